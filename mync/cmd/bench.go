@@ -0,0 +1,402 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+type benchConfig struct {
+	concurrency int
+	requests    int
+	duration    time.Duration
+	rps         float64
+	json        bool
+}
+
+// benchTarget sends a request and returns its outcome, the status code or the error, and whether it succeeded.
+type benchTarget func() (outcome string, ok bool)
+
+// benchSample is the result of a request of the benchmark.
+type benchSample struct {
+	latency time.Duration
+	outcome string
+	ok      bool
+}
+
+type benchReport struct {
+	Requests   int               `json:"requests"`
+	Successes  int               `json:"successes"`
+	Failures   int               `json:"failures"`
+	Duration   float64           `json:"duration_seconds"`
+	Throughput float64           `json:"requests_per_second"`
+	Latency    latencySummary    `json:"latency_ms"`
+	Statuses   map[string]int    `json:"statuses"`
+	Histogram  []histogramBucket `json:"histogram"`
+}
+
+// latencySummary holds latencies in milliseconds.
+type latencySummary struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// histogramBucket counts the requests whose latency is at most UpperBound milliseconds, and above the previous bucket's.
+type histogramBucket struct {
+	UpperBound float64 `json:"le_ms"`
+	Count      int     `json:"count"`
+}
+
+const histogramBuckets = 10
+
+func HandleBench(w io.Writer, args []string) error {
+	bc := benchConfig{}
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(w)
+	fs.IntVar(&bc.concurrency, "c", 10, "Number of requests sent concurrently")
+	fs.IntVar(&bc.requests, "n", 200, "Total number of requests, unless -duration is set")
+	fs.DurationVar(&bc.duration, "duration", 0, "Duration of the benchmark, instead of a number of requests")
+	fs.Float64Var(&bc.rps, "rps", 0, "Target rate in requests per second, 0 for as fast as possible")
+	fs.BoolVar(&bc.json, "json", false, "Print the report as JSON")
+	fs.Usage = func() {
+		var usageString = `
+bench: Load tests a server with a HTTP request or a unary gRPC call, each sent once without retries.
+bench: <options> http <http options> server
+bench: <options> grpc <grpc options> server`
+
+		fmt.Fprintln(w, usageString)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Options: ")
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	// the requests are paced by a ticker, which ticks at most once per nanosecond
+	if bc.concurrency < 1 || (bc.duration <= 0 && bc.requests < 1) || !(bc.rps >= 0 && bc.rps <= float64(time.Second)) {
+		return InvalidBenchOption
+	}
+	if fs.NArg() == 0 {
+		return InvalidBenchTarget
+	}
+
+	var target benchTarget
+	switch fs.Arg(0) {
+	case "http":
+		hc, err := parseHttpArgs(w, fs.Args()[1:])
+		if err != nil {
+			return err
+		}
+		if target, err = bc.httpTarget(hc); err != nil {
+			return err
+		}
+	case "grpc":
+		gc, err := parseGrpcArgs(w, fs.Args()[1:])
+		if err != nil {
+			return err
+		}
+		var closeConn func()
+		if target, closeConn, err = bc.grpcTarget(gc); err != nil {
+			return grpcError(err)
+		}
+		defer closeConn()
+	default:
+		return fmt.Errorf("%w: %s", InvalidBenchTarget, fs.Arg(0))
+	}
+
+	report := bc.run(target)
+	if bc.json {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	report.print(w)
+	return nil
+}
+
+func (bc *benchConfig) httpTarget(hc *httpConfig) (benchTarget, error) {
+	verb := strings.ToUpper(hc.verb)
+	if !httpMethods[verb] {
+		return nil, InvalidHttpMethod
+	}
+	// fail on invalid flags before the benchmark rather than on each request
+	req, err := hc.newRequest(context.Background(), verb)
+	if err != nil {
+		return nil, err
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	// the requests are sent concurrently and too many to be traced
+	hc.trace = nil
+	if t, ok := hc.transport.(*http.Transport); ok {
+		t.MaxIdleConnsPerHost = bc.concurrency
+	}
+	client := hc.client()
+	return func() (string, bool) {
+		req, err := hc.newRequest(context.Background(), verb)
+		if err != nil {
+			return benchOutcome(err), false
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return benchOutcome(httpError(err)), false
+		}
+		_, err = io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if err != nil {
+			return benchOutcome(httpError(err)), false
+		}
+		return strconv.Itoa(res.StatusCode), res.StatusCode >= 200 && res.StatusCode <= 299
+	}, nil
+}
+
+// grpcTarget dials the server and resolves the method once for all the calls, the connection
+// being closed by the returned function.
+func (bc *benchConfig) grpcTarget(gc *grpcConfig) (benchTarget, func(), error) {
+	ctx := context.Background()
+	conn, err := gc.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	target, err := func() (benchTarget, error) {
+		md, err := gc.resolve(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+		if md.IsClientStreaming() || md.IsServerStreaming() {
+			return nil, fmt.Errorf("%w: bench only calls unary methods", InvalidGrpcMethod)
+		}
+		src, err := gc.requests()
+		if err != nil {
+			return nil, err
+		}
+		defer src.Close()
+		req, err := newRequestReader(md, src).single()
+		if err != nil {
+			return nil, err
+		}
+
+		// each call is sent once
+		gc.retries = 0
+		return func() (string, bool) {
+			_, err := gc.invoke(ctx, conn, md, req)
+			if s, ok := status.FromError(err); ok {
+				return s.Code().String(), err == nil
+			}
+			return benchOutcome(err), false
+		}, nil
+	}()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return target, func() { conn.Close() }, nil
+}
+
+// benchOutcome names the outcome of a request which failed without a status.
+func benchOutcome(err error) string {
+	switch {
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, ErrNetwork):
+		return "network error"
+	default:
+		return err.Error()
+	}
+}
+
+// run sends the requests from `concurrency` workers, paced by the target rate if any, until the total
+// number of requests or the duration is reached. The requests in flight at the end of the duration complete.
+func (bc *benchConfig) run(target benchTarget) *benchReport {
+	ctx := context.Background()
+	if bc.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bc.duration)
+		defer cancel()
+	}
+	var ticks <-chan time.Time
+	if bc.rps > 0 {
+		interval := time.Duration(math.MaxInt64)
+		// rates too low for a Duration never tick anyway
+		if f := float64(time.Second) / bc.rps; f < float64(math.MaxInt64) {
+			interval = time.Duration(f)
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	var sent int64
+	samples := make([][]benchSample, bc.concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range samples {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				if bc.duration <= 0 && atomic.AddInt64(&sent, 1) > int64(bc.requests) {
+					return
+				}
+				if ticks != nil {
+					select {
+					case <-ticks:
+					case <-ctx.Done():
+						return
+					}
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				t := time.Now()
+				outcome, ok := target()
+				samples[i] = append(samples[i], benchSample{latency: time.Since(t), outcome: outcome, ok: ok})
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var all []benchSample
+	for _, s := range samples {
+		all = append(all, s...)
+	}
+	return newBenchReport(all, elapsed)
+}
+
+func newBenchReport(samples []benchSample, elapsed time.Duration) *benchReport {
+	r := &benchReport{
+		Requests: len(samples),
+		Duration: elapsed.Seconds(),
+		Statuses: make(map[string]int),
+	}
+	if len(samples) == 0 {
+		return r
+	}
+	r.Throughput = float64(len(samples)) / elapsed.Seconds()
+
+	latencies := make([]time.Duration, len(samples))
+	var total time.Duration
+	for i, s := range samples {
+		if s.ok {
+			r.Successes++
+		} else {
+			r.Failures++
+		}
+		r.Statuses[s.outcome]++
+		latencies[i] = s.latency
+		total += s.latency
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	r.Latency = latencySummary{
+		Min:  milliseconds(latencies[0]),
+		Mean: milliseconds(total / time.Duration(len(latencies))),
+		P50:  milliseconds(percentile(latencies, 50)),
+		P90:  milliseconds(percentile(latencies, 90)),
+		P99:  milliseconds(percentile(latencies, 99)),
+		Max:  milliseconds(latencies[len(latencies)-1]),
+	}
+	r.Histogram = histogram(latencies)
+	return r
+}
+
+// percentile returns the nearest-rank percentile of sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// histogram splits the range of sorted latencies in buckets of equal width.
+func histogram(sorted []time.Duration) []histogramBucket {
+	min, max := sorted[0], sorted[len(sorted)-1]
+	width := (max - min) / histogramBuckets
+	if width == 0 {
+		return []histogramBucket{{UpperBound: milliseconds(max), Count: len(sorted)}}
+	}
+	buckets := make([]histogramBucket, histogramBuckets)
+	for i := range buckets {
+		buckets[i].UpperBound = milliseconds(min + width*time.Duration(i+1))
+	}
+	// the last bucket takes the rounding of the width
+	buckets[len(buckets)-1].UpperBound = milliseconds(max)
+	for _, l := range sorted {
+		i := int((l - min) / width)
+		if i >= len(buckets) {
+			i = len(buckets) - 1
+		}
+		buckets[i].Count++
+	}
+	return buckets
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (r *benchReport) print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "Summary:")
+	fmt.Fprintf(tw, "  Requests:\t%d\n", r.Requests)
+	fmt.Fprintf(tw, "  Successes:\t%d\n", r.Successes)
+	fmt.Fprintf(tw, "  Failures:\t%d\n", r.Failures)
+	fmt.Fprintf(tw, "  Duration:\t%.3fs\n", r.Duration)
+	fmt.Fprintf(tw, "  Throughput:\t%.2f req/s\n", r.Throughput)
+	tw.Flush()
+	if r.Requests == 0 {
+		return
+	}
+
+	fmt.Fprintln(tw, "\nLatency:")
+	for _, l := range []struct {
+		name string
+		ms   float64
+	}{
+		{"min", r.Latency.Min}, {"mean", r.Latency.Mean}, {"p50", r.Latency.P50},
+		{"p90", r.Latency.P90}, {"p99", r.Latency.P99}, {"max", r.Latency.Max},
+	} {
+		fmt.Fprintf(tw, "  %s:\t%.3fms\n", l.name, l.ms)
+	}
+
+	fmt.Fprintln(tw, "\nStatus codes:")
+	for _, s := range sortedKeys(r.Statuses) {
+		fmt.Fprintf(tw, "  %s:\t%d\n", s, r.Statuses[s])
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nHistogram:")
+	most := 0
+	for _, b := range r.Histogram {
+		if b.Count > most {
+			most = b.Count
+		}
+	}
+	for _, b := range r.Histogram {
+		bar := strings.Repeat("∎", b.Count*40/most)
+		fmt.Fprintf(tw, "  %.3fms\t[%d]\t%s\n", b.UpperBound, b.Count, bar)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBenchHttp(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Bench") != "yes" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if atomic.AddInt32(&calls, 1)%4 == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	err := HandleBench(&buf, []string{"-n", "40", "-c", "4", "-json", "http", "-H", "X-Bench: yes", ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report benchReport
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("invalid report %q: %v", buf.String(), err)
+	}
+	if report.Requests != 40 || calls != 40 {
+		t.Errorf("Expected 40 requests, Got: %d reported and %d received", report.Requests, calls)
+	}
+	if report.Successes != 30 || report.Failures != 10 || report.Statuses["200"] != 30 || report.Statuses["503"] != 10 {
+		t.Errorf("Expected 30 200 and 10 503, Got: %+v", report)
+	}
+	l := report.Latency
+	if !(l.Min <= l.P50 && l.P50 <= l.P90 && l.P90 <= l.P99 && l.P99 <= l.Max && l.Min <= l.Mean && l.Mean <= l.Max) {
+		t.Errorf("Expected ordered latencies, Got: %+v", l)
+	}
+	count := 0
+	for _, b := range report.Histogram {
+		count += b.Count
+	}
+	if count != 40 || report.Histogram[len(report.Histogram)-1].UpperBound != l.Max {
+		t.Errorf("Expected a histogram of the 40 requests up to the max latency, Got: %+v", report.Histogram)
+	}
+
+	// text report
+	buf.Reset()
+	if err := HandleBench(&buf, []string{"-n", "8", "http", "-H", "X-Bench: yes", ts.URL}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"Requests:    8\n", "p99:", "Status codes:\n", "Histogram:\n"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("Expected %q in: %s", s, buf.String())
+		}
+	}
+}
+
+func TestBenchRate(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	err := HandleBench(&buf, []string{"-duration", "500ms", "-rps", "40", "-c", "4", "-json", "http", ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report benchReport
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("invalid report %q: %v", buf.String(), err)
+	}
+	// 20 at the target rate
+	if report.Requests < 10 || report.Requests > 21 || int32(report.Requests) != calls {
+		t.Errorf("Expected about 20 requests, Got: %d reported and %d received", report.Requests, calls)
+	}
+	if report.Duration < 0.5 {
+		t.Errorf("Expected a duration of 500ms, Got: %fs", report.Duration)
+	}
+}
+
+func TestBenchGrpc(t *testing.T) {
+	users := &flakyUserService{failures: 5}
+	gc := grpcConfig{
+		server:      "bufnet",
+		method:      "Users/GetUser",
+		body:        `{"email": "jane@example.com"}`,
+		retries:     3,
+		dialOptions: startTestGrpcServerWith(t, users, true),
+	}
+	bc := benchConfig{concurrency: 5, requests: 50}
+	target, closeConn, err := bc.grpcTarget(&gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeConn()
+	report := bc.run(target)
+	// the calls aren't retried
+	if report.Requests != 50 || report.Statuses["OK"] != 45 || report.Statuses["Unavailable"] != 5 || users.calls != 50 {
+		t.Errorf("Expected 45 OK and 5 Unavailable, Got: %+v", report.Statuses)
+	}
+
+	gc.method = "Repo/GetRepos"
+	if _, _, err = bc.grpcTarget(&gc); !errors.Is(err, InvalidGrpcMethod) {
+		t.Errorf("Expected error %v, Got: %v", InvalidGrpcMethod, err)
+	}
+}
+
+func TestBenchInvalid(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  error
+	}{
+		{args: []string{"-c", "0", "http", "http://localhost"}, err: InvalidBenchOption},
+		{args: []string{"-n", "0", "http", "http://localhost"}, err: InvalidBenchOption},
+		{args: []string{"-rps", "-1", "http", "http://localhost"}, err: InvalidBenchOption},
+		{args: []string{"-rps", "2e9", "http", "http://localhost"}, err: InvalidBenchOption},
+		{args: []string{"-rps", "NaN", "http", "http://localhost"}, err: InvalidBenchOption},
+		{args: []string{}, err: InvalidBenchTarget},
+		{args: []string{"ws", "http://localhost"}, err: InvalidBenchTarget},
+		{args: []string{"http", "-verb", "FOO", "http://localhost"}, err: InvalidHttpMethod},
+		{args: []string{"http"}, err: ErrNoServerSpecified},
+	}
+	for _, tc := range tests {
+		err := HandleBench(&bytes.Buffer{}, tc.args)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%v: Expected error %v, Got: %v", tc.args, tc.err, err)
+		}
+	}
+}
+
+func TestPercentileAndHistogram(t *testing.T) {
+	var latencies []time.Duration
+	for i := 1; i <= 100; i++ {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	for _, p := range []struct {
+		p        float64
+		expected time.Duration
+	}{
+		{50, 50 * time.Millisecond},
+		{90, 90 * time.Millisecond},
+		{99, 99 * time.Millisecond},
+		{100, 100 * time.Millisecond},
+	} {
+		if got := percentile(latencies, p.p); got != p.expected {
+			t.Errorf("p%v: Expected %v, Got: %v", p.p, p.expected, got)
+		}
+	}
+
+	buckets := histogram(latencies)
+	if len(buckets) != histogramBuckets {
+		t.Fatalf("Expected %d buckets, Got: %d", histogramBuckets, len(buckets))
+	}
+	for i, b := range buckets {
+		if b.Count < 9 || b.Count > 11 {
+			t.Errorf("bucket %d: Expected about 10 latencies, Got: %d", i, b.Count)
+		}
+	}
+
+	same := histogram([]time.Duration{time.Millisecond, time.Millisecond})
+	if len(same) != 1 || same[0].Count != 2 {
+		t.Errorf("Expected a single bucket, Got: %+v", same)
+	}
+}
@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// cookieJar is a cookie jar kept in a file between the runs of mync, as a JSON list of cookies.
+// The cookies are recorded as they're set, cookiejar.Jar not listing the ones it holds, and only
+// when the jar accepted them: it rejects those set for another domain or for a public suffix.
+type cookieJar struct {
+	*cookiejar.Jar
+	path string
+
+	mu      sync.Mutex
+	cookies map[string]savedCookie
+}
+
+// savedCookie is a cookie of the jar's file with the URL which set it.
+type savedCookie struct {
+	URL      string     `json:"url"`
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Domain   string     `json:"domain,omitempty"`
+	Path     string     `json:"path"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+	HttpOnly bool       `json:"http_only,omitempty"`
+}
+
+// loadCookieJar reads the jar's file, which doesn't exist before the first run.
+func loadCookieJar(path string) (*cookieJar, error) {
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, err
+	}
+	j := &cookieJar{Jar: jar, path: path, cookies: make(map[string]savedCookie)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved []savedCookie
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return nil, fmt.Errorf("%w %s: %s", InvalidCookieJar, path, err)
+	}
+	now := time.Now()
+	for _, sc := range saved {
+		u, err := url.Parse(sc.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s: %s", InvalidCookieJar, path, err)
+		}
+		if sc.Expires != nil && sc.Expires.Before(now) {
+			continue
+		}
+		c := &http.Cookie{
+			Name:     sc.Name,
+			Value:    sc.Value,
+			Domain:   sc.Domain,
+			Path:     sc.Path,
+			Secure:   sc.Secure,
+			HttpOnly: sc.HttpOnly,
+		}
+		if sc.Expires != nil {
+			c.Expires = *sc.Expires
+		}
+		j.Jar.SetCookies(u, []*http.Cookie{c})
+		if j.holds(u, c, sc.Path) {
+			j.cookies[cookieKey(u, c)] = sc
+		}
+	}
+	return j, nil
+}
+
+func (j *cookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	for _, c := range cookies {
+		path := c.Path
+		if len(path) == 0 || path[0] != '/' {
+			path = defaultCookiePath(u.Path)
+		}
+		key := cookieKey(u, c)
+		var expires *time.Time
+		switch {
+		case c.MaxAge < 0:
+			delete(j.cookies, key)
+			continue
+		case c.MaxAge > 0:
+			t := now.Add(time.Duration(c.MaxAge) * time.Second)
+			expires = &t
+		case !c.Expires.IsZero():
+			if c.Expires.Before(now) {
+				delete(j.cookies, key)
+				continue
+			}
+			t := c.Expires
+			expires = &t
+		}
+		if !j.holds(u, c, path) {
+			continue
+		}
+		j.cookies[key] = savedCookie{
+			URL:      (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: path}).String(),
+			Name:     c.Name,
+			Value:    c.Value,
+			Domain:   c.Domain,
+			Path:     path,
+			Expires:  expires,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+	}
+}
+
+// holds reports whether the jar sends the cookie `c`, set by `u` with the path `path`, back to `u`'s host.
+func (j *cookieJar) holds(u *url.URL, c *http.Cookie, path string) bool {
+	scheme := u.Scheme
+	if c.Secure {
+		scheme = "https"
+	}
+	for _, held := range j.Jar.Cookies(&url.URL{Scheme: scheme, Host: u.Host, Path: path}) {
+		if held.Name == c.Name && held.Value == c.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the cookies which haven't expired to the jar's file, readable by its owner only.
+func (j *cookieJar) save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	saved := make([]savedCookie, 0, len(j.cookies))
+	for _, k := range sortedKeys(j.cookies) {
+		if sc := j.cookies[k]; sc.Expires == nil || sc.Expires.After(now) {
+			saved = append(saved, sc)
+		}
+	}
+	b, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(j.path, append(b, '\n'), 0600)
+}
+
+// cookieKey identifies a cookie by its domain, or its host without a Domain attribute, its path and its name.
+func cookieKey(u *url.URL, c *http.Cookie) string {
+	domain := strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+	if len(domain) == 0 {
+		domain = strings.ToLower(u.Hostname())
+	}
+	path := c.Path
+	if len(path) == 0 || path[0] != '/' {
+		path = defaultCookiePath(u.Path)
+	}
+	return domain + ";" + path + ";" + c.Name
+}
+
+// defaultCookiePath is the path of a cookie set without a Path attribute, as defined by RFC 6265 section 5.1.4.
+func defaultCookiePath(path string) string {
+	if len(path) == 0 || path[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndex(path, "/")
+	if i == 0 {
+		return "/"
+	}
+	return path[:i]
+}
@@ -0,0 +1,690 @@
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kballard/go-shellquote"
+	"gopkg.in/yaml.v3"
+)
+
+// curlOption is an option of curl which mync translates, `apply` setting it on the command.
+type curlOption struct {
+	takesValue bool
+	apply      func(c *curlCommand, v string) error
+}
+
+// curlIgnored are the options of curl which don't change the request, as the display ones.
+var curlIgnored = map[string]bool{
+	"silent":            true,
+	"show-error":        true,
+	"progress-bar":      true,
+	"no-progress-meter": true,
+	"compressed":        true,
+	"fail":              true,
+	"globoff":           true,
+}
+
+// curlShortOptions maps the short options of curl to their long name.
+var curlShortOptions = map[byte]string{
+	'X': "request",
+	'H': "header",
+	'd': "data",
+	'F': "form",
+	'u': "user",
+	'G': "get",
+	'I': "head",
+	'i': "include",
+	'L': "location",
+	'k': "insecure",
+	'E': "cert",
+	'x': "proxy",
+	'b': "cookie",
+	'c': "cookie-jar",
+	'o': "output",
+	'C': "continue-at",
+	'm': "max-time",
+	'A': "user-agent",
+	'e': "referer",
+	'v': "verbose",
+	's': "silent",
+	'S': "show-error",
+	'#': "progress-bar",
+	'f': "fail",
+	'g': "globoff",
+}
+
+var curlOptions map[string]curlOption
+
+func init() {
+	data := curlOption{true, func(c *curlCommand, v string) error {
+		c.data = append(c.data, v)
+		return nil
+	}}
+	header := func(name string) curlOption {
+		return curlOption{true, func(c *curlCommand, v string) error {
+			c.hc.headers = append(c.hc.headers, name+": "+v)
+			return nil
+		}}
+	}
+	flag := func(set func(c *curlCommand)) curlOption {
+		return curlOption{false, func(c *curlCommand, _ string) error {
+			set(c)
+			return nil
+		}}
+	}
+	value := func(set func(c *curlCommand, v string)) curlOption {
+		return curlOption{true, func(c *curlCommand, v string) error {
+			set(c, v)
+			return nil
+		}}
+	}
+
+	curlOptions = map[string]curlOption{
+		"request": value(func(c *curlCommand, v string) { c.verb = strings.ToUpper(v) }),
+		"header": value(func(c *curlCommand, v string) {
+			c.hc.headers = append(c.hc.headers, v)
+		}),
+		"data":        data,
+		"data-raw":    data,
+		"data-binary": data,
+		"data-ascii":  data,
+		"json": value(func(c *curlCommand, v string) {
+			c.data = append(c.data, v)
+			c.hc.headers = append(c.hc.headers, "Accept: application/json")
+		}),
+		"form": {true, func(c *curlCommand, v string) error {
+			field, content, ok := strings.Cut(v, "=")
+			if !ok {
+				return fmt.Errorf("%w: -F %s", InvalidFormData, v)
+			}
+			switch {
+			case strings.HasPrefix(content, "@"):
+				// the type and the file name given after ; are left to mync
+				path, _, _ := strings.Cut(strings.TrimPrefix(content, "@"), ";")
+				c.hc.uploads = append(c.hc.uploads, field+"=@"+path)
+			case strings.HasPrefix(content, "<"):
+				return fmt.Errorf("%w: -F %s, mync reads files as uploads only", UnsupportedCurlOption, v)
+			default:
+				c.hc.formData = append(c.hc.formData, v)
+			}
+			return nil
+		}},
+		"form-string": value(func(c *curlCommand, v string) { c.hc.formData = append(c.hc.formData, v) }),
+		"user":        value(func(c *curlCommand, v string) { c.hc.basicAuth = v }),
+		"oauth2-bearer": value(func(c *curlCommand, v string) {
+			c.hc.bearerToken = v
+		}),
+		"get":     flag(func(c *curlCommand) { c.get = true }),
+		"head":    flag(func(c *curlCommand) { c.head = true }),
+		"include": flag(func(c *curlCommand) { c.hc.include = true }),
+		"location": flag(func(c *curlCommand) {
+			c.hc.noRedirect = false
+		}),
+		"max-redirs": {true, func(c *curlCommand, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%w: --max-redirs %s", InvalidCurlCommand, v)
+			}
+			c.hc.maxRedirects = n
+			return nil
+		}},
+		"insecure": flag(func(c *curlCommand) { c.hc.insecure = true }),
+		"cacert":   value(func(c *curlCommand, v string) { c.hc.caCert = v }),
+		"cert":     value(func(c *curlCommand, v string) { c.hc.clientCert = v }),
+		"key":      value(func(c *curlCommand, v string) { c.hc.clientKey = v }),
+		"proxy":    value(func(c *curlCommand, v string) { c.hc.proxy = v }),
+		"cookie": {true, func(c *curlCommand, v string) error {
+			// cookies are given as name=value, else it's the file they're read from
+			if !strings.Contains(v, "=") {
+				return fmt.Errorf("%w: -b %s, curl's cookie files aren't mync's JSON cookie jars", UnsupportedCurlOption, v)
+			}
+			c.hc.headers = append(c.hc.headers, "Cookie: "+v)
+			return nil
+		}},
+		"cookie-jar": {true, func(c *curlCommand, v string) error {
+			return fmt.Errorf("%w: -c %s, curl's cookie files aren't mync's JSON cookie jars", UnsupportedCurlOption, v)
+		}},
+		"output": value(func(c *curlCommand, v string) { c.hc.output.path = v }),
+		"continue-at": {true, func(c *curlCommand, v string) error {
+			if v != "-" {
+				return fmt.Errorf("%w: -C %s, mync continues where the file ends, as -C -", UnsupportedCurlOption, v)
+			}
+			c.hc.resume = true
+			return nil
+		}},
+		"http2":                 flag(func(c *curlCommand) { c.hc.http2 = true }),
+		"http2-prior-knowledge": flag(func(c *curlCommand) { c.hc.http2 = true }),
+		"http1.1":               flag(func(c *curlCommand) { c.hc.http11 = true }),
+		"max-time": {true, func(c *curlCommand, v string) error {
+			secs, err := strconv.ParseFloat(v, 64)
+			if err != nil || secs < 0 {
+				return fmt.Errorf("%w: --max-time %s", InvalidCurlCommand, v)
+			}
+			c.hc.timeout = time.Duration(secs * float64(time.Second))
+			return nil
+		}},
+		"retry": {true, func(c *curlCommand, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%w: --retry %s", InvalidCurlCommand, v)
+			}
+			c.hc.retries = n
+			return nil
+		}},
+		"user-agent": header("User-Agent"),
+		"referer":    header("Referer"),
+		"verbose":    flag(func(c *curlCommand) { c.hc.verbose = true }),
+		"url":        value(func(c *curlCommand, v string) { c.urls = append(c.urls, v) }),
+	}
+}
+
+// curlCommand is a curl command line being translated.
+type curlCommand struct {
+	hc   *httpConfig
+	verb string
+	// data are the bodies given with -d and its variants, joined with & by curl
+	data []string
+	get  bool
+	head bool
+	urls []string
+}
+
+func HandleImportCurl(w io.Writer, args []string) error {
+	var asCollection bool
+	var name string
+	fs := flag.NewFlagSet("import-curl", flag.ContinueOnError)
+	fs.SetOutput(w)
+	fs.BoolVar(&asCollection, "collection", false, "Print the request as an entry of a collection, for mync run")
+	fs.StringVar(&name, "name", "", "Name of the request in the collection, the method and the path by default")
+	fs.Usage = func() {
+		var usageString = `
+import-curl: Translates a curl command line into the mync http command.
+import-curl: <options> 'curl command'
+import-curl: <options> -- curl arguments...`
+
+		fmt.Fprintln(w, usageString)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Options: ")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return ErrNoCurlCommand
+	}
+	words := fs.Args()
+	if len(words) == 1 {
+		var err error
+		if words, err = splitCommandLine(fs.Arg(0)); err != nil {
+			return err
+		}
+	}
+
+	hc, err := parseCurl(words)
+	if err != nil {
+		return err
+	}
+	if !asCollection {
+		fmt.Fprintln(w, shellJoin(append([]string{"mync", "http"}, hc.commandLine()...)))
+		return nil
+	}
+	saved, err := hc.savedRequest(name)
+	if err != nil {
+		return err
+	}
+	b, err := yaml.Marshal([]savedRequest{*saved})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// splitCommandLine splits a command line as a POSIX shell, lines ending with a backslash being continued.
+func splitCommandLine(line string) ([]string, error) {
+	line = strings.NewReplacer("\\\r\n", " ", "\\\n", " ").Replace(line)
+	words, err := shellquote.Split(line)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", InvalidCurlCommand, err)
+	}
+	return words, nil
+}
+
+// parseCurl translates the arguments of curl, the command name included or not, into the configuration of the http command.
+func parseCurl(words []string) (*httpConfig, error) {
+	if len(words) > 0 && filepath.Base(words[0]) == "curl" {
+		words = words[1:]
+	}
+	// curl follows redirects with -L only
+	c := &curlCommand{hc: &httpConfig{maxRedirects: 10, noRedirect: true, output: outputConfig{format: formatRaw}}}
+
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		if !strings.HasPrefix(word, "-") || word == "-" {
+			c.urls = append(c.urls, word)
+			continue
+		}
+
+		// the options and their value if joined to a short option, as -XPOST or -sSL
+		var names []string
+		var joined string
+		if strings.HasPrefix(word, "--") {
+			names = []string{strings.TrimPrefix(word, "--")}
+		} else {
+			for j := 1; j < len(word); j++ {
+				name, ok := curlShortOptions[word[j]]
+				if !ok {
+					return nil, fmt.Errorf("%w: -%c", UnsupportedCurlOption, word[j])
+				}
+				names = append(names, name)
+				if opt, ok := curlOptions[name]; ok && opt.takesValue {
+					joined = word[j+1:]
+					break
+				}
+			}
+		}
+
+		for _, name := range names {
+			if curlIgnored[name] {
+				continue
+			}
+			opt, ok := curlOptions[name]
+			if !ok {
+				return nil, fmt.Errorf("%w: --%s", UnsupportedCurlOption, name)
+			}
+			var v string
+			if opt.takesValue {
+				if len(joined) > 0 {
+					v = joined
+				} else if i+1 < len(words) {
+					i++
+					v = words[i]
+				} else {
+					return nil, fmt.Errorf("%w: %s takes a value", InvalidCurlCommand, word)
+				}
+			}
+			if err := opt.apply(c, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c.httpConfig()
+}
+
+// httpConfig completes the configuration once all the options are read.
+func (c *curlCommand) httpConfig() (*httpConfig, error) {
+	hc := c.hc
+	if len(c.urls) != 1 {
+		return nil, fmt.Errorf("%w: expected a URL, got %q", InvalidCurlCommand, c.urls)
+	}
+	hc.url = c.urls[0]
+	if !strings.Contains(hc.url, "://") {
+		hc.url = "http://" + hc.url
+	}
+
+	hc.verb = http.MethodGet
+	body := strings.Join(c.data, "&")
+	switch {
+	case c.get:
+		// the data is sent in the query
+		for _, param := range strings.Split(body, "&") {
+			if len(param) > 0 {
+				hc.query = append(hc.query, param)
+			}
+		}
+	case len(c.data) == 1 && strings.HasPrefix(body, "@"):
+		hc.filePath = strings.TrimPrefix(body, "@")
+		hc.verb = http.MethodPost
+	case len(c.data) > 0 && json.Valid([]byte(body)):
+		hc.body = body
+		hc.verb = http.MethodPost
+	case len(c.data) > 0:
+		// curl posts the data as a form, encoded already
+		form, err := formFields(body)
+		if err != nil {
+			return nil, err
+		}
+		hc.form = form
+		hc.verb = http.MethodPost
+	case len(hc.formData) > 0 || len(hc.uploads) > 0:
+		hc.verb = http.MethodPost
+	}
+	if c.head {
+		hc.verb = http.MethodHead
+		hc.include = true
+	}
+	if len(c.verb) > 0 {
+		hc.verb = c.verb
+	}
+
+	// mync sets the content type of the bodies, and takes the bearer token on its own
+	headers := hc.headers[:0]
+	for _, h := range hc.headers {
+		name, v, _ := strings.Cut(h, ":")
+		name, v = http.CanonicalHeaderKey(strings.TrimSpace(name)), strings.TrimSpace(v)
+		switch {
+		case name == "Content-Type" && strings.HasPrefix(v, "application/json") && (len(hc.body) > 0 || len(hc.filePath) > 0):
+			continue
+		case name == "Content-Type" && strings.HasPrefix(v, "multipart/form-data"):
+			continue
+		case name == "Content-Type" && strings.HasPrefix(v, "application/x-www-form-urlencoded") && len(hc.form) > 0:
+			continue
+		case name == "Authorization" && strings.HasPrefix(v, "Bearer ") && len(hc.bearerToken) == 0:
+			hc.bearerToken = strings.TrimPrefix(v, "Bearer ")
+			continue
+		}
+		headers = append(headers, h)
+	}
+	hc.headers = headers
+	return hc, nil
+}
+
+// formFields decodes the data of a form, as key=value pairs joined by &, into the fields of -form.
+func formFields(data string) ([]string, error) {
+	var fields []string
+	for _, param := range strings.Split(data, "&") {
+		if len(param) == 0 {
+			continue
+		}
+		k, v, ok := strings.Cut(param, "=")
+		if ok {
+			var errK, errV error
+			k, errK = url.QueryUnescape(k)
+			v, errV = url.QueryUnescape(v)
+			ok = errK == nil && errV == nil && len(k) > 0 && !strings.Contains(k, "=")
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: mync sends JSON or form bodies, got %s", UnsupportedCurlOption, data)
+		}
+		fields = append(fields, k+"="+v)
+	}
+	return fields, nil
+}
+
+// commandLine returns the options and the URL of the mync http command sending the request.
+func (hc *httpConfig) commandLine() []string {
+	var args []string
+	add := func(a ...string) {
+		args = append(args, a...)
+	}
+	if verb := strings.ToUpper(hc.verb); len(verb) > 0 && verb != http.MethodGet {
+		add("-verb", verb)
+	}
+	for _, h := range hc.headers {
+		add("-H", h)
+	}
+	for _, q := range hc.query {
+		add("-query", q)
+	}
+	if len(hc.body) > 0 {
+		add("-body", hc.body)
+	}
+	if len(hc.filePath) > 0 {
+		add("-body-file", hc.filePath)
+	}
+	for _, f := range hc.formData {
+		add("-form-data", f)
+	}
+	for _, f := range hc.form {
+		add("-form", f)
+	}
+	for _, u := range hc.uploads {
+		add("-upload", u)
+	}
+	if len(hc.basicAuth) > 0 {
+		add("-basic-auth", hc.basicAuth)
+	}
+	if len(hc.bearerToken) > 0 {
+		add("-bearer", hc.bearerToken)
+	}
+	if hc.include {
+		add("-include")
+	}
+	if hc.timeout > 0 {
+		add("-timeout", hc.timeout.String())
+	}
+	if hc.retries > 0 {
+		add("-retries", strconv.Itoa(hc.retries))
+	}
+	if hc.noRedirect {
+		add("-no-redirect")
+	} else if hc.maxRedirects != 10 {
+		add("-max-redirects", strconv.Itoa(hc.maxRedirects))
+	}
+	if len(hc.output.path) > 0 {
+		add("-output", hc.output.path)
+	}
+	if hc.resume {
+		add("-continue")
+	}
+	if len(hc.proxy) > 0 {
+		add("-proxy", hc.proxy)
+	}
+	if len(hc.cookieJar) > 0 {
+		add("-cookie-jar", hc.cookieJar)
+	}
+	if hc.http2 {
+		add("-http2")
+	}
+	if hc.http11 {
+		add("-http1.1")
+	}
+	if len(hc.caCert) > 0 {
+		add("-cacert", hc.caCert)
+	}
+	if len(hc.clientCert) > 0 {
+		add("-cert", hc.clientCert)
+	}
+	if len(hc.clientKey) > 0 {
+		add("-key", hc.clientKey)
+	}
+	if hc.insecure {
+		add("-insecure")
+	}
+	if hc.verbose {
+		add("-verbose")
+	}
+	return append(args, hc.url)
+}
+
+// savedRequest returns the request as an entry of a collection, which holds the request itself
+// but not how it's sent, mync run following the redirects.
+func (hc *httpConfig) savedRequest(name string) (*savedRequest, error) {
+	if len(hc.filePath) > 0 || len(hc.formData) > 0 || len(hc.form) > 0 || len(hc.uploads) > 0 || len(hc.output.path) > 0 || hc.resume ||
+		len(hc.proxy) > 0 || len(hc.cookieJar) > 0 || hc.http2 || hc.http11 || len(hc.caCert) > 0 || len(hc.clientCert) > 0 ||
+		hc.insecure {
+		return nil, fmt.Errorf("%w: only the method, URL, headers, JSON body, credentials, timeout and retries are", ErrNotInCollection)
+	}
+
+	u, err := url.Parse(hc.url)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", InvalidCurlCommand, err)
+	}
+	if len(name) == 0 {
+		name = hc.verb + " " + u.Path
+	}
+	saved := &savedHttp{
+		Verb:      hc.verb,
+		Url:       hc.url,
+		BasicAuth: hc.basicAuth,
+		Bearer:    hc.bearerToken,
+		Timeout:   hc.timeout,
+		Retries:   hc.retries,
+	}
+	for _, h := range hc.headers {
+		k, v, _ := strings.Cut(h, ":")
+		if saved.Headers == nil {
+			saved.Headers = make(map[string]string)
+		}
+		saved.Headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	for _, q := range hc.query {
+		k, v, _ := strings.Cut(q, "=")
+		if saved.Query == nil {
+			saved.Query = make(map[string]string)
+		}
+		saved.Query[k] = v
+	}
+	if len(hc.body) > 0 {
+		// the body is kept structured, to be edited in the collection
+		if err = json.Unmarshal([]byte(hc.body), &saved.Body); err != nil {
+			return nil, fmt.Errorf("%w: %s", InvalidJsonBody, err)
+		}
+	}
+	return &savedRequest{Name: name, Http: saved}, nil
+}
+
+// curlCommand returns the curl command sending the same request as the http command.
+// The cookie jar is left out, curl can't read mync's.
+func (hc *httpConfig) curlCommand() string {
+	args := []string{"curl"}
+	add := func(a ...string) {
+		args = append(args, a...)
+	}
+	switch verb := strings.ToUpper(hc.verb); {
+	case verb == http.MethodHead:
+		add("--head")
+	case verb == http.MethodPost && (len(hc.body) > 0 || len(hc.filePath) > 0 || len(hc.formData) > 0 || len(hc.form) > 0 || len(hc.uploads) > 0):
+		// implied by the body
+	case verb != http.MethodGet:
+		add("-X", verb)
+	}
+	if len(hc.body) > 0 || len(hc.filePath) > 0 {
+		add("-H", "Content-Type: application/json")
+	}
+	if len(hc.bearerToken) > 0 {
+		add("-H", "Authorization: Bearer "+hc.bearerToken)
+	}
+	for _, h := range hc.headers {
+		add("-H", h)
+	}
+	if len(hc.body) > 0 {
+		add("--data-raw", hc.body)
+	}
+	if len(hc.filePath) > 0 {
+		add("--data-binary", "@"+hc.filePath)
+	}
+	for _, f := range hc.formData {
+		add("--form-string", f)
+	}
+	for _, f := range hc.form {
+		k, v, _ := strings.Cut(f, "=")
+		add("-d", url.QueryEscape(k)+"="+url.QueryEscape(v))
+	}
+	for _, u := range hc.uploads {
+		add("-F", u)
+	}
+	if len(hc.basicAuth) > 0 {
+		add("-u", hc.basicAuth)
+	}
+	if hc.include && strings.ToUpper(hc.verb) != http.MethodHead {
+		add("-i")
+	}
+	if hc.timeout > 0 {
+		add("--max-time", strconv.FormatFloat(hc.timeout.Seconds(), 'f', -1, 64))
+	}
+	if hc.retries > 0 {
+		add("--retry", strconv.Itoa(hc.retries))
+	}
+	if !hc.noRedirect {
+		add("-L")
+		if hc.maxRedirects != 10 {
+			add("--max-redirs", strconv.Itoa(hc.maxRedirects))
+		}
+	}
+	if len(hc.output.path) > 0 {
+		add("-o", hc.output.path)
+	}
+	if hc.resume {
+		add("-C", "-")
+	}
+	if len(hc.proxy) > 0 {
+		add("-x", hc.proxy)
+	}
+	if hc.http2 {
+		if strings.HasPrefix(hc.url, "http://") {
+			add("--http2-prior-knowledge")
+		} else {
+			add("--http2")
+		}
+	}
+	if hc.http11 {
+		add("--http1.1")
+	}
+	if len(hc.caCert) > 0 {
+		add("--cacert", hc.caCert)
+	}
+	if len(hc.clientCert) > 0 {
+		add("--cert", hc.clientCert)
+	}
+	if len(hc.clientKey) > 0 {
+		add("--key", hc.clientKey)
+	}
+	if hc.insecure {
+		add("-k")
+	}
+	if hc.verbose {
+		add("-v")
+	}
+
+	// curl takes the query in the URL
+	target := hc.url
+	if u, err := url.Parse(hc.url); err == nil && hc.addQuery(u) == nil {
+		target = u.String()
+	}
+	add(target)
+	return shellJoin(args)
+}
+
+// grpcurlCommand returns the grpcurl command calling the same method as the grpc command, mync
+// dialing the servers without TLS.
+func (gc *grpcConfig) grpcurlCommand() string {
+	args := []string{"grpcurl", "-plaintext"}
+	for _, p := range gc.importPaths {
+		args = append(args, "-import-path", p)
+	}
+	for _, p := range gc.protoFiles {
+		args = append(args, "-proto", p)
+	}
+	for _, p := range gc.protosets {
+		args = append(args, "-protoset", p)
+	}
+	if gc.timeout > 0 {
+		args = append(args, "-max-time", strconv.FormatFloat(gc.timeout.Seconds(), 'f', -1, 64))
+	}
+	switch {
+	case len(gc.bodyFile) > 0:
+		// grpcurl reads the body from the standard input
+		args = append(args, "-d", "@")
+	case len(gc.body) > 0:
+		args = append(args, "-d", gc.body)
+	}
+	cmd := shellJoin(append(args, gc.server, gc.method))
+	if len(gc.bodyFile) > 0 && gc.bodyFile != "-" {
+		cmd += " < " + shellJoin([]string{gc.bodyFile})
+	}
+	return cmd
+}
+
+// shellJoin joins the words into a POSIX shell command line, quoting those which need it in single quotes.
+func shellJoin(words []string) string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		if len(word) > 0 && strings.Trim(word, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=@,+%") == "" {
+			quoted[i] = word
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
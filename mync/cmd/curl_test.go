@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestImportCurl(t *testing.T) {
+	for _, tc := range []struct {
+		curl     string
+		expected string
+	}{
+		{"curl http://localhost:8080/users", "mync http -no-redirect http://localhost:8080/users"},
+		{"curl -sSL example.com", "mync http http://example.com"},
+		{
+			`curl -X POST 'https://api.example.com/users?page=2' -H 'Content-Type: application/json' -d '{"name": "jane"}'`,
+			`mync http -verb POST -body '{"name": "jane"}' -no-redirect 'https://api.example.com/users?page=2'`,
+		},
+		{
+			"curl -XDELETE -H 'Authorization: Bearer abc' -H 'X-Request-Id: 1' https://example.com/users/1",
+			"mync http -verb DELETE -H 'X-Request-Id: 1' -bearer abc -no-redirect https://example.com/users/1",
+		},
+		{
+			"curl \\\n  --json '{\"a\": 1}' \\\n  -u jane:secret --url https://example.com",
+			`mync http -verb POST -H 'Accept: application/json' -body '{"a": 1}' -basic-auth jane:secret -no-redirect https://example.com`,
+		},
+		{"curl -d @users.json -X PUT example.com", "mync http -verb PUT -body-file users.json -no-redirect http://example.com"},
+		{"curl -G -d q=go -d page=2 example.com/search", "mync http -query q=go -query page=2 -no-redirect http://example.com/search"},
+		{
+			"curl -H 'Content-Type: application/x-www-form-urlencoded' -d 'name=jane%20doe&expr=a%3Db' -d page=2 example.com/users",
+			"mync http -verb POST -form 'name=jane doe' -form expr=a=b -form page=2 -no-redirect http://example.com/users",
+		},
+		{
+			"curl -F 'file=@a.txt;type=text/plain' -F name=x example.com/upload",
+			"mync http -verb POST -form-data name=x -upload file=@a.txt -no-redirect http://example.com/upload",
+		},
+		{"curl -I -L --max-redirs 3 example.com", "mync http -verb HEAD -include -max-redirects 3 http://example.com"},
+		{"curl -m 2.5 --retry 3 -i example.com", "mync http -include -timeout 2.5s -retries 3 -no-redirect http://example.com"},
+		{
+			"curl -A mync/1 -b 'session=abc' -e https://example.com example.com",
+			"mync http -H 'User-Agent: mync/1' -H 'Cookie: session=abc' -H 'Referer: https://example.com' -no-redirect http://example.com",
+		},
+		{
+			"curl -o out.bin -C - -x socks5://localhost:1080 example.com",
+			"mync http -no-redirect -output out.bin -continue -proxy socks5://localhost:1080 http://example.com",
+		},
+		{
+			"curl --http2 --cacert ca.pem -E client.pem --key client.key -kv https://example.com",
+			"mync http -no-redirect -http2 -cacert ca.pem -cert client.pem -key client.key -insecure -verbose https://example.com",
+		},
+		{"curl --http1.1 --compressed https://example.com", "mync http -no-redirect -http1.1 https://example.com"},
+	} {
+		var buf bytes.Buffer
+		if err := HandleImportCurl(&buf, []string{tc.curl}); err != nil {
+			t.Errorf("%s: %v", tc.curl, err)
+			continue
+		}
+		if got := strings.TrimSuffix(buf.String(), "\n"); got != tc.expected {
+			t.Errorf("%s: Expected %s, Got: %s", tc.curl, tc.expected, got)
+		}
+	}
+
+	// the arguments of curl given as they are
+	var buf bytes.Buffer
+	if err := HandleImportCurl(&buf, []string{"--", "curl", "-H", "X-A: it's", "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "mync http -H 'X-A: it'\\''s' -no-redirect http://example.com\n"; buf.String() != expected {
+		t.Errorf("Expected %q, Got: %q", expected, buf.String())
+	}
+}
+
+func TestImportCurlErrors(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		expected error
+	}{
+		{nil, ErrNoCurlCommand},
+		{[]string{"curl -d hello example.com"}, UnsupportedCurlOption},
+		{[]string{"curl -d a=%zz example.com"}, UnsupportedCurlOption},
+		{[]string{"-collection", "curl -d a=b example.com"}, ErrNotInCollection},
+		{[]string{"curl --digest example.com"}, UnsupportedCurlOption},
+		{[]string{"curl -Z example.com"}, UnsupportedCurlOption},
+		{[]string{"curl -C 100 example.com"}, UnsupportedCurlOption},
+		{[]string{"curl -F 'a=<b.txt' example.com"}, UnsupportedCurlOption},
+		{[]string{"curl -F a example.com"}, InvalidFormData},
+		{[]string{"curl -b jar.txt example.com"}, UnsupportedCurlOption},
+		{[]string{"curl -c jar.txt example.com"}, UnsupportedCurlOption},
+		{[]string{"curl example.com other.com"}, InvalidCurlCommand},
+		{[]string{"curl -m soon example.com"}, InvalidCurlCommand},
+		{[]string{"curl example.com -H"}, InvalidCurlCommand},
+		{[]string{"curl 'example.com"}, InvalidCurlCommand},
+		{[]string{"-collection", "curl -k https://example.com"}, ErrNotInCollection},
+	} {
+		if err := HandleImportCurl(&bytes.Buffer{}, tc.args); !errors.Is(err, tc.expected) {
+			t.Errorf("%q: Expected %v, Got: %v", tc.args, tc.expected, err)
+		}
+	}
+}
+
+func TestImportCurlCollection(t *testing.T) {
+	var buf bytes.Buffer
+	args := []string{"-collection", "-name", "create user", `curl -H 'X-A: 1' -d '{"name": "jane", "roles": ["admin"]}' -m 3 'http://localhost:8080/users?dry=1'`}
+	if err := HandleImportCurl(&buf, args); err != nil {
+		t.Fatal(err)
+	}
+	var requests []savedRequest
+	if err := yaml.Unmarshal(buf.Bytes(), &requests); err != nil || len(requests) != 1 {
+		t.Fatalf("Expected an entry of a collection, Got: %v\n%s", err, buf.String())
+	}
+	saved := requests[0]
+	if saved.Name != "create user" || saved.Http.Verb != "POST" || saved.Http.Url != "http://localhost:8080/users?dry=1" ||
+		saved.Http.Headers["X-A"] != "1" || saved.Http.Timeout != 3*time.Second {
+		t.Errorf("Expected the request, Got: %s", buf.String())
+	}
+	if body, ok := saved.Http.Body.(map[string]interface{}); !ok || body["name"] != "jane" {
+		t.Errorf("Expected the body to be kept structured, Got: %#v", saved.Http.Body)
+	}
+}
+
+func TestPrintCurl(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"http://localhost:8080/users"}, "curl -L http://localhost:8080/users"},
+		{
+			[]string{"-verb", "POST", "-H", "X-A: 1", "-query", "page=2", "-body", `{"name": "jane"}`, "-bearer", "abc", "http://example.com/users"},
+			`curl -H 'Content-Type: application/json' -H 'Authorization: Bearer abc' -H 'X-A: 1' --data-raw '{"name": "jane"}' -L 'http://example.com/users?page=2'`,
+		},
+		{
+			[]string{"-verb", "PUT", "-body-file", "user.json", "-basic-auth", "jane:secret", "-no-redirect", "http://example.com"},
+			"curl -X PUT -H 'Content-Type: application/json' --data-binary @user.json -u jane:secret http://example.com",
+		},
+		{
+			[]string{"-form-data", "name=x", "-upload", "file=@a.txt", "-max-redirects", "3", "http://example.com"},
+			"curl --form-string name=x -F file=@a.txt -L --max-redirs 3 http://example.com",
+		},
+		{
+			[]string{"-form", "name=jane doe", "-form", "expr=a=b", "http://example.com"},
+			"curl -d name=jane+doe -d expr=a%3Db -L http://example.com",
+		},
+		{
+			[]string{"-verb", "HEAD", "-timeout", "1500ms", "-retries", "2", "http://example.com"},
+			"curl --head --max-time 1.5 --retry 2 -L http://example.com",
+		},
+		{
+			[]string{"-output", "out.bin", "-continue", "-proxy", "http://proxy:3128", "-cookie-jar", "jar.json", "-http2", "http://example.com"},
+			"curl -L -o out.bin -C - -x http://proxy:3128 --http2-prior-knowledge http://example.com",
+		},
+	} {
+		var buf bytes.Buffer
+		if err := HandleHttp(&buf, append([]string{"-print-curl"}, tc.args...)); err != nil {
+			t.Errorf("%q: %v", tc.args, err)
+			continue
+		}
+		if got := strings.TrimSuffix(buf.String(), "\n"); got != tc.expected {
+			t.Errorf("%q: Expected %s, Got: %s", tc.args, tc.expected, got)
+		}
+
+		// the curl command converts back to the same request
+		words, err := splitCommandLine(tc.expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hc, err := parseCurl(words)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expected, err)
+		} else if got := hc.curlCommand(); got != tc.expected {
+			t.Errorf("Expected %s back, Got: %s", tc.expected, got)
+		}
+	}
+
+	// the certificates are read before the command is printed
+	_, ca := startTLSServer(t, false, tls.NoClientCert)
+	cert, key := writeClientCert(t, "jane")
+	var buf bytes.Buffer
+	args := []string{"-print-curl", "-http1.1", "-cacert", ca, "-cert", cert, "-key", key, "-insecure", "-verbose", "-include", "https://example.com"}
+	if err := HandleHttp(&buf, args); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("curl -i -L --http1.1 --cacert %s --cert %s --key %s -k -v https://example.com\n", ca, cert, key)
+	if buf.String() != expected {
+		t.Errorf("Expected %s, Got: %s", expected, buf.String())
+	}
+}
+
+func TestPrintGrpcurl(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"-method", "Users/GetUser", "localhost:50051"}, "grpcurl -plaintext localhost:50051 Users/GetUser"},
+		{
+			[]string{"-method", "Users/GetUser", "-body", `{"id": 1}`, "-timeout", "2s", "localhost:50051"},
+			`grpcurl -plaintext -max-time 2 -d '{"id": 1}' localhost:50051 Users/GetUser`,
+		},
+		{
+			[]string{"-method", "Users/GetUser", "-body-file", "my user.json", "-import-path", "protos", "-proto", "users.proto", "localhost:50051"},
+			"grpcurl -plaintext -import-path protos -proto users.proto -d @ localhost:50051 Users/GetUser < 'my user.json'",
+		},
+		{
+			[]string{"-method", "Users/GetUser", "-body-file", "-", "-protoset", "users.pb", "localhost:50051"},
+			"grpcurl -plaintext -protoset users.pb -d @ localhost:50051 Users/GetUser",
+		},
+	} {
+		var buf bytes.Buffer
+		if err := HandleGrpc(&buf, append([]string{"-print-grpcurl"}, tc.args...)); err != nil {
+			t.Errorf("%q: %v", tc.args, err)
+			continue
+		}
+		if got := strings.TrimSuffix(buf.String(), "\n"); got != tc.expected {
+			t.Errorf("%q: Expected %s, Got: %s", tc.args, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/desc/protoprint"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// descriptorSource resolves the services of a server and the types of their messages.
+type descriptorSource interface {
+	// ListServices returns the fully qualified names of the services.
+	ListServices() ([]string, error)
+	// FindSymbol returns the descriptor of a fully qualified symbol, or ErrSymbolNotFound.
+	FindSymbol(name string) (desc.Descriptor, error)
+}
+
+// reflectionSource asks the server's reflection service for the descriptors.
+type reflectionSource struct {
+	rc *grpcreflect.Client
+}
+
+func (s reflectionSource) ListServices() ([]string, error) {
+	return s.rc.ListServices()
+}
+
+func (s reflectionSource) FindSymbol(name string) (desc.Descriptor, error) {
+	fd, err := s.rc.FileContainingSymbol(name)
+	if grpcreflect.IsElementNotFoundError(err) {
+		return nil, fmt.Errorf("%w: %s", ErrSymbolNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return findSymbol([]*desc.FileDescriptor{fd}, name)
+}
+
+// fileSource holds descriptors loaded locally, from .proto files or descriptor sets.
+type fileSource struct {
+	// files includes the dependencies of the loaded files
+	files []*desc.FileDescriptor
+}
+
+func newFileSource(fds []*desc.FileDescriptor) fileSource {
+	var s fileSource
+	seen := make(map[string]bool)
+	var add func(fd *desc.FileDescriptor)
+	add = func(fd *desc.FileDescriptor) {
+		if seen[fd.GetName()] {
+			return
+		}
+		seen[fd.GetName()] = true
+		s.files = append(s.files, fd)
+		for _, dep := range fd.GetDependencies() {
+			add(dep)
+		}
+	}
+	for _, fd := range fds {
+		add(fd)
+	}
+	return s
+}
+
+func (s fileSource) ListServices() ([]string, error) {
+	var services []string
+	for _, fd := range s.files {
+		for _, sd := range fd.GetServices() {
+			services = append(services, sd.GetFullyQualifiedName())
+		}
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+func (s fileSource) FindSymbol(name string) (desc.Descriptor, error) {
+	return findSymbol(s.files, name)
+}
+
+func findSymbol(fds []*desc.FileDescriptor, name string) (desc.Descriptor, error) {
+	for _, fd := range fds {
+		if d := fd.FindSymbol(name); d != nil {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrSymbolNotFound, name)
+}
+
+// hasLocalDescriptors reports whether the descriptors are loaded locally rather than through reflection.
+func (gc *grpcConfig) hasLocalDescriptors() bool {
+	return len(gc.protoFiles) > 0 || len(gc.protosets) > 0
+}
+
+// descriptorSource returns the source of the descriptors: the local files when there are any, else the
+// reflection service of the server behind `conn`, which is only used then.
+func (gc *grpcConfig) descriptorSource(ctx context.Context, conn *grpc.ClientConn) (descriptorSource, error) {
+	if !gc.hasLocalDescriptors() {
+		return reflectionSource{rc: grpcreflect.NewClientAuto(ctx, conn)}, nil
+	}
+
+	var fds []*desc.FileDescriptor
+	if len(gc.protoFiles) > 0 {
+		p := protoparse.Parser{
+			ImportPaths:           gc.importPaths,
+			IncludeSourceCodeInfo: true,
+		}
+		parsed, err := p.ParseFiles(gc.protoFiles...)
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, parsed...)
+	}
+	for _, path := range gc.protosets {
+		loaded, err := loadProtoset(path)
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, loaded...)
+	}
+	return newFileSource(fds), nil
+}
+
+// loadProtoset reads a file holding a serialized `FileDescriptorSet`, as written by `protoc --descriptor_set_out`.
+func loadProtoset(path string) ([]*desc.FileDescriptor, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err = proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("invalid protoset %s: %w", path, err)
+	}
+	files, err := desc.CreateFileDescriptorsFromSet(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protoset %s: %w", path, err)
+	}
+	fds := make([]*desc.FileDescriptor, 0, len(files))
+	for _, f := range set.File {
+		fds = append(fds, files[f.GetName()])
+	}
+	return fds, nil
+}
+
+// symbolName turns a method written as `Service/Method` into its fully qualified name.
+func symbolName(name string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(name, "/"), "/", ".")
+}
+
+// listSymbol writes the services of the source, or the methods of a service, one per line.
+func listSymbol(w io.Writer, src descriptorSource, name string) error {
+	if len(name) == 0 {
+		services, err := src.ListServices()
+		if err != nil {
+			return err
+		}
+		for _, s := range services {
+			fmt.Fprintln(w, s)
+		}
+		return nil
+	}
+
+	d, err := src.FindSymbol(symbolName(name))
+	if err != nil {
+		return err
+	}
+	sd, ok := d.(*desc.ServiceDescriptor)
+	if !ok {
+		return fmt.Errorf("%w: %s is not a service", InvalidGrpcMethod, name)
+	}
+	for _, md := range sd.GetMethods() {
+		fmt.Fprintln(w, md.GetFullyQualifiedName())
+	}
+	return nil
+}
+
+// describeSymbol writes the definition of a symbol in the protobuf language. Methods are followed
+// by the definitions of their request and response messages.
+func describeSymbol(w io.Writer, src descriptorSource, name string) error {
+	d, err := src.FindSymbol(symbolName(name))
+	if err != nil {
+		return err
+	}
+	if err = printDescriptor(w, d); err != nil {
+		return err
+	}
+	if md, ok := d.(*desc.MethodDescriptor); ok {
+		for _, m := range []*desc.MessageDescriptor{md.GetInputType(), md.GetOutputType()} {
+			fmt.Fprintln(w)
+			if err = printDescriptor(w, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func printDescriptor(w io.Writer, d desc.Descriptor) error {
+	var kind string
+	switch d.(type) {
+	case *desc.ServiceDescriptor:
+		kind = "a service"
+	case *desc.MethodDescriptor:
+		kind = "a method"
+	case *desc.MessageDescriptor:
+		kind = "a message"
+	case *desc.FieldDescriptor:
+		kind = "a field"
+	case *desc.OneOfDescriptor:
+		kind = "a oneof"
+	case *desc.EnumDescriptor:
+		kind = "an enum"
+	case *desc.EnumValueDescriptor:
+		kind = "an enum value"
+	default:
+		kind = "a symbol"
+	}
+	s, err := (&protoprint.Printer{}).PrintProtoToString(d)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s is %s:\n", d.GetFullyQualifiedName(), kind)
+	fmt.Fprint(w, s)
+	return nil
+}
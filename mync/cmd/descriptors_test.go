@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	svc "github.com/lucaspere/grpc/multiple_services"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// protoDir holds the .proto files of the test services.
+const protoDir = "../../grpc/multiple-services"
+
+// writeProtoset writes the descriptors compiled in the test services to a file.
+func writeProtoset(t *testing.T) string {
+	set := descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{
+			protodesc.ToFileDescriptorProto(svc.File_users_proto),
+			protodesc.ToFileDescriptorProto(svc.File_repositories_proto),
+		},
+	}
+	b, err := proto.Marshal(&set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "services.protoset")
+	if err = os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGrpcCallLocalDescriptors(t *testing.T) {
+	opts := startTestGrpcServerWithReflection(t, false)
+
+	tests := []struct {
+		name string
+		gc   grpcConfig
+	}{
+		{name: "proto", gc: grpcConfig{
+			protoFiles:  stringsFlag{"users.proto"},
+			importPaths: stringsFlag{protoDir},
+		}},
+		{name: "protoset", gc: grpcConfig{
+			protosets: stringsFlag{writeProtoset(t)},
+		}},
+	}
+	for _, tc := range tests {
+		gc := tc.gc
+		gc.server = "bufnet"
+		gc.method = "Users/GetUser"
+		gc.body = `{"email": "jane@example.com"}`
+		gc.dialOptions = opts
+		var buf bytes.Buffer
+		if err := gc.call(context.Background(), &buf); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		msgs := decodeMessages(t, &buf)
+		if len(msgs) != 1 || msgs[0]["user"].(map[string]interface{})["firstName"] != "jane" {
+			t.Errorf("%s: Expected user jane, Got: %v", tc.name, msgs)
+		}
+	}
+
+	// without reflection nor local descriptors the method can't be resolved
+	gc := grpcConfig{
+		server:      "bufnet",
+		method:      "Users/GetUser",
+		dialOptions: opts,
+	}
+	if err := gc.call(context.Background(), &bytes.Buffer{}); err == nil {
+		t.Error("Expected an error without reflection")
+	}
+}
+
+func TestGrpcList(t *testing.T) {
+	opts := startTestGrpcServer(t)
+
+	reflected := grpcConfig{server: "bufnet", dialOptions: opts}
+	local := grpcConfig{
+		protoFiles:  stringsFlag{"repositories.proto"},
+		importPaths: stringsFlag{protoDir},
+	}
+	for _, gc := range []grpcConfig{reflected, local} {
+		var buf bytes.Buffer
+		err := gc.inspect(context.Background(), func(src descriptorSource) error {
+			return listSymbol(&buf, src, "")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the imported users.proto is listed too
+		if !strings.Contains(buf.String(), "Repo\n") || !strings.Contains(buf.String(), "Users\n") {
+			t.Errorf("Expected services Repo and Users, Got: %s", buf.String())
+		}
+
+		buf.Reset()
+		err = gc.inspect(context.Background(), func(src descriptorSource) error {
+			return listSymbol(&buf, src, "Repo")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "Repo.GetRepos\nRepo.CreateRepo\n"
+		if buf.String() != expected {
+			t.Errorf("Expected %q, Got: %q", expected, buf.String())
+		}
+	}
+}
+
+func TestGrpcDescribe(t *testing.T) {
+	opts := startTestGrpcServer(t)
+
+	reflected := grpcConfig{server: "bufnet", dialOptions: opts}
+	local := grpcConfig{protosets: stringsFlag{writeProtoset(t)}}
+	for _, gc := range []grpcConfig{reflected, local} {
+		var buf bytes.Buffer
+		err := gc.inspect(context.Background(), func(src descriptorSource) error {
+			return describeSymbol(&buf, src, "Users/GetUser")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []string{
+			"Users.GetUser is a method:",
+			"rpc GetUser ( UserGetRequest ) returns ( UserGetReply );",
+			"UserGetRequest is a message:",
+			"string email = 1;",
+			"UserGetReply is a message:",
+		} {
+			if !strings.Contains(buf.String(), s) {
+				t.Errorf("Expected %q in: %s", s, buf.String())
+			}
+		}
+
+		err = gc.inspect(context.Background(), func(src descriptorSource) error {
+			return describeSymbol(&buf, src, "Unknown")
+		})
+		if !errors.Is(err, ErrSymbolNotFound) {
+			t.Errorf("Expected error %v, Got: %v", ErrSymbolNotFound, err)
+		}
+	}
+}
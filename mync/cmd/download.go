@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// progressInterval is how often the progress of a download is refreshed.
+const progressInterval = 200 * time.Millisecond
+
+// partialFile is the -output file of a download continued with -continue, size being
+// the length already downloaded.
+type partialFile struct {
+	*os.File
+	size int64
+}
+
+// openPartial opens the file to continue its download, creating it if it doesn't exist.
+func openPartial(path string) (*partialFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &partialFile{File: f, size: fi.Size()}, nil
+}
+
+// resume positions the file where the response body is written: after the downloaded part when the
+// server sent the rest of the file, or at the beginning when it sent the whole file.
+func (pf *partialFile) resume(res *http.Response) error {
+	if res.StatusCode != http.StatusPartialContent {
+		pf.size = 0
+		if err := pf.Truncate(0); err != nil {
+			return err
+		}
+		_, err := pf.Seek(0, io.SeekStart)
+		return err
+	}
+
+	var start int64
+	_, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-", &start)
+	if err != nil || start != pf.size {
+		return fmt.Errorf("%w: the server sent the range %q from byte %d", ErrResumeFailed, res.Header.Get("Content-Range"), pf.size)
+	}
+	_, err = pf.Seek(pf.size, io.SeekStart)
+	return err
+}
+
+// continueDownload writes the rest of the file to the partial -output file. The part already downloaded
+// is kept when the server answers with an error, to be continued later.
+func (hc *httpConfig) continueDownload(res *http.Response) error {
+	pf := hc.partial
+	h := hc.newChecksum()
+	if pf.complete(res) {
+		if h != nil {
+			if err := pf.hashDownloaded(h); err != nil {
+				return err
+			}
+		}
+		return hc.verifyChecksum(h)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return statusError(res)
+	}
+
+	if err := pf.resume(res); err != nil {
+		return err
+	}
+	if h != nil && pf.size > 0 {
+		if err := pf.hashDownloaded(h); err != nil {
+			return err
+		}
+	}
+	if err := hc.copyBody(pf, res, h, pf.size); err != nil {
+		return err
+	}
+	return hc.verifyChecksum(h)
+}
+
+// complete reports whether the server refused the range because the file is already downloaded,
+// its Content-Range giving the length of the file.
+func (pf *partialFile) complete(res *http.Response) bool {
+	if res.StatusCode != http.StatusRequestedRangeNotSatisfiable || pf.size == 0 {
+		return false
+	}
+	var length int64
+	_, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes */%d", &length)
+	return err == nil && length == pf.size
+}
+
+// hashDownloaded feeds the part already downloaded to the hash, the file being read from the path
+// as it's opened write-only.
+func (pf *partialFile) hashDownloaded(h hash.Hash) error {
+	f, err := os.Open(pf.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, io.LimitReader(f, pf.size))
+	return err
+}
+
+// newChecksum returns the hash verifying the download, nil without -sha256.
+func (hc *httpConfig) newChecksum() hash.Hash {
+	if len(hc.sha256) == 0 {
+		return nil
+	}
+	return sha256.New()
+}
+
+// verifyChecksum compares the hash of the download to the one given with -sha256.
+func (hc *httpConfig) verifyChecksum(h hash.Hash) error {
+	if h == nil {
+		return nil
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != strings.ToLower(hc.sha256) {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, strings.ToLower(hc.sha256), sum)
+	}
+	return nil
+}
+
+// validChecksum reports whether the -sha256 value is a hex encoded SHA-256 hash.
+func validChecksum(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// isTerminal reports whether the file is a terminal, where the progress of downloads is shown.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// progressWriter counts the bytes written through it and refreshes the progress line of the download.
+type progressWriter struct {
+	w io.Writer
+	// out is where the progress is shown, total being the length of the file or -1 when unknown
+	out   io.Writer
+	total int64
+
+	done    int64
+	resumed int64
+	start   time.Time
+	last    time.Time
+}
+
+func newProgressWriter(w, out io.Writer, res *http.Response, resumed int64) *progressWriter {
+	total := res.ContentLength
+	if total >= 0 {
+		total += resumed
+	}
+	now := time.Now()
+	return &progressWriter{w: w, out: out, total: total, done: resumed, resumed: resumed, start: now, last: now}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.done += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.print()
+	}
+	return n, err
+}
+
+func (p *progressWriter) print() {
+	elapsed := time.Since(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.done-p.resumed) / elapsed
+	}
+	if p.total >= 0 {
+		percent := 100.0
+		if p.total > 0 {
+			percent = float64(p.done) * 100 / float64(p.total)
+		}
+		fmt.Fprintf(p.out, "\r%s / %s %5.1f%% %s/s ", formatBytes(p.done), formatBytes(p.total), percent, formatBytes(int64(rate)))
+	} else {
+		fmt.Fprintf(p.out, "\r%s %s/s ", formatBytes(p.done), formatBytes(int64(rate)))
+	}
+}
+
+// finish prints the final progress and ends its line.
+func (p *progressWriter) finish() {
+	p.print()
+	fmt.Fprintln(p.out)
+}
+
+// formatBytes writes a length with binary units, as 1.5 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 5; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startFileServer serves the content with support for Range requests, unless `ranges` is false,
+// and records the Range headers it receives.
+func startFileServer(t *testing.T, content []byte, ranges bool) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var received []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received = append(received, r.Header.Get("Range"))
+		mu.Unlock()
+		if r.URL.Path != "/file.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		if !ranges {
+			w.Write(content)
+			return
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(ts.Close)
+	return ts, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), received...)
+	}
+}
+
+func downloadContent() ([]byte, string) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	sum := sha256.Sum256(content)
+	return content, hex.EncodeToString(sum[:])
+}
+
+func TestHttpDownloadContinue(t *testing.T) {
+	content, sum := downloadContent()
+	ts, ranges := startFileServer(t, content, true)
+	path := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(path, content[:1000], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"-output", path, "-continue", "-sha256", strings.ToUpper(sum), ts.URL + "/file.bin"}
+	if err := HandleHttp(io.Discard, args); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Errorf("Expected the downloaded file, Got: %d bytes", len(b))
+	}
+	if r := ranges(); len(r) != 1 || r[0] != "bytes=1000-" {
+		t.Errorf("Expected the rest of the file to be requested, Got: %q", r)
+	}
+
+	// the file being complete, the server answers 416 and the checksum is verified
+	if err = HandleHttp(io.Discard, args); err != nil {
+		t.Fatal(err)
+	}
+	if r := ranges(); len(r) != 2 || r[1] != "bytes="+strconv.Itoa(len(content))+"-" {
+		t.Errorf("Expected the end of the file to be requested, Got: %q", r)
+	}
+
+	// a missing file is downloaded from the start
+	missing := filepath.Join(t.TempDir(), "missing.bin")
+	if err = HandleHttp(io.Discard, []string{"-output", missing, "-continue", ts.URL + "/file.bin"}); err != nil {
+		t.Fatal(err)
+	}
+	if r := ranges(); r[2] != "" {
+		t.Errorf("Expected no range for a missing file, Got: %q", r[2])
+	}
+	if b, _ = os.ReadFile(missing); !bytes.Equal(b, content) {
+		t.Errorf("Expected the downloaded file, Got: %d bytes", len(b))
+	}
+
+	// the part downloaded is kept on error responses
+	if err = os.WriteFile(path, content[:1000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = HandleHttp(io.Discard, []string{"-output", path, "-continue", ts.URL + "/missing"})
+	if !errors.Is(err, ErrStatus) {
+		t.Errorf("Expected %v, Got: %v", ErrStatus, err)
+	}
+	if b, _ = os.ReadFile(path); !bytes.Equal(b, content[:1000]) {
+		t.Errorf("Expected the partial file to be kept, Got: %d bytes", len(b))
+	}
+
+	// and so is the output file without -continue
+	err = HandleHttp(io.Discard, []string{"-output", path, ts.URL + "/missing"})
+	if !errors.Is(err, ErrStatus) {
+		t.Errorf("Expected %v, Got: %v", ErrStatus, err)
+	}
+	if b, _ = os.ReadFile(path); !bytes.Equal(b, content[:1000]) {
+		t.Errorf("Expected the output file to be left alone, Got: %d bytes", len(b))
+	}
+}
+
+func TestHttpDownloadWithoutRanges(t *testing.T) {
+	content, sum := downloadContent()
+	ts, _ := startFileServer(t, content, false)
+	path := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(path, []byte("a stale partial file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server sending the whole file, it replaces the partial one
+	if err := HandleHttp(io.Discard, []string{"-output", path, "-continue", "-sha256", sum, ts.URL + "/file.bin"}); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(path); !bytes.Equal(b, content) {
+		t.Errorf("Expected the downloaded file, Got: %d bytes", len(b))
+	}
+
+	var buf bytes.Buffer
+	err := HandleHttp(&buf, []string{"-sha256", strings.Repeat("0", 64), ts.URL + "/file.bin"})
+	if !errors.Is(err, ErrChecksumMismatch) || !strings.Contains(err.Error(), sum) {
+		t.Errorf("Expected %v, Got: %v", ErrChecksumMismatch, err)
+	}
+	if !bytes.HasSuffix(buf.Bytes(), content) {
+		t.Errorf("Expected the body to be written, Got: %d bytes", buf.Len())
+	}
+}
+
+func TestHttpDownloadProgress(t *testing.T) {
+	content, _ := downloadContent()
+	ts, _ := startFileServer(t, content, true)
+	path := filepath.Join(t.TempDir(), "file.bin")
+
+	hc, err := parseHttpArgs(io.Discard, []string{"-output", path, ts.URL + "/file.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var progress bytes.Buffer
+	hc.progress = &progress
+	if err = hc.send(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(progress.String(), "\r") || !strings.Contains(progress.String(), "\r1.0 MiB / 1.0 MiB 100.0% ") ||
+		!strings.HasSuffix(progress.String(), "/s \n") {
+		t.Errorf("Expected the progress, Got: %q", progress.String())
+	}
+}
+
+func TestHttpDownloadInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		expected error
+	}{
+		{[]string{"-continue"}, ErrContinueWithoutOutput},
+		{[]string{"-continue", "-output", "out", "-append"}, ErrContinueWithoutOutput},
+		{[]string{"-continue", "-output", "out", "-format", "json"}, ErrConflictingDownload},
+		{[]string{"-continue", "-output", "out", "-include"}, ErrConflictingDownload},
+		{[]string{"-sha256", strings.Repeat("0", 64), "-jq", ".name"}, ErrConflictingDownload},
+		{[]string{"-sha256", "abc"}, InvalidChecksum},
+	} {
+		_, err := parseHttpArgs(io.Discard, append(tc.args, "http://localhost"))
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("%v: Expected %v, Got: %v", tc.args, tc.expected, err)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, expected := range map[int64]string{
+		0:               "0 B",
+		1023:            "1023 B",
+		1536:            "1.5 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+		3 << 40:         "3.0 TiB",
+	} {
+		if got := formatBytes(n); got != expected {
+			t.Errorf("Expected %s, Got: %s", expected, got)
+		}
+	}
+}
@@ -5,3 +5,49 @@ import "errors"
 var ErrNoServerSpecified = errors.New("you have to specify the remote server.")
 var InvalidHttpMethod = errors.New("invalid HTTP method")
 var InvalidJsonBody = errors.New("invalid json body")
+var ErrNoMethodSpecified = errors.New("you have to specify the method to call.")
+var InvalidGrpcMethod = errors.New("invalid gRPC method")
+var ErrNoSymbolSpecified = errors.New("you have to specify the symbol to describe.")
+var ErrSymbolNotFound = errors.New("symbol not found")
+var InvalidHttpHeader = errors.New("invalid HTTP header")
+var InvalidQueryParam = errors.New("invalid query parameter")
+var ErrConflictingAuth = errors.New("you can't use both basic authentication and a bearer token.")
+var InvalidFormData = errors.New("invalid form data")
+var ErrConflictingBody = errors.New("you can't send both a JSON body and form data.")
+var ErrTooManyRedirects = errors.New("too many redirects")
+var ErrTimeout = errors.New("timeout")
+var ErrNetwork = errors.New("network error")
+var ErrStatus = errors.New("error response")
+var ErrNoCollectionSpecified = errors.New("you have to specify the collection to run.")
+var InvalidVariable = errors.New("invalid variable, expected name=value")
+var InvalidCollection = errors.New("invalid collection")
+var ErrUndefinedVariable = errors.New("undefined variable")
+var ErrRunFailed = errors.New("requests failed")
+var InvalidBenchTarget = errors.New("invalid bench target, expected http or grpc")
+var InvalidBenchOption = errors.New("invalid bench option, -c and -n must be positive and -rps between 0 and 1e9")
+var InvalidOutputFormat = errors.New("invalid output format")
+var InvalidJqFilter = errors.New("invalid jq filter")
+var ErrJqFilter = errors.New("jq filter failed")
+var ErrResponseNotJson = errors.New("the response isn't JSON")
+var InvalidChecksum = errors.New("invalid sha256 checksum, expected 64 hexadecimal digits")
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+var ErrContinueWithoutOutput = errors.New("you have to specify the -output file to continue, without -append.")
+var ErrConflictingDownload = errors.New("you can't continue or verify a download with -jq or a format other than raw, nor continue it with -include.")
+var ErrResumeFailed = errors.New("can't continue the download")
+var ErrConflictingProtocols = errors.New("you can't force both HTTP/2 and HTTP/1.1.")
+var InvalidProxy = errors.New("invalid proxy, expected a http, https, socks5 or socks5h URL")
+var InvalidCertificate = errors.New("invalid certificate")
+var InvalidCookieJar = errors.New("invalid cookie jar")
+var ErrCleartextProxy = errors.New("you can't send cleartext HTTP/2 through a proxy.")
+var ErrHttp2Unsupported = errors.New("the server doesn't support HTTP/2")
+var InvalidShellCommand = errors.New("invalid shell command, \"help\" lists them")
+var ErrNestedShell = errors.New("you're already in the shell.")
+var ErrNoCurlCommand = errors.New("you have to specify the curl command to import.")
+var InvalidCurlCommand = errors.New("invalid curl command")
+var UnsupportedCurlOption = errors.New("unsupported curl option")
+var ErrNotInCollection = errors.New("the request can't be saved in a collection")
+var InvalidWebSocketURL = errors.New("invalid WebSocket URL, expected a ws, wss, http or https URL")
+var InvalidStreamOption = errors.New("invalid option, the delays and the counts can't be negative")
+var ErrNotEventStream = errors.New("the response isn't an event stream")
+var ErrNoSpecSpecified = errors.New("you have to specify the -spec file of the mocks.")
+var InvalidMockSpec = errors.New("invalid mock spec")
@@ -0,0 +1,314 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/itchyny/gojq"
+	"gopkg.in/yaml.v3"
+)
+
+// The formats of the responses.
+const (
+	formatRaw  = "raw"
+	formatJson = "json"
+	formatYaml = "yaml"
+	// formatHeaders prints the status line and the headers of HTTP responses only
+	formatHeaders = "headers"
+)
+
+// ANSI colours of the JSON tokens.
+const (
+	colorKey    = "\x1b[34;1m"
+	colorString = "\x1b[32m"
+	colorNumber = "\x1b[36m"
+	colorBool   = "\x1b[33m"
+	colorNull   = "\x1b[90m"
+	colorReset  = "\x1b[0m"
+)
+
+// outputConfig is how and where the responses are written.
+type outputConfig struct {
+	format string
+	jq     string
+	color  bool
+	path   string
+	append bool
+
+	// code is the compiled jq filter
+	code *gojq.Code
+}
+
+func (oc *outputConfig) flags(fs *flag.FlagSet, defaultFormat string, formats ...string) {
+	fs.StringVar(&oc.format, "format", defaultFormat, "Format of the response: "+strings.Join(formats, ", "))
+	fs.StringVar(&oc.jq, "jq", "", "jq filter applied to the JSON response, as .user.name")
+	fs.BoolVar(&oc.color, "color", false, "Colour the JSON output")
+	fs.StringVar(&oc.path, "output", "", "File path where save the data's output, the file is overwritten")
+	fs.BoolVar(&oc.append, "append", false, "Append to the -output file instead of overwriting it")
+}
+
+// validate checks the format is one of `formats` and compiles the jq filter.
+func (oc *outputConfig) validate(formats ...string) error {
+	valid := false
+	for _, f := range formats {
+		valid = valid || oc.format == f
+	}
+	if !valid {
+		return fmt.Errorf("%w: %s", InvalidOutputFormat, oc.format)
+	}
+	if len(oc.jq) == 0 {
+		return nil
+	}
+	if oc.format == formatHeaders {
+		return fmt.Errorf("%w: -jq filters the body, which isn't printed with %s", InvalidOutputFormat, oc.format)
+	}
+	query, err := gojq.Parse(oc.jq)
+	if err != nil {
+		return fmt.Errorf("%w: %s", InvalidJqFilter, err)
+	}
+	if oc.code, err = gojq.Compile(query); err != nil {
+		return fmt.Errorf("%w: %s", InvalidJqFilter, err)
+	}
+	return nil
+}
+
+// open returns where the response is written, the output file if there is one or else `w`,
+// and the function closing it.
+func (oc *outputConfig) open(w io.Writer) (io.Writer, func() error, error) {
+	if len(oc.path) == 0 {
+		return w, func() error { return nil }, nil
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if oc.append {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(oc.path, flag, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
+}
+
+// copiesBody reports whether the body is written as it is, without being decoded.
+func (oc *outputConfig) copiesBody() bool {
+	return oc.format == formatRaw && oc.code == nil
+}
+
+// writeJSON writes a body of one or more JSON values, filtered and formatted.
+func (oc *outputConfig) writeJSON(w io.Writer, body []byte) error {
+	if oc.copiesBody() {
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+		if len(body) > 0 && body[len(body)-1] != '\n' {
+			_, err := io.WriteString(w, "\n")
+			return err
+		}
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	first := true
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrResponseNotJson, err)
+		}
+		if oc.code == nil {
+			if err = oc.writeValue(w, raw, first); err != nil {
+				return err
+			}
+			first = false
+			continue
+		}
+
+		// gojq takes the values decoded as interface{}, with float64 numbers
+		var v interface{}
+		if err = json.Unmarshal(raw, &v); err != nil {
+			return fmt.Errorf("%w: %s", ErrResponseNotJson, err)
+		}
+		iter := oc.code.Run(v)
+		for {
+			result, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if err, ok := result.(error); ok {
+				return fmt.Errorf("%w: %s", ErrJqFilter, err)
+			}
+			b, err := json.Marshal(result)
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrJqFilter, err)
+			}
+			if err = oc.writeValue(w, b, first); err != nil {
+				return err
+			}
+			first = false
+		}
+	}
+}
+
+// writeValue writes a single JSON value in the format, YAML documents after the first being separated.
+func (oc *outputConfig) writeValue(w io.Writer, raw []byte, first bool) error {
+	switch oc.format {
+	case formatRaw:
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, raw); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+		_, err := w.Write(buf.Bytes())
+		return err
+	case formatYaml:
+		if !first {
+			if _, err := io.WriteString(w, "---\n"); err != nil {
+				return err
+			}
+		}
+		return writeYaml(w, raw)
+	default:
+		return writeIndentedJSON(w, raw, oc.color)
+	}
+}
+
+// writeYaml writes a JSON value as YAML, keeping the order of the keys.
+func writeYaml(w io.Writer, raw []byte) error {
+	// JSON being YAML, the value is decoded in flow style which is reset to block style
+	var node yaml.Node
+	if err := yaml.Unmarshal(raw, &node); err != nil {
+		return fmt.Errorf("%w: %s", ErrResponseNotJson, err)
+	}
+	var blockStyle func(n *yaml.Node)
+	blockStyle = func(n *yaml.Node) {
+		n.Style = 0
+		for _, c := range n.Content {
+			blockStyle(c)
+		}
+	}
+	blockStyle(&node)
+	b, err := yaml.Marshal(&node)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// writeIndentedJSON writes a JSON value indented, keeping the order of the keys, and
+// coloured with ANSI escape codes if `color` is set.
+func writeIndentedJSON(w io.Writer, raw []byte, color bool) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var buf bytes.Buffer
+	paint := func(c, s string) {
+		if color {
+			buf.WriteString(c + s + colorReset)
+		} else {
+			buf.WriteString(s)
+		}
+	}
+	newline := func(depth int) {
+		buf.WriteByte('\n')
+		buf.WriteString(strings.Repeat("  ", depth))
+	}
+
+	// frames are the objects and arrays being written, n counting their keys and values
+	type frame struct {
+		object bool
+		n      int
+	}
+	var frames []*frame
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrResponseNotJson, err)
+		}
+		var top *frame
+		if len(frames) > 0 {
+			top = frames[len(frames)-1]
+		}
+
+		if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+			frames = frames[:len(frames)-1]
+			if top.n > 0 {
+				newline(len(frames))
+			}
+			buf.WriteRune(rune(d))
+			continue
+		}
+
+		if top != nil && top.object && top.n%2 == 0 {
+			// a key
+			if top.n > 0 {
+				buf.WriteByte(',')
+			}
+			newline(len(frames))
+			paint(colorKey, quote(tok.(string)))
+			buf.WriteString(": ")
+			top.n++
+			continue
+		}
+		if top != nil {
+			if !top.object {
+				if top.n > 0 {
+					buf.WriteByte(',')
+				}
+				newline(len(frames))
+			}
+			top.n++
+		}
+
+		switch v := tok.(type) {
+		case json.Delim:
+			buf.WriteRune(rune(v))
+			frames = append(frames, &frame{object: v == '{'})
+		case string:
+			paint(colorString, quote(v))
+		case json.Number:
+			paint(colorNumber, v.String())
+		case bool:
+			paint(colorBool, fmt.Sprint(v))
+		case nil:
+			paint(colorNull, "null")
+		}
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// quote returns a JSON string, without escaping the HTML characters as json.Marshal does.
+func quote(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// writeTracker remembers the error of writing, to tell it apart from the error of reading when copying.
+type writeTracker struct {
+	w   io.Writer
+	err error
+}
+
+func (t *writeTracker) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if err != nil {
+		t.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func formatted(t *testing.T, oc outputConfig, body string) string {
+	if err := oc.validate(formatRaw, formatJson, formatYaml); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := oc.writeJSON(&buf, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestFormatJson(t *testing.T) {
+	body := `{"name":"jane","tags":["a<b",1.50],"empty":{},"none":[],"admin":false,"boss":null}`
+	expected := `{
+  "name": "jane",
+  "tags": [
+    "a<b",
+    1.50
+  ],
+  "empty": {},
+  "none": [],
+  "admin": false,
+  "boss": null
+}
+`
+	if got := formatted(t, outputConfig{format: formatJson}, body); got != expected {
+		t.Errorf("Expected %q, Got: %q", expected, got)
+	}
+
+	got := formatted(t, outputConfig{format: formatJson, color: true}, `{"id":1,"ok":true}`)
+	expected = "{\n  \x1b[34;1m\"id\"\x1b[0m: \x1b[36m1\x1b[0m,\n  \x1b[34;1m\"ok\"\x1b[0m: \x1b[33mtrue\x1b[0m\n}\n"
+	if got != expected {
+		t.Errorf("Expected %q, Got: %q", expected, got)
+	}
+
+	// the raw format writes the body as it is, several JSON values one after the other
+	if got := formatted(t, outputConfig{format: formatRaw}, "{\"a\": 1}\n{\"a\": 2}"); got != "{\"a\": 1}\n{\"a\": 2}\n" {
+		t.Errorf("Expected the body, Got: %q", got)
+	}
+	if got := formatted(t, outputConfig{format: formatJson}, "{\"a\": 1}\n{\"a\": 2}"); got != "{\n  \"a\": 1\n}\n{\n  \"a\": 2\n}\n" {
+		t.Errorf("Expected both values, Got: %q", got)
+	}
+}
+
+func TestFormatYaml(t *testing.T) {
+	got := formatted(t, outputConfig{format: formatYaml}, `{"name":"jane","tags":["a","b"],"age":36}{"name":"john"}`)
+	expected := "name: jane\ntags:\n    - a\n    - b\nage: 36\n---\nname: john\n"
+	if got != expected {
+		t.Errorf("Expected %q, Got: %q", expected, got)
+	}
+}
+
+func TestFormatJq(t *testing.T) {
+	body := `{"users":[{"name":"jane","age":36},{"name":"john","age":40}]}`
+	got := formatted(t, outputConfig{format: formatRaw, jq: ".users[] | .name"}, body)
+	if got != "\"jane\"\n\"john\"\n" {
+		t.Errorf("Expected the names, Got: %q", got)
+	}
+	got = formatted(t, outputConfig{format: formatJson, jq: "[.users[].age]"}, body)
+	if got != "[\n  36,\n  40\n]\n" {
+		t.Errorf("Expected the ages, Got: %q", got)
+	}
+
+	oc := outputConfig{format: formatJson, jq: ".users["}
+	if err := oc.validate(formatJson); !errors.Is(err, InvalidJqFilter) {
+		t.Errorf("Expected %v, Got: %v", InvalidJqFilter, err)
+	}
+	oc = outputConfig{format: formatJson, jq: ".users.name"}
+	if err := oc.validate(formatJson); err != nil {
+		t.Fatal(err)
+	}
+	if err := oc.writeJSON(&bytes.Buffer{}, []byte(body)); !errors.Is(err, ErrJqFilter) {
+		t.Errorf("Expected %v, Got: %v", ErrJqFilter, err)
+	}
+	if err := oc.writeJSON(&bytes.Buffer{}, []byte("<html>")); !errors.Is(err, ErrResponseNotJson) {
+		t.Errorf("Expected %v, Got: %v", ErrResponseNotJson, err)
+	}
+
+	oc = outputConfig{format: "xml"}
+	if err := oc.validate(formatJson); !errors.Is(err, InvalidOutputFormat) {
+		t.Errorf("Expected %v, Got: %v", InvalidOutputFormat, err)
+	}
+}
+
+func TestHttpOutput(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"name":"jane"}`))
+	}))
+	t.Cleanup(ts.Close)
+
+	var buf bytes.Buffer
+	if err := HandleHttp(&buf, []string{"-format", "headers", ts.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "HTTP/1.1 200 OK\nContent-Length: 15\nContent-Type: application/json\n") || strings.Contains(buf.String(), "jane") {
+		t.Errorf("Expected the headers only, Got: %q", buf.String())
+	}
+
+	// the output file is overwritten, unless -append is set
+	path := filepath.Join(t.TempDir(), "out.json")
+	if err := os.WriteFile(path, []byte("a longer previous content\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"-output", path, "-format", "json"},
+		{"-output", path, "-append", "-jq", ".name"},
+	} {
+		buf.Reset()
+		if err := HandleHttp(&buf, append(args, ts.URL)); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("Expected the response in the file, Got: %q", buf.String())
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "{\n  \"name\": \"jane\"\n}\n\"jane\"\n" {
+		t.Errorf("Expected both responses, Got: %q", b)
+	}
+
+	err = HandleHttp(&buf, []string{"-output", filepath.Join(path, "not-a-dir"), ts.URL})
+	if err == nil {
+		t.Errorf("Expected an error creating the output file")
+	}
+}
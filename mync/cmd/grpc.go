@@ -1,29 +1,122 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/dynamicpb"
 )
 
+// grpcFormats are the output formats of the grpc command, the messages being JSON.
+var grpcFormats = []string{formatRaw, formatJson, formatYaml}
+
 type grpcConfig struct {
-	server string
-	method string
-	body   string
+	server       string
+	method       string
+	body         string
+	bodyFile     string
+	maxMessages  int
+	timeout      time.Duration
+	retries      int
+	output       outputConfig
+	printGrpcurl bool
+
+	// protoFiles, importPaths and protosets load the descriptors locally instead of through reflection
+	protoFiles  stringsFlag
+	importPaths stringsFlag
+	protosets   stringsFlag
+
+	// stdin is read for the requests when the body file is `-`.
+	stdin io.Reader
+
+	// dialOptions are appended to the options the server is dialed with, the tests use them to dial in-process servers.
+	dialOptions []grpc.DialOption
+}
+
+// stringsFlag is a flag which can be repeated, its values are accumulated.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func (gc *grpcConfig) descriptorFlags(fs *flag.FlagSet) {
+	fs.Var(&gc.protoFiles, "proto", "File path of a .proto file describing the services, can be repeated")
+	fs.Var(&gc.importPaths, "import-path", "Directory where the .proto files and their imports are searched, can be repeated")
+	fs.Var(&gc.protosets, "protoset", "File path of a compiled FileDescriptorSet describing the services, can be repeated")
 }
 
 func HandleGrpc(w io.Writer, args []string) error {
-	gc := grpcConfig{}
+	if len(args) > 0 {
+		switch args[0] {
+		case "list":
+			return handleGrpcList(w, args[1:])
+		case "describe":
+			return handleGrpcDescribe(w, args[1:])
+		}
+	}
+	gc, err := parseGrpcArgs(w, args)
+	if err != nil {
+		return err
+	}
+	if gc.printGrpcurl {
+		fmt.Fprintln(w, gc.grpcurlCommand())
+		return nil
+	}
+	out, closeOut, err := gc.output.open(w)
+	if err != nil {
+		return err
+	}
+	err = grpcError(gc.call(context.Background(), out))
+	if cerr := closeOut(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// parseGrpcArgs parses the flags and the server of the grpc command.
+func parseGrpcArgs(w io.Writer, args []string) (*grpcConfig, error) {
+	gc := grpcConfig{stdin: os.Stdin}
 
 	fs := flag.NewFlagSet("grpc", flag.ContinueOnError)
 	fs.SetOutput(w)
-	fs.StringVar(&gc.method, "method", "", "method to call")
-	fs.StringVar(&gc.body, "body", "", "body of request")
+	gc.descriptorFlags(fs)
+	fs.StringVar(&gc.method, "method", "", "method to call, as Service/Method")
+	fs.StringVar(&gc.body, "body", "", "body of request, as JSON. Streaming methods take newline-delimited JSON messages")
+	fs.StringVar(&gc.bodyFile, "body-file", "", "File path containing the body of request, - reads it from the standard input")
+	fs.IntVar(&gc.maxMessages, "max-messages", 0, "stop after receiving this many response messages, 0 for no limit")
+	fs.DurationVar(&gc.timeout, "timeout", 0, "timeout of each attempt of the call, a stream being a single attempt, 0 for no timeout")
+	fs.IntVar(&gc.retries, "retries", 0, "number of retries of unary calls failing with UNAVAILABLE, RESOURCE_EXHAUSTED, ABORTED or DEADLINE_EXCEEDED")
+	gc.output.flags(fs, formatJson, grpcFormats...)
+	fs.BoolVar(&gc.printGrpcurl, "print-grpcurl", false, "Print the equivalent grpcurl command instead of calling the method")
 	fs.Usage = func() {
 		var usageString = `
 grpc: A gRPC client.
  
-grpc: <options> server`
+grpc: <options> server
+grpc list: <options> [server] [service]
+grpc describe: <options> [server] symbol
+
+The services are resolved through the server's reflection service unless
+-proto or -protoset is given, list and describe don't take a server then.`
 		fmt.Fprintf(w, usageString)
 		fmt.Fprintln(w)
 		fmt.Fprintln(w)
@@ -32,12 +125,385 @@ grpc: <options> server`
 	}
 	err := fs.Parse(args)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if fs.NArg() != 1 {
-		return ErrNoServerSpecified
+		return nil, ErrNoServerSpecified
 	}
 	gc.server = fs.Arg(0)
-	fmt.Fprintln(w, "Executing grpc command")
+	if len(gc.method) == 0 {
+		return nil, ErrNoMethodSpecified
+	}
+	if err = gc.output.validate(grpcFormats...); err != nil {
+		return nil, err
+	}
+	return &gc, nil
+}
+
+// parseInspectArgs parses the flags and arguments of list and describe, the server
+// argument being left out when the descriptors are local.
+func (gc *grpcConfig) parseInspectArgs(w io.Writer, name, usage string, args []string) ([]string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(w)
+	gc.descriptorFlags(fs)
+	fs.DurationVar(&gc.timeout, "timeout", 0, "timeout of the requests to the reflection service, 0 for no timeout")
+	fs.Usage = func() {
+		fmt.Fprintln(w, usage)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Options: ")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	args = fs.Args()
+	if !gc.hasLocalDescriptors() {
+		if len(args) == 0 {
+			return nil, ErrNoServerSpecified
+		}
+		gc.server, args = args[0], args[1:]
+	}
+	return args, nil
+}
+
+func handleGrpcList(w io.Writer, args []string) error {
+	gc := grpcConfig{}
+	args, err := gc.parseInspectArgs(w, "grpc list", "\ngrpc list: Lists the services, or the methods of a service.\ngrpc list: <options> [server] [service]", args)
+	if err != nil {
+		return err
+	}
+	var service string
+	if len(args) > 0 {
+		service = args[0]
+	}
+	return grpcError(gc.inspect(context.Background(), func(src descriptorSource) error {
+		return listSymbol(w, src, service)
+	}))
+}
+
+func handleGrpcDescribe(w io.Writer, args []string) error {
+	gc := grpcConfig{}
+	args, err := gc.parseInspectArgs(w, "grpc describe", "\ngrpc describe: Describes a service, method or message.\ngrpc describe: <options> [server] symbol", args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return ErrNoSymbolSpecified
+	}
+	return grpcError(gc.inspect(context.Background(), func(src descriptorSource) error {
+		return describeSymbol(w, src, args[0])
+	}))
+}
+
+// inspect runs `fn` with the source of the descriptors, dialing the server for reflection if there are no local ones.
+func (gc *grpcConfig) inspect(ctx context.Context, fn func(src descriptorSource) error) error {
+	ctx, cancel := gc.withTimeout(ctx)
+	defer cancel()
+	var conn *grpc.ClientConn
+	if !gc.hasLocalDescriptors() {
+		var err error
+		if conn, err = gc.dial(ctx); err != nil {
+			return err
+		}
+		defer conn.Close()
+	}
+	src, err := gc.descriptorSource(ctx, conn)
+	if err != nil {
+		return err
+	}
+	return fn(src)
+}
+
+func (gc *grpcConfig) dial(ctx context.Context) (*grpc.ClientConn, error) {
+	opts := append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}, gc.dialOptions...)
+	return grpc.DialContext(ctx, gc.server, opts...)
+}
+
+// call dials the server, resolves the method and writes the JSON responses to `w`.
+func (gc *grpcConfig) call(ctx context.Context, w io.Writer) error {
+	// cancelling ends the reflection stream too
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	conn, err := gc.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	md, err := gc.resolve(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	src, err := gc.requests()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	reqs := newRequestReader(md, src)
+	if md.IsClientStreaming() || md.IsServerStreaming() {
+		sctx, scancel := gc.withTimeout(ctx)
+		defer scancel()
+		return gc.stream(sctx, conn, md, reqs, w)
+	}
+
+	req, err := reqs.single()
+	if err != nil {
+		return err
+	}
+	res, err := gc.invoke(ctx, conn, md, req)
+	if err != nil {
+		return err
+	}
+	return gc.printMessage(w, res)
+}
+
+// resolve finds the descriptor of the method, through the server's reflection service if there are no local descriptors.
+func (gc *grpcConfig) resolve(ctx context.Context, conn *grpc.ClientConn) (*desc.MethodDescriptor, error) {
+	ctx, cancel := gc.withTimeout(ctx)
+	defer cancel()
+	ds, err := gc.descriptorSource(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	return resolveMethod(ds, gc.method)
+}
+
+// invoke calls a unary method, retrying it with an exponential backoff while it fails with a retryable code.
+func (gc *grpcConfig) invoke(ctx context.Context, conn *grpc.ClientConn, md *desc.MethodDescriptor, req *dynamicpb.Message) (*dynamicpb.Message, error) {
+	for attempt := 0; ; attempt++ {
+		actx, cancel := gc.withTimeout(ctx)
+		res := dynamicpb.NewMessage(md.GetOutputType().UnwrapMessage())
+		// the codec of grpc takes messages of the first protobuf API
+		err := conn.Invoke(actx, fullMethodName(md), proto.MessageV1(req), proto.MessageV1(res))
+		cancel()
+		if err == nil {
+			return res, nil
+		}
+		if attempt >= gc.retries || !retryableCode(status.Code(err)) || ctx.Err() != nil {
+			return nil, err
+		}
+		if serr := sleep(ctx, backoff(attempt)); serr != nil {
+			return nil, err
+		}
+	}
+}
+
+// withTimeout bounds the context by the timeout, if there is one.
+func (gc *grpcConfig) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if gc.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, gc.timeout)
+}
+
+// requests opens the source of the request messages: the body, the body file or the standard input.
+func (gc *grpcConfig) requests() (io.ReadCloser, error) {
+	switch gc.bodyFile {
+	case "":
+		return io.NopCloser(strings.NewReader(gc.body)), nil
+	case "-":
+		return io.NopCloser(gc.stdin), nil
+	default:
+		return os.Open(gc.bodyFile)
+	}
+}
+
+// stream calls a streaming method. The requests are sent while the responses are printed as they arrive,
+// and the call is cancelled once `maxMessages` responses were received.
+func (gc *grpcConfig) stream(ctx context.Context, conn *grpc.ClientConn, md *desc.MethodDescriptor, reqs *requestReader, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sd := &grpc.StreamDesc{
+		StreamName:    md.GetName(),
+		ServerStreams: md.IsServerStreaming(),
+		ClientStreams: md.IsClientStreaming(),
+	}
+	stream, err := conn.NewStream(ctx, sd, fullMethodName(md))
+	if err != nil {
+		return err
+	}
+
+	// the requests are sent concurrently so bidi responses print as they arrive, a failing
+	// send cancels the call. The sender is joined once the responses are received, which
+	// cancels it when it's still waiting for requests
+	errc := make(chan error, 1)
+	go func() {
+		err := sendRequests(ctx, stream, reqs, md.IsClientStreaming())
+		if err != nil {
+			cancel()
+		}
+		errc <- err
+	}()
+
+	err = gc.receive(stream, sd, md, w)
+	cancel()
+	if serr := <-errc; serr != nil && !errors.Is(serr, context.Canceled) {
+		return serr
+	}
+	return err
+}
+
+// receive prints the responses of the call, up to -max-messages of them.
+func (gc *grpcConfig) receive(stream grpc.ClientStream, sd *grpc.StreamDesc, md *desc.MethodDescriptor, w io.Writer) error {
+	for n := 0; gc.maxMessages <= 0 || n < gc.maxMessages; n++ {
+		res := dynamicpb.NewMessage(md.GetOutputType().UnwrapMessage())
+		err := stream.RecvMsg(proto.MessageV1(res))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err = gc.printMessage(w, res); err != nil {
+			return err
+		}
+		if !sd.ServerStreams {
+			break
+		}
+	}
 	return nil
 }
+
+// sendRequests sends the requests on the stream then closes its sending side. Methods
+// that aren't client streaming take a single request. It returns the error of `ctx` once
+// it's done, even while waiting for the next request.
+func sendRequests(ctx context.Context, stream grpc.ClientStream, reqs *requestReader, clientStreams bool) error {
+	if !clientStreams {
+		req, err := readRequest(ctx, reqs.single)
+		if err != nil {
+			return err
+		}
+		if err = stream.SendMsg(proto.MessageV1(req)); err != nil && err != io.EOF {
+			return err
+		}
+		return stream.CloseSend()
+	}
+	for {
+		req, err := readRequest(ctx, reqs.next)
+		if err == io.EOF {
+			return stream.CloseSend()
+		}
+		if err != nil {
+			return err
+		}
+		// io.EOF means the server ended the call, its status is returned by the receiving side
+		if err = stream.SendMsg(proto.MessageV1(req)); err == io.EOF {
+			return nil
+		}
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readRequest returns the request read by `read`, or the error of `ctx` once it's done. The requests
+// may be read from the standard input, whose read can't be interrupted: it's then left to end on its own.
+func readRequest(ctx context.Context, read func() (*dynamicpb.Message, error)) (*dynamicpb.Message, error) {
+	type result struct {
+		req *dynamicpb.Message
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		req, err := read()
+		c <- result{req, err}
+	}()
+	select {
+	case r := <-c:
+		return r.req, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// requestReader decodes the request messages of a method from a sequence of JSON values,
+// usually one per line.
+type requestReader struct {
+	md  *desc.MethodDescriptor
+	dec *json.Decoder
+}
+
+func newRequestReader(md *desc.MethodDescriptor, r io.Reader) *requestReader {
+	return &requestReader{md: md, dec: json.NewDecoder(r)}
+}
+
+// next returns the next request message, or io.EOF once they were all read.
+func (r *requestReader) next() (*dynamicpb.Message, error) {
+	var raw json.RawMessage
+	if err := r.dec.Decode(&raw); err == io.EOF {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %s", InvalidJsonBody, err)
+	}
+	req := dynamicpb.NewMessage(r.md.GetInputType().UnwrapMessage())
+	if err := protojson.Unmarshal(raw, req); err != nil {
+		return nil, fmt.Errorf("%w: %s", InvalidJsonBody, err)
+	}
+	return req, nil
+}
+
+// single returns the only request message, an empty body being an empty message.
+func (r *requestReader) single() (*dynamicpb.Message, error) {
+	req, err := r.next()
+	if err == io.EOF {
+		return dynamicpb.NewMessage(r.md.GetInputType().UnwrapMessage()), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = r.next(); err != io.EOF {
+		return nil, fmt.Errorf("%w: %s takes a single message", InvalidJsonBody, r.md.GetName())
+	}
+	return req, nil
+}
+
+// printMessage writes a response message in the output format.
+func (gc *grpcConfig) printMessage(w io.Writer, m *dynamicpb.Message) error {
+	data, err := protojson.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return gc.output.writeJSON(w, data)
+}
+
+// resolveMethod finds the descriptor of a method named `Service/Method`, `Service.Method` also works.
+// Services are named with their package, as in `helloworld.Greeter/SayHello`.
+func resolveMethod(ds descriptorSource, name string) (*desc.MethodDescriptor, error) {
+	name = strings.TrimPrefix(name, "/")
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		i = strings.LastIndex(name, ".")
+	}
+	if i <= 0 || i == len(name)-1 {
+		return nil, fmt.Errorf("%w: %s", InvalidGrpcMethod, name)
+	}
+	service, method := name[:i], name[i+1:]
+
+	d, err := ds.FindSymbol(service)
+	if errors.Is(err, ErrSymbolNotFound) {
+		return nil, fmt.Errorf("%w: unknown service %s", InvalidGrpcMethod, service)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sd, ok := d.(*desc.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not a service", InvalidGrpcMethod, service)
+	}
+	md := sd.FindMethodByName(method)
+	if md == nil {
+		return nil, fmt.Errorf("%w: service %s has no method %s", InvalidGrpcMethod, service, method)
+	}
+	return md, nil
+}
+
+// fullMethodName returns the name of the method on the wire, `/package.Service/Method`.
+func fullMethodName(md *desc.MethodDescriptor) string {
+	return "/" + md.GetService().GetFullyQualifiedName() + "/" + md.GetName()
+}
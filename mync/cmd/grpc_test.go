@@ -0,0 +1,417 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	svc "github.com/lucaspere/grpc/multiple_services"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type userService struct {
+	svc.UnimplementedUsersServer
+}
+
+func (s *userService) GetUser(ctx context.Context, in *svc.UserGetRequest) (*svc.UserGetReply, error) {
+	components := strings.Split(in.Email, "@")
+	if len(components) != 2 {
+		return nil, errors.New("invalid email address")
+	}
+	u := svc.User{
+		Id:        in.Id,
+		FirstName: components[0],
+		LastName:  components[1],
+		Age:       36,
+	}
+	return &svc.UserGetReply{User: &u}, nil
+}
+
+func (s *userService) GetHelp(stream svc.Users_GetHelpServer) error {
+	for {
+		request, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(&svc.UserHelpReply{Response: request.Request}); err != nil {
+			return err
+		}
+	}
+}
+
+type repoService struct {
+	svc.UnimplementedRepoServer
+}
+
+func (s *repoService) GetRepos(in *svc.RepoGetRequest, stream svc.Repo_GetReposServer) error {
+	for cnt := 1; cnt <= 5; cnt++ {
+		repo := svc.Repository{
+			Id:   in.Id,
+			Name: fmt.Sprintf("repo-%d", cnt),
+		}
+		if err := stream.Send(&svc.RepoGetReply{Repo: &repo}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *repoService) CreateRepo(stream svc.Repo_CreateRepoServer) error {
+	var name string
+	var data []byte
+	for {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch r.Body.(type) {
+		case *svc.RepoCreateRequest_Context:
+			name = r.GetContext().Name
+		case *svc.RepoCreateRequest_Data:
+			data = append(data, r.GetData()...)
+		default:
+			return status.Error(codes.InvalidArgument, "Message doesn't contain context or data")
+		}
+	}
+	return stream.SendAndClose(&svc.RepoCreateReply{
+		Repo: &svc.Repository{Name: name},
+		Size: int32(len(data)),
+	})
+}
+
+func startTestGrpcServer(t *testing.T) []grpc.DialOption {
+	return startTestGrpcServerWith(t, &userService{}, true)
+}
+
+func startTestGrpcServerWithReflection(t *testing.T, withReflection bool) []grpc.DialOption {
+	return startTestGrpcServerWith(t, &userService{}, withReflection)
+}
+
+func startTestGrpcServerWith(t *testing.T, users svc.UsersServer, withReflection bool) []grpc.DialOption {
+	l := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	svc.RegisterUsersServer(s, users)
+	svc.RegisterRepoServer(s, &repoService{})
+	if withReflection {
+		reflection.Register(s)
+	}
+	go func() {
+		if err := s.Serve(l); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	t.Cleanup(s.Stop)
+
+	return []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return l.Dial()
+		}),
+	}
+}
+
+func TestGrpcCall(t *testing.T) {
+	opts := startTestGrpcServer(t)
+
+	gc := grpcConfig{
+		server:      "bufnet",
+		method:      "Users/GetUser",
+		body:        `{"email": "jane@example.com", "id": "foo-bar"}`,
+		dialOptions: opts,
+	}
+	var buf bytes.Buffer
+	if err := gc.call(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var res struct {
+		User struct {
+			Id        string `json:"id"`
+			FirstName string `json:"firstName"`
+			LastName  string `json:"lastName"`
+			Age       int    `json:"age"`
+		} `json:"user"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &res); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", buf.String(), err)
+	}
+	if res.User.Id != "foo-bar" || res.User.FirstName != "jane" || res.User.LastName != "example.com" || res.User.Age != 36 {
+		t.Errorf("Expected user jane@example.com, Got: %s", buf.String())
+	}
+}
+
+func TestGrpcCallErrors(t *testing.T) {
+	opts := startTestGrpcServer(t)
+
+	tests := []struct {
+		method string
+		body   string
+		err    error
+	}{
+		{method: "Users", err: InvalidGrpcMethod},
+		{method: "Accounts/GetUser", err: InvalidGrpcMethod},
+		{method: "Users/DeleteUser", err: InvalidGrpcMethod},
+		{method: "Users/GetUser", body: `{"mail": "jane@example.com"}`, err: InvalidJsonBody},
+	}
+	for _, tc := range tests {
+		gc := grpcConfig{
+			server:      "bufnet",
+			method:      tc.method,
+			body:        tc.body,
+			dialOptions: opts,
+		}
+		err := gc.call(context.Background(), &bytes.Buffer{})
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s %s: Expected error %v, Got: %v", tc.method, tc.body, tc.err, err)
+		}
+	}
+
+	// errors of the server come back as they are
+	gc := grpcConfig{
+		server:      "bufnet",
+		method:      "Users.GetUser",
+		body:        `{"email": "jane"}`,
+		dialOptions: opts,
+	}
+	err := gc.call(context.Background(), &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "invalid email address") {
+		t.Errorf("Expected error invalid email address, Got: %v", err)
+	}
+}
+
+// decodeMessages decodes the JSON messages printed by a call.
+func decodeMessages(t *testing.T, r io.Reader) []map[string]interface{} {
+	var msgs []map[string]interface{}
+	dec := json.NewDecoder(r)
+	for {
+		var m map[string]interface{}
+		err := dec.Decode(&m)
+		if err == io.EOF {
+			return msgs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, m)
+	}
+}
+
+func TestGrpcServerStreaming(t *testing.T) {
+	opts := startTestGrpcServer(t)
+
+	tests := []struct {
+		maxMessages int
+		expected    int
+	}{
+		{maxMessages: 0, expected: 5},
+		{maxMessages: 2, expected: 2},
+		{maxMessages: 10, expected: 5},
+	}
+	for _, tc := range tests {
+		gc := grpcConfig{
+			server:      "bufnet",
+			method:      "Repo/GetRepos",
+			body:        `{"id": "foo-bar"}`,
+			maxMessages: tc.maxMessages,
+			dialOptions: opts,
+		}
+		var buf bytes.Buffer
+		if err := gc.call(context.Background(), &buf); err != nil {
+			t.Fatal(err)
+		}
+		msgs := decodeMessages(t, &buf)
+		if len(msgs) != tc.expected {
+			t.Fatalf("max-messages %d: Expected %d messages, Got: %d", tc.maxMessages, tc.expected, len(msgs))
+		}
+		for i, m := range msgs {
+			repo := m["repo"].(map[string]interface{})
+			if repo["name"] != fmt.Sprintf("repo-%d", i+1) || repo["id"] != "foo-bar" {
+				t.Errorf("Expected repo-%d, Got: %v", i+1, repo)
+			}
+		}
+	}
+}
+
+func TestGrpcClientStreaming(t *testing.T) {
+	opts := startTestGrpcServer(t)
+
+	f, err := os.CreateTemp(t.TempDir(), "requests*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bytes are base64 in JSON: "aGVsbG8=" is hello
+	fmt.Fprintln(f, `{"context": {"creatorId": "jane", "name": "mync"}}`)
+	fmt.Fprintln(f, `{"data": "aGVsbG8="}`)
+	fmt.Fprintln(f, `{"data": "aGVsbG8="}`)
+	f.Close()
+
+	gc := grpcConfig{
+		server:      "bufnet",
+		method:      "Repo/CreateRepo",
+		bodyFile:    f.Name(),
+		dialOptions: opts,
+	}
+	var buf bytes.Buffer
+	if err := gc.call(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	msgs := decodeMessages(t, &buf)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 message, Got: %s", buf.String())
+	}
+	repo := msgs[0]["repo"].(map[string]interface{})
+	if repo["name"] != "mync" || msgs[0]["size"] != float64(10) {
+		t.Errorf("Expected repo mync of size 10, Got: %s", buf.String())
+	}
+}
+
+func TestGrpcBidiStreaming(t *testing.T) {
+	opts := startTestGrpcServer(t)
+
+	gc := grpcConfig{
+		server:      "bufnet",
+		method:      "Users/GetHelp",
+		bodyFile:    "-",
+		stdin:       strings.NewReader("{\"request\": \"one\"}\n{\"request\": \"two\"}\n{\"request\": \"three\"}\n"),
+		dialOptions: opts,
+	}
+	var buf bytes.Buffer
+	if err := gc.call(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	msgs := decodeMessages(t, &buf)
+	expected := []string{"one", "two", "three"}
+	if len(msgs) != len(expected) {
+		t.Fatalf("Expected %d messages, Got: %s", len(expected), buf.String())
+	}
+	for i, m := range msgs {
+		if m["response"] != expected[i] {
+			t.Errorf("Expected response %s, Got: %v", expected[i], m["response"])
+		}
+	}
+
+	// an invalid request cancels the call
+	gc.stdin = strings.NewReader("{\"request\": \"one\"}\n{\"requests\": \"two\"}\n")
+	err := gc.call(context.Background(), &bytes.Buffer{})
+	if !errors.Is(err, InvalidJsonBody) {
+		t.Errorf("Expected error %v, Got: %v", InvalidJsonBody, err)
+	}
+
+	// the call ends with the responses, without waiting for the input to end
+	r, pw := io.Pipe()
+	t.Cleanup(func() { pw.Close() })
+	go pw.Write([]byte("{\"request\": \"one\"}\n"))
+	gc.stdin = r
+	gc.maxMessages = 1
+	done := make(chan error)
+	go func() {
+		done <- gc.call(context.Background(), &bytes.Buffer{})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected the call to end, Got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the call to end, Got: waiting for the input")
+	}
+}
+
+// flakyUserService fails its first calls with UNAVAILABLE, and answers after a delay.
+type flakyUserService struct {
+	userService
+	failures int32
+	calls    int32
+	delay    time.Duration
+}
+
+func (s *flakyUserService) GetUser(ctx context.Context, in *svc.UserGetRequest) (*svc.UserGetReply, error) {
+	if atomic.AddInt32(&s.calls, 1) <= s.failures {
+		return nil, status.Error(codes.Unavailable, "try again")
+	}
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.userService.GetUser(ctx, in)
+}
+
+func TestGrpcRetries(t *testing.T) {
+	defer func(d time.Duration) { retryBaseDelay = d }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	tests := []struct {
+		failures int32
+		retries  int
+		err      error
+		calls    int32
+	}{
+		{failures: 2, retries: 2, calls: 3},
+		{failures: 2, retries: 1, err: ErrNetwork, calls: 2},
+		{failures: 1, retries: 0, err: ErrNetwork, calls: 1},
+	}
+	for _, tc := range tests {
+		users := &flakyUserService{failures: tc.failures}
+		gc := grpcConfig{
+			server:      "bufnet",
+			method:      "Users/GetUser",
+			body:        `{"email": "jane@example.com"}`,
+			retries:     tc.retries,
+			dialOptions: startTestGrpcServerWith(t, users, true),
+		}
+		err := grpcError(gc.call(context.Background(), &bytes.Buffer{}))
+		if !errors.Is(err, tc.err) || (tc.err == nil && err != nil) {
+			t.Errorf("%d failures, %d retries: Expected error %v, Got: %v", tc.failures, tc.retries, tc.err, err)
+		}
+		if users.calls != tc.calls {
+			t.Errorf("%d failures, %d retries: Expected %d calls, Got: %d", tc.failures, tc.retries, tc.calls, users.calls)
+		}
+	}
+}
+
+func TestGrpcTimeout(t *testing.T) {
+	users := &flakyUserService{delay: time.Second}
+	gc := grpcConfig{
+		server:      "bufnet",
+		method:      "Users/GetUser",
+		body:        `{"email": "jane@example.com"}`,
+		timeout:     50 * time.Millisecond,
+		dialOptions: startTestGrpcServerWith(t, users, true),
+	}
+	err := grpcError(gc.call(context.Background(), &bytes.Buffer{}))
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected error %v, Got: %v", ErrTimeout, err)
+	}
+
+	// errors of the server are error responses
+	gc = grpcConfig{
+		server:      "bufnet",
+		method:      "Users/GetUser",
+		body:        `{"email": "jane"}`,
+		dialOptions: startTestGrpcServer(t),
+	}
+	err = grpcError(gc.call(context.Background(), &bytes.Buffer{}))
+	if !errors.Is(err, ErrStatus) {
+		t.Errorf("Expected error %v, Got: %v", ErrStatus, err)
+	}
+}
@@ -2,43 +2,145 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// httpFormats are the output formats of the http command.
+var httpFormats = []string{formatRaw, formatJson, formatYaml, formatHeaders}
+
+// httpMethods are the methods `-verb` accepts.
+var httpMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+}
+
 type httpConfig struct {
-	url            string
-	verb           string
-	outputFilePath string
-	body           string
-	filePath       string
-	formData       map[string]string
+	url          string
+	verb         string
+	body         string
+	filePath     string
+	formData     stringsFlag
+	form         stringsFlag
+	uploads      stringsFlag
+	headers      stringsFlag
+	query        stringsFlag
+	basicAuth    string
+	bearerToken  string
+	include      bool
+	timeout      time.Duration
+	retries      int
+	maxRedirects int
+	noRedirect   bool
+	output       outputConfig
+	resume       bool
+	sha256       string
+	proxy        string
+	cookieJar    string
+	http2        bool
+	http11       bool
+	caCert       string
+	clientCert   string
+	clientKey    string
+	insecure     bool
+	verbose      bool
+	printCurl    bool
+
+	// transport sends the requests, the default one when nil
+	transport http.RoundTripper
+	// jar keeps the cookies in the -cookie-jar file
+	jar *cookieJar
+	// trace is where the connections are traced with -verbose, nil to not trace them
+	trace io.Writer
+	// progress is where the progress of the download is shown, nil to hide it
+	progress io.Writer
+	// partial is the -output file of a download continued with -continue
+	partial *partialFile
 }
 
 func HandleHttp(w io.Writer, args []string) error {
+	hc, err := parseHttpArgs(w, args)
+	if err != nil {
+		return err
+	}
+	if hc.printCurl {
+		fmt.Fprintln(w, hc.curlCommand())
+		return nil
+	}
+	return hc.send(w)
+}
+
+// send sends the request and writes the response to the output file, or else to `w`.
+func (hc *httpConfig) send(w io.Writer) error {
+	var err error
+	if hc.resume {
+		if hc.partial, err = openPartial(hc.output.path); err != nil {
+			return err
+		}
+	}
+	err = hc.validateMethod(w)
+	if hc.partial != nil {
+		if cerr := hc.partial.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if hc.jar != nil {
+		if serr := hc.jar.save(); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// parseHttpArgs parses the flags and the server of the http command.
+func parseHttpArgs(w io.Writer, args []string) (*httpConfig, error) {
 	hc := httpConfig{}
 	fs := flag.NewFlagSet("http", flag.ContinueOnError)
 
 	fs.SetOutput(w)
-	fs.StringVar(&hc.verb, "verb", "GET", "HTTP method")
-	fs.StringVar(&hc.outputFilePath, "output", "", "File path where save the data's output")
+	fs.StringVar(&hc.verb, "verb", "GET", "HTTP method: GET, POST, PUT, PATCH, DELETE, HEAD or OPTIONS, POST by default when the request has a body")
 	fs.StringVar(&hc.body, "body", "", "JSON data to be used as payload")
 	fs.StringVar(&hc.filePath, "body-file", "", "File path containing the JSON data to be used as payload")
-	fs.StringVar(&hc.filePath, "upload", "", "File path of the upload file")
-	str := fs.String("form-data", "", "Form-Data key-value pair")
-
-	if len(*str) > 0 {
-		form := strings.Split(*str, "=")
-
-		hc.formData[form[0]] = form[1]
-	}
+	fs.Var(&hc.uploads, "upload", "File to upload in a multipart form, as field=@path, can be repeated")
+	fs.Var(&hc.formData, "form-data", "Form-Data key-value pair, as key=value, can be repeated")
+	fs.Var(&hc.form, "form", "URL-encoded form field, as key=value, sent as an application/x-www-form-urlencoded body, can be repeated")
+	hc.requestFlags(fs)
+	fs.BoolVar(&hc.include, "include", false, "Print the status line and the headers of the response")
+	fs.DurationVar(&hc.timeout, "timeout", 0, "Timeout of each attempt of the request, 0 for no timeout")
+	fs.IntVar(&hc.retries, "retries", 0, "Number of retries of the request on network errors and on 408, 429, 500, 502, 503 and 504 responses. "+
+		"POST and PATCH requests are only retried when they couldn't be sent, or on 429 and 503 responses with a Retry-After header")
+	fs.IntVar(&hc.maxRedirects, "max-redirects", 10, "Maximum number of redirects followed")
+	fs.BoolVar(&hc.noRedirect, "no-redirect", false, "Don't follow redirects")
+	hc.output.flags(fs, formatRaw, httpFormats...)
+	fs.BoolVar(&hc.resume, "continue", false, "Continue the download of a partial -output file with a Range request")
+	fs.StringVar(&hc.sha256, "sha256", "", "Expected SHA-256 checksum of the response body, in hexadecimal")
+	fs.StringVar(&hc.cookieJar, "cookie-jar", "", "File path of the cookie jar, read before the request and written after it")
+	fs.BoolVar(&hc.http2, "http2", false, "Force HTTP/2, spoken over cleartext for http URLs")
+	fs.BoolVar(&hc.http11, "http1.1", false, "Force HTTP/1.1")
+	hc.connectionFlags(fs)
+	fs.BoolVar(&hc.printCurl, "print-curl", false, "Print the equivalent curl command instead of sending the request")
 
 	fs.Usage = func() {
 		var usageString = `
@@ -52,140 +154,423 @@ http: <options> server`
 	}
 	err := fs.Parse(args)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if fs.NArg() != 1 {
-		return ErrNoServerSpecified
+		return nil, ErrNoServerSpecified
 	}
 
 	hc.url = fs.Arg(0)
-	fmt.Fprintln(w, "Executing http command")
-
-	if len(hc.outputFilePath) > 0 {
-		var file *os.File
-
-		path := filepath.Join(hc.outputFilePath)
-		file, err = os.Open(path)
-		if err != nil {
-			file, err = os.Create(path)
-			if err != nil {
-				return err
-			}
+	verbSet := false
+	fs.Visit(func(f *flag.Flag) {
+		verbSet = verbSet || f.Name == "verb"
+	})
+	if !verbSet && (len(hc.body) > 0 || len(hc.filePath) > 0 || len(hc.formData) > 0 || len(hc.form) > 0 || len(hc.uploads) > 0) {
+		// the body is posted, as curl does, unless another method is asked for
+		hc.verb = http.MethodPost
+	}
+	if err = hc.output.validate(httpFormats...); err != nil {
+		return nil, err
+	}
+	if len(hc.sha256) > 0 && !validChecksum(hc.sha256) {
+		return nil, fmt.Errorf("%w: %s", InvalidChecksum, hc.sha256)
+	}
+	if hc.resume && (len(hc.output.path) == 0 || hc.output.append) {
+		return nil, ErrContinueWithoutOutput
+	}
+	if (hc.resume || len(hc.sha256) > 0) && (!hc.output.copiesBody() || (hc.resume && hc.include)) {
+		return nil, ErrConflictingDownload
+	}
+	if len(hc.output.path) > 0 && isTerminal(os.Stderr) {
+		hc.progress = os.Stderr
+	}
+	if hc.transport, err = hc.newTransport(); err != nil {
+		return nil, err
+	}
+	if len(hc.cookieJar) > 0 {
+		if hc.jar, err = loadCookieJar(hc.cookieJar); err != nil {
+			return nil, err
 		}
+	}
+	if hc.verbose {
+		hc.trace = w
+	}
+	return &hc, nil
+}
 
-		err = hc.validateMethod(file)
-	} else {
-		err = hc.validateMethod(w)
+func (hc *httpConfig) validateMethod(w io.Writer) error {
+	verb := strings.ToUpper(hc.verb)
+	if !httpMethods[verb] {
+		return InvalidHttpMethod
 	}
 
+	res, err := hc.do(context.Background(), verb)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer res.Body.Close()
+	if hc.partial != nil {
+		return hc.continueDownload(res)
+	}
+	if (res.StatusCode < 200 || res.StatusCode > 299) && len(hc.output.path) > 0 {
+		// the output file is left as it is, as when continuing a download
+		return statusError(res)
+	}
+
+	out, closeOut, err := hc.output.open(w)
+	if err != nil {
+		return err
+	}
+	err = hc.writeResponse(out, res)
+	if cerr := closeOut(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
-func (hc *httpConfig) validateMethod(w io.Writer) error {
-	var data []byte
-	var err error
-	switch hc.verb {
-	case "GET":
-		data, err = hc.handleGet()
-	case "POST":
-		data, err = hc.handlePost()
-	default:
-		return InvalidHttpMethod
+// writeResponse writes the response in the output format, and checks its status and its checksum.
+func (hc *httpConfig) writeResponse(w io.Writer, res *http.Response) error {
+	if hc.include || hc.output.format == formatHeaders {
+		printResponseHead(w, res)
+	}
+	h := hc.newChecksum()
+	if err := hc.writeBody(w, res, h); err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return statusError(res)
+	}
+	return hc.verifyChecksum(h)
+}
+
+// statusError is the error of a non-2xx response.
+func statusError(res *http.Response) error {
+	return &requestError{kind: ErrStatus, err: fmt.Errorf("the server answered %s", res.Status)}
+}
+
+// do sends the request, retrying it with an exponential backoff while it fails with a network error
+// or a retryable response. Requests which aren't idempotent are only retried after a network error when
+// they weren't written to the connection. The request is built again for each attempt, as its body is consumed.
+func (hc *httpConfig) do(ctx context.Context, verb string) (*http.Response, error) {
+	client := hc.client()
+	for attempt := 0; ; attempt++ {
+		var wrote atomic.Bool
+		actx := httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			WroteRequest: func(httptrace.WroteRequestInfo) {
+				wrote.Store(true)
+			},
+		})
+		req, err := hc.newRequest(actx, verb)
+		if err != nil {
+			return nil, err
+		}
+		res, err := client.Do(req)
+		last := attempt >= hc.retries
+		if err != nil && (last || errors.Is(err, ErrTooManyRedirects) || (!idempotentMethod(verb) && wrote.Load())) {
+			return nil, httpError(err)
+		}
+		if err == nil && (last || !retryableResponse(verb, res)) {
+			return res, nil
+		}
+
+		wait := backoff(attempt)
+		if res != nil {
+			if d, ok := retryAfter(res); ok {
+				wait = d
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+		if err = sleep(ctx, wait); err != nil {
+			return nil, httpError(err)
+		}
+	}
+}
+
+func (hc *httpConfig) client() *http.Client {
+	c := &http.Client{
+		Transport: hc.transport,
+		Timeout:   hc.timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if hc.noRedirect {
+				return http.ErrUseLastResponse
+			}
+			if len(via) > hc.maxRedirects {
+				return fmt.Errorf("%w: stopped after %d redirects", ErrTooManyRedirects, hc.maxRedirects)
+			}
+			return nil
+		},
 	}
+	if hc.jar != nil {
+		c.Jar = hc.jar
+	}
+	return c
+}
 
+// writeBody writes the body of the response in the output format, copying it as it is
+// received when it's neither formatted nor filtered. The copied body is fed to the hash if any.
+func (hc *httpConfig) writeBody(w io.Writer, res *http.Response, h hash.Hash) error {
+	if hc.output.format == formatHeaders {
+		return nil
+	}
+	if hc.output.copiesBody() {
+		return hc.copyBody(w, res, h, 0)
+	}
+	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		return err
+		return httpError(err)
 	}
-	w.Write(data)
+	if len(body) == 0 {
+		return nil
+	}
+	return hc.output.writeJSON(w, body)
+}
 
+// copyBody copies the body as it's received, through the hash and the progress of the download if any.
+// `resumed` is the length downloaded before, when the download is continued.
+func (hc *httpConfig) copyBody(w io.Writer, res *http.Response, h hash.Hash, resumed int64) error {
+	t := &writeTracker{w: w}
+	var dst io.Writer = t
+	if h != nil {
+		dst = io.MultiWriter(t, h)
+	}
+	if hc.progress != nil {
+		p := newProgressWriter(dst, hc.progress, res, resumed)
+		defer p.finish()
+		dst = p
+	}
+	if _, err := io.Copy(dst, res.Body); err != nil {
+		if t.err != nil {
+			return t.err
+		}
+		return httpError(err)
+	}
 	return nil
 }
 
-func (hc *httpConfig) handleGet() ([]byte, error) {
-	res, err := http.Get(hc.url)
+// newRequest builds the request with its body, query parameters, headers and credentials.
+func (hc *httpConfig) newRequest(ctx context.Context, verb string) (*http.Request, error) {
+	body, ct, err := hc.requestBody()
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
+	req, err := http.NewRequestWithContext(ctx, verb, hc.url, body)
+	if err == nil {
+		if body != nil {
+			req.Header.Set("Content-Type", ct)
+		}
+		err = hc.setHeaders(req)
+	}
+	if err != nil {
+		// stops the writing of a multipart body
+		if c, ok := body.(io.Closer); ok {
+			c.Close()
+		}
+		return nil, err
+	}
+	return hc.withTrace(req), nil
+}
 
-	return io.ReadAll(res.Body)
+// requestFlags registers the flags of the query parameters, the headers and the credentials,
+// which the ws and sse commands take too.
+func (hc *httpConfig) requestFlags(fs *flag.FlagSet) {
+	fs.Var(&hc.headers, "H", "Request header, as \"Key: Value\", can be repeated")
+	fs.Var(&hc.query, "query", "Query parameter, as key=value, can be repeated")
+	fs.StringVar(&hc.basicAuth, "basic-auth", "", "Basic authentication credentials, as user:password")
+	fs.StringVar(&hc.bearerToken, "bearer", "", "Bearer token sent in the Authorization header")
 }
 
-func (hc *httpConfig) handlePost() ([]byte, error) {
-	var body io.Reader
-	var ct = "application/json"
-	if len(hc.filePath) > 0 {
-		hc.filePath = filepath.Join(hc.filePath)
-		file, err := os.Open(hc.filePath)
-		if err != nil {
-			return nil, err
+// setHeaders sets the query parameters, the headers and the credentials of the request.
+// The headers given with `-H` come last, so they override the others.
+func (hc *httpConfig) setHeaders(req *http.Request) error {
+	if err := hc.addQuery(req.URL); err != nil {
+		return err
+	}
+
+	if len(hc.basicAuth) > 0 && len(hc.bearerToken) > 0 {
+		return ErrConflictingAuth
+	}
+	if len(hc.basicAuth) > 0 {
+		user, password, _ := strings.Cut(hc.basicAuth, ":")
+		req.SetBasicAuth(user, password)
+	}
+	if len(hc.bearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+hc.bearerToken)
+	}
+	if hc.partial != nil && hc.partial.size > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", hc.partial.size))
+	}
+	for _, h := range hc.headers {
+		k, v, ok := strings.Cut(h, ":")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || len(k) == 0 {
+			return fmt.Errorf("%w: %s", InvalidHttpHeader, h)
+		}
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+			continue
 		}
+		req.Header.Add(k, v)
+	}
+	return nil
+}
 
-		j, err := io.ReadAll(file)
-		if err != nil {
-			return j, err
+// addQuery adds the query parameters to the URL.
+func (hc *httpConfig) addQuery(u *url.URL) error {
+	if len(hc.query) == 0 {
+		return nil
+	}
+	q := u.Query()
+	for _, param := range hc.query {
+		k, v, ok := strings.Cut(param, "=")
+		if !ok || len(k) == 0 {
+			return fmt.Errorf("%w: %s", InvalidQueryParam, param)
 		}
+		q.Add(k, v)
+	}
+	u.RawQuery = q.Encode()
+	return nil
+}
 
-		if len(hc.formData) > 0 {
-			j, ct, err = hc.handleMultipart(j)
-			if err != nil {
-				return j, err
-			}
+// requestBody returns the body of the request and its content type, the body being nil when there is none.
+func (hc *httpConfig) requestBody() (io.Reader, string, error) {
+	var ct = "application/json"
+	isMultipart := len(hc.formData) > 0 || len(hc.uploads) > 0
+	if isMultipart && (len(hc.filePath) > 0 || len(hc.body) > 0) {
+		return nil, "", ErrConflictingBody
+	}
+	if len(hc.form) > 0 && (isMultipart || len(hc.filePath) > 0 || len(hc.body) > 0) {
+		return nil, "", ErrConflictingBody
+	}
+
+	if isMultipart {
+		return hc.multipartBody()
+	} else if len(hc.form) > 0 {
+		return hc.urlencodedBody()
+	} else if len(hc.filePath) > 0 {
+		hc.filePath = filepath.Join(hc.filePath)
+		j, err := os.ReadFile(hc.filePath)
+		if err != nil {
+			return nil, "", err
 		}
 		if !json.Valid(j) {
-			return nil, InvalidJsonBody
+			return nil, "", InvalidJsonBody
 		}
 
-		body = bytes.NewBuffer(j)
-
+		return bytes.NewBuffer(j), ct, nil
 	} else if len(hc.body) > 0 {
 		if !json.Valid([]byte(hc.body)) {
-			return nil, InvalidJsonBody
+			return nil, "", InvalidJsonBody
 		}
 
-		body = bytes.NewReader([]byte(hc.body))
+		return bytes.NewReader([]byte(hc.body)), ct, nil
 	}
+	return nil, "", nil
+}
 
-	res, err := http.Post(hc.url, ct, body)
-	if err != nil {
-		return nil, err
+// urlencodedBody returns the -form fields encoded as an application/x-www-form-urlencoded body, in the order given.
+func (hc *httpConfig) urlencodedBody() (io.Reader, string, error) {
+	fields := make([]string, 0, len(hc.form))
+	for _, kv := range hc.form {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || len(k) == 0 {
+			return nil, "", fmt.Errorf("%w: %s", InvalidFormData, kv)
+		}
+		fields = append(fields, url.QueryEscape(k)+"="+url.QueryEscape(v))
 	}
-
-	defer res.Body.Close()
-	return io.ReadAll(res.Body)
+	return strings.NewReader(strings.Join(fields, "&")), "application/x-www-form-urlencoded", nil
 }
 
-func (hc *httpConfig) handleMultipart(b []byte) ([]byte, string, error) {
-	var buf bytes.Buffer
-	var err error
-	var fw io.Writer
+// formFile is a file uploaded in a multipart form.
+type formFile struct {
+	field string
+	file  *os.File
+}
 
-	mw := multipart.NewWriter(&buf)
+// multipartBody returns a multipart form with the form data followed by the uploaded files. The form is
+// written while the request is sent, so the files aren't held in memory.
+func (hc *httpConfig) multipartBody() (io.Reader, string, error) {
+	fields := make([][2]string, 0, len(hc.formData))
+	for _, kv := range hc.formData {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || len(k) == 0 {
+			return nil, "", fmt.Errorf("%w: %s", InvalidFormData, kv)
+		}
+		fields = append(fields, [2]string{k, v})
+	}
 
-	for key, value := range hc.formData {
-		fw, err = mw.CreateFormField(key)
+	var files []formFile
+	closeFiles := func() {
+		for _, f := range files {
+			f.file.Close()
+		}
+	}
+	for _, upload := range hc.uploads {
+		field, path, ok := strings.Cut(upload, "=")
+		path = strings.TrimPrefix(path, "@")
+		if !ok || len(field) == 0 || len(path) == 0 {
+			closeFiles()
+			return nil, "", fmt.Errorf("%w: %s", InvalidFormData, upload)
+		}
+		file, err := os.Open(path)
 		if err != nil {
+			closeFiles()
 			return nil, "", err
 		}
-
-		fmt.Fprintf(fw, value)
+		files = append(files, formFile{field: field, file: file})
 	}
 
-	fw, err = mw.CreateFormFile("filedata", hc.filePath)
-	if err != nil {
-		return nil, "", err
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		defer closeFiles()
+		pw.CloseWithError(writeMultipart(mw, fields, files))
+	}()
+	return pr, mw.FormDataContentType(), nil
+}
+
+func writeMultipart(mw *multipart.Writer, fields [][2]string, files []formFile) error {
+	for _, f := range fields {
+		if err := mw.WriteField(f[0], f[1]); err != nil {
+			return err
+		}
 	}
-	data := bytes.NewReader(b)
-	_, err = io.Copy(fw, data)
-	err = mw.Close()
-	if err != nil {
-		return nil, "", err
+	for _, f := range files {
+		name := filepath.Base(f.file.Name())
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+			"name":     f.field,
+			"filename": name,
+		}))
+		ct := mime.TypeByExtension(filepath.Ext(name))
+		if len(ct) == 0 {
+			ct = "application/octet-stream"
+		}
+		h.Set("Content-Type", ct)
+		fw, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(fw, f.file); err != nil {
+			return err
+		}
 	}
+	return mw.Close()
+}
 
-	contentType := mw.FormDataContentType()
-	return buf.Bytes(), contentType, nil
+// printResponseHead writes the status line and the headers of the response, sorted, followed by a blank line.
+func printResponseHead(w io.Writer, res *http.Response) {
+	fmt.Fprintf(w, "%s %s\n", res.Proto, res.Status)
+	keys := make([]string, 0, len(res.Header))
+	for k := range res.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range res.Header[k] {
+			fmt.Fprintf(w, "%s: %s\n", k, v)
+		}
+	}
+	fmt.Fprintln(w)
 }
@@ -0,0 +1,566 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoRequest is what the echo server answers.
+type echoRequest struct {
+	Method string      `json:"method"`
+	Query  string      `json:"query"`
+	Header http.Header `json:"header"`
+	Host   string      `json:"host"`
+	Body   string      `json:"body"`
+}
+
+func startEchoServer(t *testing.T) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Echo", "yes")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(echoRequest{
+			Method: r.Method,
+			Query:  r.URL.RawQuery,
+			Header: r.Header,
+			Host:   r.Host,
+			Body:   string(b),
+		})
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// echo runs the http command against the echo server and decodes its answer.
+func echo(t *testing.T, url string, args ...string) echoRequest {
+	var buf bytes.Buffer
+	if err := HandleHttp(&buf, append(args, url)); err != nil {
+		t.Fatal(err)
+	}
+	var req echoRequest
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		t.Fatalf("invalid echo %q: %v", buf.String(), err)
+	}
+	return req
+}
+
+func TestHttpMethods(t *testing.T) {
+	ts := startEchoServer(t)
+
+	for _, verb := range []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "put"} {
+		req := echo(t, ts.URL, "-verb", verb, "-body", `{"name": "jane"}`)
+		if req.Method != strings.ToUpper(verb) {
+			t.Errorf("Expected method %s, Got: %s", verb, req.Method)
+		}
+		if req.Body != `{"name": "jane"}` || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: Expected the JSON body, Got: %q %q", verb, req.Body, req.Header.Get("Content-Type"))
+		}
+	}
+
+	// HEAD responses have no body
+	var buf bytes.Buffer
+	if err := HandleHttp(&buf, []string{"-verb", "HEAD", "-include", ts.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "HTTP/1.1 201 Created\n") || strings.HasSuffix(buf.String(), "}\n") {
+		t.Errorf("Expected the response head only, Got: %s", buf.String())
+	}
+
+	err := HandleHttp(&bytes.Buffer{}, []string{"-verb", "TRACE", ts.URL})
+	if !errors.Is(err, InvalidHttpMethod) {
+		t.Errorf("Expected error %v, Got: %v", InvalidHttpMethod, err)
+	}
+}
+
+func TestHttpHeadersAndQuery(t *testing.T) {
+	ts := startEchoServer(t)
+
+	req := echo(t, ts.URL,
+		"-H", "X-Request-Id: 42",
+		"-H", "Accept:text/plain",
+		"-H", "X-Request-Id: 43",
+		"-H", "Host: example.com",
+		"-query", "q=hello world",
+		"-query", "page=2",
+		"-query", "page=3",
+	)
+	if ids := req.Header.Values("X-Request-Id"); len(ids) != 2 || ids[0] != "42" || ids[1] != "43" {
+		t.Errorf("Expected X-Request-Id 42 and 43, Got: %v", ids)
+	}
+	if req.Header.Get("Accept") != "text/plain" {
+		t.Errorf("Expected Accept text/plain, Got: %s", req.Header.Get("Accept"))
+	}
+	if req.Host != "example.com" {
+		t.Errorf("Expected host example.com, Got: %s", req.Host)
+	}
+	if req.Query != "page=2&page=3&q=hello+world" {
+		t.Errorf("Expected query page=2&page=3&q=hello+world, Got: %s", req.Query)
+	}
+
+	// parameters already in the URL are kept
+	req = echo(t, ts.URL+"?a=1", "-query", "b=2")
+	if req.Query != "a=1&b=2" {
+		t.Errorf("Expected query a=1&b=2, Got: %s", req.Query)
+	}
+
+	tests := []struct {
+		args []string
+		err  error
+	}{
+		{args: []string{"-H", "X-Request-Id"}, err: InvalidHttpHeader},
+		{args: []string{"-H", ": 42"}, err: InvalidHttpHeader},
+		{args: []string{"-query", "page"}, err: InvalidQueryParam},
+		{args: []string{"-query", "=2"}, err: InvalidQueryParam},
+	}
+	for _, tc := range tests {
+		err := HandleHttp(&bytes.Buffer{}, append(tc.args, ts.URL))
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%v: Expected error %v, Got: %v", tc.args, tc.err, err)
+		}
+	}
+}
+
+func TestHttpAuth(t *testing.T) {
+	ts := startEchoServer(t)
+
+	req := echo(t, ts.URL, "-basic-auth", "jane:s3cr:et")
+	r := http.Request{Header: req.Header}
+	user, password, ok := r.BasicAuth()
+	if !ok || user != "jane" || password != "s3cr:et" {
+		t.Errorf("Expected basic auth jane:s3cr:et, Got: %s", req.Header.Get("Authorization"))
+	}
+
+	req = echo(t, ts.URL, "-bearer", "token")
+	if req.Header.Get("Authorization") != "Bearer token" {
+		t.Errorf("Expected Bearer token, Got: %s", req.Header.Get("Authorization"))
+	}
+
+	// -H overrides the credentials
+	req = echo(t, ts.URL, "-bearer", "token", "-H", "Authorization: Token other")
+	if a := req.Header.Values("Authorization"); len(a) != 2 || a[1] != "Token other" {
+		t.Errorf("Expected the Authorization header, Got: %v", a)
+	}
+
+	err := HandleHttp(&bytes.Buffer{}, []string{"-bearer", "token", "-basic-auth", "jane:secret", ts.URL})
+	if !errors.Is(err, ErrConflictingAuth) {
+		t.Errorf("Expected error %v, Got: %v", ErrConflictingAuth, err)
+	}
+}
+
+func TestHttpInclude(t *testing.T) {
+	ts := startEchoServer(t)
+
+	var buf bytes.Buffer
+	if err := HandleHttp(&buf, []string{"-include", ts.URL}); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	head, body, ok := strings.Cut(out, "\n\n")
+	if !ok {
+		t.Fatalf("Expected the response head, Got: %s", out)
+	}
+	lines := strings.Split(head, "\n")
+	if lines[0] != "HTTP/1.1 201 Created" {
+		t.Errorf("Expected status line HTTP/1.1 201 Created, Got: %s", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "Content-Length: ") || lines[2] != "Content-Type: application/json" {
+		t.Errorf("Expected sorted headers, Got: %v", lines[1:])
+	}
+	if lines[len(lines)-1] != "X-Echo: yes" {
+		t.Errorf("Expected header X-Echo: yes, Got: %v", lines[1:])
+	}
+	if !json.Valid([]byte(body)) {
+		t.Errorf("Expected the JSON body, Got: %s", body)
+	}
+}
+
+// formPart is a part of a multipart form received by the form server.
+type formPart struct {
+	Field       string `json:"field"`
+	FileName    string `json:"file_name"`
+	ContentType string `json:"content_type"`
+	Data        string `json:"data"`
+}
+
+// startFormServer starts a server answering the parts of the multipart forms it receives.
+func startFormServer(t *testing.T) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the form is streamed
+		if r.ContentLength != -1 {
+			http.Error(w, "expected a chunked body", http.StatusBadRequest)
+			return
+		}
+		mr, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		parts := []formPart{}
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			b, err := io.ReadAll(p)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			parts = append(parts, formPart{
+				Field:       p.FormName(),
+				FileName:    p.FileName(),
+				ContentType: p.Header.Get("Content-Type"),
+				Data:        string(b),
+			})
+		}
+		json.NewEncoder(w).Encode(parts)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestHttpMultipart(t *testing.T) {
+	ts := startFormServer(t)
+
+	dir := t.TempDir()
+	report := filepath.Join(dir, "report.txt")
+	if err := os.WriteFile(report, []byte("not JSON"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(data, bytes.Repeat([]byte{0, 1, 2}, 1<<16), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err := HandleHttp(&buf, []string{
+		"-verb", "POST",
+		"-form-data", "name=jane",
+		"-form-data", "expr=a=b",
+		"-upload", "report=@" + report,
+		"-upload", "data=" + data,
+		ts.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []formPart
+	if err := json.Unmarshal(buf.Bytes(), &parts); err != nil {
+		t.Fatalf("invalid answer %q: %v", buf.String(), err)
+	}
+	expected := []formPart{
+		{Field: "name", Data: "jane"},
+		{Field: "expr", Data: "a=b"},
+		{Field: "report", FileName: "report.txt", ContentType: "text/plain; charset=utf-8", Data: "not JSON"},
+		{Field: "data", FileName: "data.bin", ContentType: "application/octet-stream", Data: strings.Repeat("\x00\x01\x02", 1<<16)},
+	}
+	if len(parts) != len(expected) {
+		t.Fatalf("Expected %d parts, Got: %d", len(expected), len(parts))
+	}
+	for i := range expected {
+		if parts[i] != expected[i] {
+			t.Errorf("Expected part %s, Got: %s", expected[i].Field, parts[i].Field)
+		}
+	}
+
+	tests := []struct {
+		args []string
+		err  error
+	}{
+		{args: []string{"-form-data", "name"}, err: InvalidFormData},
+		{args: []string{"-upload", "report"}, err: InvalidFormData},
+		{args: []string{"-upload", "=@" + report}, err: InvalidFormData},
+		{args: []string{"-upload", "report=@" + filepath.Join(dir, "missing")}, err: os.ErrNotExist},
+		{args: []string{"-form-data", "name=jane", "-body", "{}"}, err: ErrConflictingBody},
+	}
+	for _, tc := range tests {
+		err := HandleHttp(&bytes.Buffer{}, append(append([]string{"-verb", "POST"}, tc.args...), ts.URL))
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%v: Expected error %v, Got: %v", tc.args, tc.err, err)
+		}
+	}
+}
+
+func TestHttpForm(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%s %s %s", r.Header.Get("Content-Type"), r.PostForm.Get("name"), r.PostForm.Get("expr"))
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	if err := HandleHttp(&buf, []string{"-form", "name=jane doe", "-form", "expr=a=b&c", ts.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "application/x-www-form-urlencoded jane doe a=b&c"; buf.String() != expected {
+		t.Errorf("Expected %q, Got: %q", expected, buf.String())
+	}
+
+	tests := []struct {
+		args []string
+		err  error
+	}{
+		{args: []string{"-form", "name"}, err: InvalidFormData},
+		{args: []string{"-form", "=jane"}, err: InvalidFormData},
+		{args: []string{"-form", "name=jane", "-body", "{}"}, err: ErrConflictingBody},
+		{args: []string{"-form", "name=jane", "-form-data", "expr=a"}, err: ErrConflictingBody},
+	}
+	for _, tc := range tests {
+		err := HandleHttp(&bytes.Buffer{}, append(tc.args, ts.URL))
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%v: Expected error %v, Got: %v", tc.args, tc.err, err)
+		}
+	}
+}
+
+func TestHttpDefaultVerb(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Method)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{nil, http.MethodGet},
+		{[]string{"-body", `{"name": "jane"}`}, http.MethodPost},
+		{[]string{"-form-data", "name=jane"}, http.MethodPost},
+		{[]string{"-form", "name=jane"}, http.MethodPost},
+		// an explicit -verb wins, even when it's GET
+		{[]string{"-verb", "PUT", "-body", `{"name": "jane"}`}, http.MethodPut},
+		{[]string{"-verb", "GET", "-form-data", "name=jane"}, http.MethodGet},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		if err := HandleHttp(&buf, append(tc.args, ts.URL)); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("%v: Expected %s, Got: %s", tc.args, tc.expected, buf.String())
+		}
+	}
+}
+
+func TestHttpRetries(t *testing.T) {
+	defer func(d time.Duration) { retryBaseDelay = d }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	tests := []struct {
+		verb       string
+		failures   int32
+		code       int
+		retryAfter bool
+		retries    string
+		err        error
+		calls      int32
+	}{
+		{verb: "POST", failures: 2, code: http.StatusServiceUnavailable, retryAfter: true, retries: "2", calls: 3},
+		{verb: "POST", failures: 2, code: http.StatusTooManyRequests, retryAfter: true, retries: "1", err: ErrStatus, calls: 2},
+		{verb: "PUT", failures: 2, code: http.StatusInternalServerError, retries: "2", calls: 3},
+		{verb: "PUT", failures: 1, code: http.StatusBadGateway, retries: "0", err: ErrStatus, calls: 1},
+		// not retryable
+		{verb: "PUT", failures: 1, code: http.StatusBadRequest, retries: "2", err: ErrStatus, calls: 1},
+		// POST requests may have been processed
+		{verb: "POST", failures: 1, code: http.StatusInternalServerError, retryAfter: true, retries: "2", err: ErrStatus, calls: 1},
+		{verb: "PATCH", failures: 1, code: http.StatusServiceUnavailable, retries: "2", err: ErrStatus, calls: 1},
+	}
+	for _, tc := range tests {
+		var calls int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			if atomic.AddInt32(&calls, 1) <= tc.failures {
+				if tc.retryAfter {
+					w.Header().Set("Retry-After", "0")
+				}
+				w.WriteHeader(tc.code)
+				return
+			}
+			// the body is sent again
+			w.Write(b)
+		}))
+		var buf bytes.Buffer
+		err := HandleHttp(&buf, []string{"-verb", tc.verb, "-body", `{"name": "jane"}`, "-retries", tc.retries, ts.URL})
+		ts.Close()
+		if !errors.Is(err, tc.err) || (tc.err == nil && err != nil) {
+			t.Errorf("%s %d %d, %s retries: Expected error %v, Got: %v", tc.verb, tc.failures, tc.code, tc.retries, tc.err, err)
+		}
+		if calls != tc.calls {
+			t.Errorf("%s %d %d, %s retries: Expected %d calls, Got: %d", tc.verb, tc.failures, tc.code, tc.retries, tc.calls, calls)
+		}
+		if tc.err == nil && !strings.HasSuffix(buf.String(), `{"name": "jane"}`) {
+			t.Errorf("Expected the body, Got: %s", buf.String())
+		}
+	}
+}
+
+// failingTransport fails the first `failures` requests, before sending them when `unsent` is set
+// and after the server received them otherwise.
+type failingTransport struct {
+	http.RoundTripper
+	failures int32
+	unsent   bool
+	calls    int32
+}
+
+func (t *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.AddInt32(&t.calls, 1) > t.failures {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	if t.unsent {
+		return nil, errors.New("connection refused")
+	}
+	res, err := t.RoundTripper.RoundTrip(req)
+	if err == nil {
+		res.Body.Close()
+	}
+	return nil, errors.New("connection reset")
+}
+
+func TestHttpRetriesUnsent(t *testing.T) {
+	defer func(d time.Duration) { retryBaseDelay = d }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer ts.Close()
+
+	for _, unsent := range []bool{true, false} {
+		hc, err := parseHttpArgs(&bytes.Buffer{}, []string{"-verb", "POST", "-body", `{"name": "jane"}`, "-retries", "2", ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport := &failingTransport{RoundTripper: hc.transport, failures: 1, unsent: unsent}
+		hc.transport = transport
+		res, err := hc.do(context.Background(), http.MethodPost)
+		if err == nil {
+			res.Body.Close()
+		}
+		// a POST request is sent again only if it didn't reach the server
+		if unsent && (err != nil || transport.calls != 2) {
+			t.Errorf("Expected the unsent request to be retried, Got: %v after %d calls", err, transport.calls)
+		}
+		if !unsent && (!errors.Is(err, ErrNetwork) || transport.calls != 1) {
+			t.Errorf("Expected the sent request not to be retried, Got: %v after %d calls", err, transport.calls)
+		}
+	}
+}
+
+func TestHttpRetriesCanceled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	hc, err := parseHttpArgs(&bytes.Buffer{}, []string{"-retries", "2", ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the wait before the retry stops with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = hc.do(ctx, http.MethodGet)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected error %v, Got: %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Expected the retry to be canceled, Got: %s", d)
+	}
+}
+
+func TestHttpErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	err := HandleHttp(&buf, []string{ts.URL + "/missing"})
+	if !errors.Is(err, ErrStatus) || !strings.Contains(err.Error(), "404 Not Found") {
+		t.Errorf("Expected error %v, Got: %v", ErrStatus, err)
+	}
+	// the body of error responses is printed
+	if !strings.Contains(buf.String(), "404 page not found") {
+		t.Errorf("Expected the body of the response, Got: %s", buf.String())
+	}
+
+	err = HandleHttp(&bytes.Buffer{}, []string{"-timeout", "50ms", ts.URL + "/slow"})
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected error %v, Got: %v", ErrTimeout, err)
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	err = HandleHttp(&bytes.Buffer{}, []string{closed.URL})
+	if !errors.Is(err, ErrNetwork) {
+		t.Errorf("Expected error %v, Got: %v", ErrNetwork, err)
+	}
+}
+
+func TestHttpRedirects(t *testing.T) {
+	// /redirect/n redirects n times
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+		if err != nil || n == 0 {
+			w.Write([]byte(`{"done": true}`))
+			return
+		}
+		http.Redirect(w, r, "/redirect/"+strconv.Itoa(n-1), http.StatusFound)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		args []string
+		err  error
+	}{
+		{args: []string{}},
+		{args: []string{"-max-redirects", "3"}},
+		{args: []string{"-max-redirects", "2"}, err: ErrTooManyRedirects},
+		{args: []string{"-no-redirect"}, err: ErrStatus},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		err := HandleHttp(&buf, append(tc.args, "-include", ts.URL+"/redirect/3"))
+		if !errors.Is(err, tc.err) || (tc.err == nil && err != nil) {
+			t.Errorf("%v: Expected error %v, Got: %v", tc.args, tc.err, err)
+		}
+		if tc.err == nil && !strings.HasSuffix(buf.String(), `{"done": true}`) {
+			t.Errorf("%v: Expected the last response, Got: %s", tc.args, buf.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	HandleHttp(&buf, []string{"-no-redirect", "-include", ts.URL + "/redirect/3"})
+	if !strings.Contains(buf.String(), "HTTP/1.1 302 Found\nContent-Length") || !strings.Contains(buf.String(), "Location: /redirect/2\n") {
+		t.Errorf("Expected the redirect, Got: %s", buf.String())
+	}
+}
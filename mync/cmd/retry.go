@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retryBaseDelay is the delay before the first retry, it doubles with each retry up to maxRetryDelay.
+var retryBaseDelay = 200 * time.Millisecond
+
+const maxRetryDelay = 10 * time.Second
+
+// backoff returns the delay before the retry following the attempt, counted from 0, with half of it
+// drawn at random so that clients retrying together spread out.
+func backoff(attempt int) time.Duration {
+	d := maxRetryDelay
+	if attempt < 16 {
+		d = retryBaseDelay << attempt
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter returns the delay asked for by the Retry-After header of a response, in seconds, if any.
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	secs, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0, false
+	}
+	d := time.Duration(secs) * time.Second
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d, true
+}
+
+// retryableStatus reports whether a request answered with the status code is worth retrying.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// idempotentMethod reports whether requests sent with the method can be sent again without
+// changing their effect. POST and PATCH requests may not be.
+func idempotentMethod(verb string) bool {
+	return verb != http.MethodPost && verb != http.MethodPatch
+}
+
+// retryableResponse reports whether a request sent with the method and answered with the response is
+// worth retrying. Requests which aren't idempotent are only retried when the server asks for it, with a
+// 429 or 503 response carrying a Retry-After header.
+func retryableResponse(verb string, res *http.Response) bool {
+	if idempotentMethod(verb) {
+		return retryableStatus(res.StatusCode)
+	}
+	_, ok := retryAfter(res)
+	return ok && (res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable)
+}
+
+// sleep waits for the delay, it returns the context's error when the context is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryableCode reports whether a gRPC call which failed with the code is worth retrying.
+func retryableCode(code codes.Code) bool {
+	switch code {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// requestError is an error of a request classified as a timeout, a network error or an error response,
+// so that the exit code of mync tells them apart.
+type requestError struct {
+	kind error
+	err  error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+func (e *requestError) Is(target error) bool {
+	return target == e.kind
+}
+
+// httpError classifies an error of the HTTP client.
+func httpError(err error) error {
+	if errors.Is(err, ErrTooManyRedirects) {
+		return err
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return &requestError{kind: ErrTimeout, err: err}
+	}
+	return &requestError{kind: ErrNetwork, err: err}
+}
+
+// grpcError classifies the error of a gRPC call, errors without a status are left as they are.
+func grpcError(err error) error {
+	s, ok := status.FromError(err)
+	if err == nil || !ok {
+		return err
+	}
+	switch s.Code() {
+	case codes.DeadlineExceeded:
+		return &requestError{kind: ErrTimeout, err: err}
+	case codes.Unavailable:
+		return &requestError{kind: ErrNetwork, err: err}
+	default:
+		return &requestError{kind: ErrStatus, err: err}
+	}
+}
@@ -0,0 +1,535 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PaesslerAG/jsonpath"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// collection is a file of saved requests, which `mync run` sends in order.
+type collection struct {
+	Name string `yaml:"name"`
+	// Vars are the default values of the variables, `{{name}}` in the requests
+	Vars     map[string]string `yaml:"vars"`
+	Requests []savedRequest    `yaml:"requests"`
+}
+
+// savedRequest is a request of a collection, either HTTP or gRPC.
+type savedRequest struct {
+	Name string     `yaml:"name"`
+	Http *savedHttp `yaml:"http,omitempty"`
+	Grpc *savedGrpc `yaml:"grpc,omitempty"`
+	// Extract sets variables with the values at JSONPaths of the response body, for the next requests
+	Extract map[string]string `yaml:"extract,omitempty"`
+	Assert  assertions        `yaml:"assert,omitempty"`
+}
+
+type savedHttp struct {
+	Verb    string            `yaml:"verb"`
+	Url     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+	Query   map[string]string `yaml:"query,omitempty"`
+	// Body is sent as JSON, strings as they are
+	Body      interface{}   `yaml:"body,omitempty"`
+	BasicAuth string        `yaml:"basic_auth,omitempty"`
+	Bearer    string        `yaml:"bearer,omitempty"`
+	Timeout   time.Duration `yaml:"timeout,omitempty"`
+	Retries   int           `yaml:"retries,omitempty"`
+}
+
+type savedGrpc struct {
+	Server string `yaml:"server"`
+	Method string `yaml:"method"`
+	// Body is sent as JSON, strings as they are
+	Body interface{} `yaml:"body"`
+	// Proto, ImportPath and Protoset are relative to the collection, the .proto files lying under an import
+	// path, or the collection's directory without one
+	Proto      []string      `yaml:"proto"`
+	ImportPath []string      `yaml:"import_path"`
+	Protoset   []string      `yaml:"protoset"`
+	Timeout    time.Duration `yaml:"timeout"`
+	Retries    int           `yaml:"retries"`
+}
+
+// assertions are checked against the response of a request. Without a status, a successful one is expected.
+type assertions struct {
+	// Status is the HTTP status code or the gRPC code, as 404 or NotFound
+	Status string `yaml:"status"`
+	// Body maps JSONPaths of the response body to their expected values
+	Body     map[string]interface{} `yaml:"body"`
+	Contains []string               `yaml:"contains"`
+}
+
+// savedResponse is what the assertions and extractions see of a response.
+type savedResponse struct {
+	status string
+	// statusText is the status as reported
+	statusText string
+	ok         bool
+	body       []byte
+}
+
+func HandleRun(w io.Writer, args []string) error {
+	var envFiles, vars stringsFlag
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(w)
+	fs.Var(&envFiles, "env", "File path of a YAML or JSON environment file holding variables, can be repeated")
+	fs.Var(&vars, "var", "Variable, as name=value, can be repeated")
+	fs.Usage = func() {
+		var usageString = `
+run: Runs the requests of a collection.
+run: <options> collection`
+
+		fmt.Fprintln(w, usageString)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Options: ")
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return ErrNoCollectionSpecified
+	}
+
+	overrides := make(map[string]string)
+	for _, kv := range vars {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || len(k) == 0 {
+			return fmt.Errorf("%w: %s", InvalidVariable, kv)
+		}
+		overrides[k] = v
+	}
+
+	c, err := loadCollection(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	r := runner{dir: filepath.Dir(fs.Arg(0)), vars: make(variables)}
+	for k, v := range c.Vars {
+		r.vars[k] = v
+	}
+	for _, path := range envFiles {
+		env, err := loadEnv(path)
+		if err != nil {
+			return err
+		}
+		for k, v := range env {
+			r.vars[k] = v
+		}
+	}
+	for k, v := range overrides {
+		r.vars[k] = v
+	}
+	return r.run(context.Background(), w, c)
+}
+
+func loadCollection(path string) (*collection, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c collection
+	if err = yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", InvalidCollection, path, err)
+	}
+	for i, req := range c.Requests {
+		if len(req.Name) == 0 {
+			c.Requests[i].Name = fmt.Sprintf("request %d", i+1)
+		}
+		if (req.Http == nil) == (req.Grpc == nil) {
+			return nil, fmt.Errorf("%w: %s: %s needs either http or grpc", InvalidCollection, path, c.Requests[i].Name)
+		}
+	}
+	return &c, nil
+}
+
+// loadEnv reads the variables of an environment file, a YAML or JSON map.
+func loadEnv(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var env map[string]string
+	if err = yaml.Unmarshal(b, &env); err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", InvalidCollection, path, err)
+	}
+	return env, nil
+}
+
+// runner sends the requests of a collection.
+type runner struct {
+	// dir is the directory of the collection
+	dir  string
+	vars variables
+
+	// dialOptions are passed to the gRPC calls, the tests use them to dial in-process servers.
+	dialOptions []grpc.DialOption
+}
+
+// run sends the requests in order and writes a report of the assertions, the run failing if any did.
+// A failing request doesn't stop the run, though the requests using its extractions will fail too.
+func (r *runner) run(ctx context.Context, w io.Writer, c *collection) error {
+	if len(c.Name) > 0 {
+		fmt.Fprintln(w, c.Name)
+	}
+	passed, failed := 0, 0
+	for _, req := range c.Requests {
+		start := time.Now()
+		res, failures := r.send(ctx, req)
+		elapsed := time.Since(start).Round(time.Millisecond)
+
+		result := "PASS"
+		if len(failures) > 0 {
+			result = "FAIL"
+			failed++
+		} else {
+			passed++
+		}
+		if res != nil {
+			fmt.Fprintf(w, "%s %s (%s, %s)\n", result, req.Name, res.statusText, elapsed)
+		} else {
+			fmt.Fprintf(w, "%s %s (%s)\n", result, req.Name, elapsed)
+		}
+		for _, f := range failures {
+			fmt.Fprintf(w, "    %s\n", f)
+		}
+	}
+	fmt.Fprintf(w, "\n%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d", ErrRunFailed, failed, len(c.Requests))
+	}
+	return nil
+}
+
+// send sends a request, checks its assertions and extracts its variables. It returns the
+// failures, the response being nil when the request couldn't be sent.
+func (r *runner) send(ctx context.Context, req savedRequest) (*savedResponse, []string) {
+	var res *savedResponse
+	var err error
+	if req.Http != nil {
+		res, err = r.sendHttp(ctx, req.Http)
+	} else {
+		res, err = r.sendGrpc(ctx, req.Grpc)
+	}
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+
+	failures := req.Assert.check(res)
+	var doc interface{}
+	if len(req.Extract) > 0 {
+		if doc, err = decodeBody(res.body); err != nil {
+			return res, append(failures, fmt.Sprintf("extract: %s", err))
+		}
+	}
+	for _, name := range sortedKeys(req.Extract) {
+		v, err := jsonpath.Get(req.Extract[name], doc)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("extract %s: %s", name, err))
+			continue
+		}
+		if s, ok := v.(string); ok {
+			r.vars[name] = s
+		} else {
+			b, _ := json.Marshal(v)
+			r.vars[name] = string(b)
+		}
+	}
+	return res, failures
+}
+
+func (r *runner) sendHttp(ctx context.Context, saved *savedHttp) (*savedResponse, error) {
+	hc := httpConfig{
+		timeout: saved.Timeout,
+		retries: saved.Retries,
+		// the default of the http command
+		maxRedirects: 10,
+	}
+	var err error
+	if hc.url, err = r.vars.expand(saved.Url); err != nil {
+		return nil, err
+	}
+	if hc.basicAuth, err = r.vars.expand(saved.BasicAuth); err != nil {
+		return nil, err
+	}
+	if hc.bearerToken, err = r.vars.expand(saved.Bearer); err != nil {
+		return nil, err
+	}
+	if hc.body, err = r.vars.expandBody(saved.Body); err != nil {
+		return nil, err
+	}
+	for _, k := range sortedKeys(saved.Headers) {
+		v, err := r.vars.expand(saved.Headers[k])
+		if err != nil {
+			return nil, err
+		}
+		hc.headers = append(hc.headers, k+": "+v)
+	}
+	for _, k := range sortedKeys(saved.Query) {
+		v, err := r.vars.expand(saved.Query[k])
+		if err != nil {
+			return nil, err
+		}
+		hc.query = append(hc.query, k+"="+v)
+	}
+	verb := strings.ToUpper(saved.Verb)
+	if len(verb) == 0 {
+		verb = http.MethodGet
+	}
+	if !httpMethods[verb] {
+		return nil, fmt.Errorf("%w: %s", InvalidHttpMethod, saved.Verb)
+	}
+
+	res, err := hc.do(ctx, verb)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, httpError(err)
+	}
+	return &savedResponse{
+		status:     strconv.Itoa(res.StatusCode),
+		statusText: res.Status,
+		ok:         res.StatusCode >= 200 && res.StatusCode <= 299,
+		body:       body,
+	}, nil
+}
+
+func (r *runner) sendGrpc(ctx context.Context, saved *savedGrpc) (*savedResponse, error) {
+	gc := grpcConfig{
+		timeout:     saved.Timeout,
+		retries:     saved.Retries,
+		dialOptions: r.dialOptions,
+	}
+	var err error
+	if gc.server, err = r.vars.expand(saved.Server); err != nil {
+		return nil, err
+	}
+	if gc.method, err = r.vars.expand(saved.Method); err != nil {
+		return nil, err
+	}
+	if gc.body, err = r.vars.expandBody(saved.Body); err != nil {
+		return nil, err
+	}
+	for _, p := range saved.ImportPath {
+		gc.importPaths = append(gc.importPaths, r.path(p))
+	}
+	for _, p := range saved.Protoset {
+		gc.protosets = append(gc.protosets, r.path(p))
+	}
+	if len(gc.importPaths) == 0 {
+		gc.importPaths = stringsFlag{r.dir}
+	}
+	if len(saved.Proto) > 0 {
+		// the parser wants the .proto files named relative to the import path holding them
+		protoFiles := make([]string, 0, len(saved.Proto))
+		for _, p := range saved.Proto {
+			protoFiles = append(protoFiles, r.path(p))
+		}
+		if gc.protoFiles, err = protoparse.ResolveFilenames(gc.importPaths, protoFiles...); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	err = gc.call(ctx, &buf)
+	s, ok := status.FromError(err)
+	if err != nil && !ok {
+		return nil, err
+	}
+	return &savedResponse{
+		status:     s.Code().String(),
+		statusText: s.Code().String(),
+		ok:         err == nil,
+		body:       buf.Bytes(),
+	}, nil
+}
+
+// path resolves a path of the collection.
+func (r *runner) path(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(r.dir, p)
+}
+
+// variableRef matches the references to variables, as {{name}}.
+var variableRef = regexp.MustCompile(`\{\{\s*([\w.-]+)\s*\}\}`)
+
+// variables are the values of the references in the templates, as {{name}}.
+type variables map[string]string
+
+// expand replaces the references to variables in `s` by their values.
+func (vars variables) expand(s string) (string, error) {
+	var err error
+	s = variableRef.ReplaceAllStringFunc(s, func(ref string) string {
+		name := variableRef.FindStringSubmatch(ref)[1]
+		v, ok := vars[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("%w: %s", ErrUndefinedVariable, name)
+		}
+		return v
+	})
+	return s, err
+}
+
+// expandBody returns a body as JSON, the variables being replaced in its strings.
+func (vars variables) expandBody(body interface{}) (string, error) {
+	if body == nil {
+		return "", nil
+	}
+	if s, ok := body.(string); ok {
+		return vars.expand(s)
+	}
+	v, err := vars.expandValue(body)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func (vars variables) expandValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return vars.expand(v)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			e, err := vars.expandValue(e)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = e
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			e, err := vars.expandValue(e)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = e
+		}
+		return l, nil
+	default:
+		return v, nil
+	}
+}
+
+// check returns the failed assertions.
+func (a assertions) check(res *savedResponse) []string {
+	var failures []string
+	if len(a.Status) == 0 {
+		if !res.ok {
+			failures = append(failures, fmt.Sprintf("status: expected success, got %s", res.statusText))
+		}
+	} else if normalizeStatus(a.Status) != normalizeStatus(res.status) {
+		failures = append(failures, fmt.Sprintf("status: expected %s, got %s", a.Status, res.status))
+	}
+
+	for _, s := range a.Contains {
+		if !bytes.Contains(res.body, []byte(s)) {
+			failures = append(failures, fmt.Sprintf("body: expected to contain %q", s))
+		}
+	}
+
+	if len(a.Body) == 0 {
+		return failures
+	}
+	doc, err := decodeBody(res.body)
+	if err != nil {
+		return append(failures, fmt.Sprintf("body: %s", err))
+	}
+	for _, path := range sortedKeys(a.Body) {
+		got, err := jsonpath.Get(path, doc)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("body %s: %s", path, err))
+			continue
+		}
+		expected, err := normalizeJSON(a.Body[path])
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("body %s: %s", path, err))
+			continue
+		}
+		if !reflect.DeepEqual(expected, got) {
+			e, _ := json.Marshal(expected)
+			g, _ := json.Marshal(got)
+			failures = append(failures, fmt.Sprintf("body %s: expected %s, got %s", path, e, g))
+		}
+	}
+	return failures
+}
+
+// normalizeStatus lets gRPC codes be written as NotFound or NOT_FOUND.
+func normalizeStatus(s string) string {
+	return strings.ToLower(strings.ReplaceAll(s, "_", ""))
+}
+
+// normalizeJSON turns a value decoded from YAML into its JSON decoded form, to compare it with the body.
+func normalizeJSON(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var n interface{}
+	err = json.Unmarshal(b, &n)
+	return n, err
+}
+
+// decodeBody decodes a JSON body. Bodies holding several JSON values, as the
+// responses of streaming methods, are decoded as an array of them.
+func decodeBody(body []byte) (interface{}, error) {
+	var values []interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	for {
+		var v interface{}
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", InvalidJsonBody, err)
+		}
+		values = append(values, v)
+	}
+	switch len(values) {
+	case 0:
+		return nil, fmt.Errorf("%w: empty body", InvalidJsonBody)
+	case 1:
+		return values[0], nil
+	}
+	return values, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
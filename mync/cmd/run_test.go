@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// startUsersServer starts a server storing users, POST /users returns the created user and
+// GET /users/{id} a stored one. Writes need the token secret.
+func startUsersServer(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	users := make(map[string]map[string]interface{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/users":
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var u map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			u["id"] = "u" + string(rune('0'+len(users)+1))
+			users[u["id"].(string)] = u
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(u)
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/users/"):
+			u, ok := users[strings.TrimPrefix(r.URL.Path, "/users/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(u)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testCollection = `
+name: users
+vars:
+  base: http://unused
+  token: wrong
+requests:
+  - name: create user
+    http:
+      verb: POST
+      url: "{{base}}/users"
+      bearer: "{{token}}"
+      body:
+        name: jane
+        email: "{{email}}"
+        tags: [a, b]
+    extract:
+      id: $.id
+      tags: $.tags
+    assert:
+      status: 201
+      body:
+        $.name: jane
+        $.tags[1]: b
+  - name: get user
+    http:
+      url: "{{base}}/users/{{id}}"
+    assert:
+      body:
+        $.email: jane@example.com
+      contains: ['"tags":["a","b"]']
+  - name: get missing user
+    http:
+      url: "{{base}}/users/unknown"
+    assert:
+      status: 404
+`
+
+func TestRun(t *testing.T) {
+	ts := startUsersServer(t)
+	dir := t.TempDir()
+	path := writeFile(t, dir, "collection.yaml", testCollection)
+	env := writeFile(t, dir, "env.json", `{"base": "`+ts.URL+`", "token": "secret"}`)
+
+	var buf bytes.Buffer
+	err := HandleRun(&buf, []string{"-env", env, "-var", "email=jane@example.com", path})
+	if err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	for _, s := range []string{
+		"users\n",
+		"PASS create user (201 Created, ",
+		"PASS get user (200 OK, ",
+		"PASS get missing user (404 Not Found, ",
+		"\n3 passed, 0 failed\n",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("Expected %q in: %s", s, buf.String())
+		}
+	}
+
+	// the collection's token is wrong, and the user isn't created
+	buf.Reset()
+	err = HandleRun(&buf, []string{"-var", "base=" + ts.URL, "-var", "email=jane@example.com", path})
+	if !errors.Is(err, ErrRunFailed) {
+		t.Errorf("Expected error %v, Got: %v", ErrRunFailed, err)
+	}
+	for _, s := range []string{
+		"FAIL create user (401 Unauthorized, ",
+		"    status: expected 201, got 401\n",
+		"    body: invalid json body: empty body\n",
+		"FAIL get user (",
+		"    undefined variable: id\n",
+		"PASS get missing user (404 Not Found, ",
+		"\n1 passed, 2 failed\n",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("Expected %q in: %s", s, buf.String())
+		}
+	}
+}
+
+func TestRunGrpcImportPath(t *testing.T) {
+	opts := startTestGrpcServerWithReflection(t, false)
+	dir := t.TempDir()
+	proto, err := os.ReadFile(filepath.Join(protoDir, "users.proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(dir, "protos"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "protos"), "users.proto", string(proto))
+	path := writeFile(t, dir, "collection.yaml", `
+requests:
+  - grpc:
+      server: bufnet
+      method: Users/GetUser
+      proto: [protos/users.proto]
+      import_path: [protos]
+      body: {email: jane@example.com}
+    assert:
+      body:
+        $.user.age: 36
+`)
+	c, err := loadCollection(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := runner{dir: dir, vars: make(map[string]string), dialOptions: opts}
+	var buf bytes.Buffer
+	if err = r.run(context.Background(), &buf, c); err != nil {
+		t.Fatalf("Expected no error, Got: %v\n%s", err, buf.String())
+	}
+	if !strings.Contains(buf.String(), "PASS request 1 (OK, ") {
+		t.Errorf("Expected request 1 to pass, Got: %s", buf.String())
+	}
+}
+
+func TestRunGrpc(t *testing.T) {
+	opts := startTestGrpcServerWithReflection(t, false)
+	dir := t.TempDir()
+	proto, err := os.ReadFile(filepath.Join(protoDir, "users.proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "users.proto", string(proto))
+	path := writeFile(t, dir, "collection.yaml", `
+requests:
+  - grpc:
+      server: bufnet
+      method: Users/GetUser
+      proto: [users.proto]
+      body: {email: jane@example.com}
+    extract:
+      name: $.user.firstName
+    assert:
+      body:
+        $.user.age: 36
+  - grpc:
+      server: bufnet
+      method: Users/GetUser
+      proto: [users.proto]
+      body: '{"email": "{{name}}"}'
+    assert:
+      status: UNKNOWN
+  - grpc:
+      server: bufnet
+      method: Users/GetUser
+      proto: [users.proto]
+      body: {email: "{{name}}"}
+`)
+	c, err := loadCollection(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := runner{dir: dir, vars: make(map[string]string), dialOptions: opts}
+	var buf bytes.Buffer
+	err = r.run(context.Background(), &buf, c)
+	if !errors.Is(err, ErrRunFailed) {
+		t.Errorf("Expected error %v, Got: %v", ErrRunFailed, err)
+	}
+	for _, s := range []string{
+		"PASS request 1 (OK, ",
+		"PASS request 2 (Unknown, ",
+		"FAIL request 3 (Unknown, ",
+		"    status: expected success, got Unknown\n",
+		"\n2 passed, 1 failed\n",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("Expected %q in: %s", s, buf.String())
+		}
+	}
+}
+
+func TestRunInvalidCollection(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		err     error
+	}{
+		{content: "requests: [", err: InvalidCollection},
+		{content: "requests:\n  - name: nothing\n", err: InvalidCollection},
+		{content: "requests:\n  - http: {url: x}\n    grpc: {server: y}\n", err: InvalidCollection},
+	}
+	for _, tc := range tests {
+		path := writeFile(t, dir, "collection.yaml", tc.content)
+		err := HandleRun(&bytes.Buffer{}, []string{path})
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%q: Expected error %v, Got: %v", tc.content, tc.err, err)
+		}
+	}
+
+	err := HandleRun(&bytes.Buffer{}, []string{"-var", "base", "collection.yaml"})
+	if !errors.Is(err, InvalidVariable) {
+		t.Errorf("Expected error %v, Got: %v", InvalidVariable, err)
+	}
+}
@@ -0,0 +1,736 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"gopkg.in/yaml.v3"
+)
+
+// mockAdminPath lists the requests received by the mock server, the routes can't use it.
+const mockAdminPath = "/__mync/requests"
+
+// mockSpec is the spec of the mock server, a YAML or JSON file. The routes and the gRPC mocks are
+// matched in order, the first one matching answering.
+type mockSpec struct {
+	Routes []mockRoute  `yaml:"routes"`
+	Grpc   []mockMethod `yaml:"grpc"`
+}
+
+// mockRoute answers the HTTP requests matching its method, path, query parameters, headers and body.
+type mockRoute struct {
+	Name string `yaml:"name"`
+	// Method matches any method when empty
+	Method string `yaml:"method"`
+	// Path is matched segment by segment, {name} matching any segment and a final * the rest of the path
+	Path    string            `yaml:"path"`
+	Query   map[string]string `yaml:"query"`
+	Headers map[string]string `yaml:"headers"`
+	// Body is matched as a subset of the JSON body, a string being contained in the body
+	Body     interface{}  `yaml:"body"`
+	Response mockResponse `yaml:"response"`
+}
+
+type mockResponse struct {
+	// Status is 200 by default
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	// Body is sent as JSON, strings as they are. The references to the request are replaced in the
+	// headers and the body, as {{path.id}}, {{query.page}}, {{header.X-Token}} or {{body.user.name}}
+	Body  interface{}   `yaml:"body"`
+	Delay time.Duration `yaml:"delay"`
+	// Jitter is added to the delay, drawn at random up to its value
+	Jitter time.Duration `yaml:"jitter"`
+	Fault  *mockFault    `yaml:"fault"`
+}
+
+// mockMethod answers the calls of a gRPC method whose metadata and request match.
+type mockMethod struct {
+	Name string `yaml:"name"`
+	// Method is written as Service/Method
+	Method   string            `yaml:"method"`
+	Metadata map[string]string `yaml:"metadata"`
+	// Body is matched as a subset of the request, written as JSON with the field names of the .proto file, as
+	// creator_id rather than creatorId. The 64-bit integers, which are strings in JSON, match numbers too
+	Body     interface{}      `yaml:"body"`
+	Response mockGrpcResponse `yaml:"response"`
+}
+
+type mockGrpcResponse struct {
+	// Body is the response message and Messages those of a server stream. The references to the call are
+	// replaced in their strings, as {{metadata.authorization}} or {{body.creator_id}}. Their fields are
+	// written with either the names of the .proto file or their lowerCamelCase form
+	Body     interface{}   `yaml:"body"`
+	Messages []interface{} `yaml:"messages"`
+	// Code and Message are the status of the call, OK by default
+	Code    string        `yaml:"code"`
+	Message string        `yaml:"message"`
+	Delay   time.Duration `yaml:"delay"`
+	Jitter  time.Duration `yaml:"jitter"`
+	Fault   *mockFault    `yaml:"fault"`
+
+	code codes.Code
+}
+
+// mockFault makes a share of the requests fail.
+type mockFault struct {
+	// Rate is the share of the requests failing, from 0 to 1
+	Rate float64 `yaml:"rate"`
+	// Status is the status of the failed HTTP requests, whose connection is closed without a response when it's 0
+	Status int `yaml:"status"`
+	// Code is the code of the failed gRPC calls, Unavailable by default
+	Code string `yaml:"code"`
+
+	code codes.Code
+}
+
+// loggedRequest is a request received by the mock server, as listed by mockAdminPath.
+type loggedRequest struct {
+	Time     time.Time `json:"time"`
+	Protocol string    `json:"protocol"`
+	// Method is the HTTP method, or the gRPC method as Service/Method
+	Method  string              `json:"method"`
+	Path    string              `json:"path,omitempty"`
+	Query   map[string][]string `json:"query,omitempty"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	// Body is decoded when it's JSON
+	Body interface{} `json:"body,omitempty"`
+	// Route is the name of the route or gRPC mock which answered, empty when none matched
+	Route string `json:"route,omitempty"`
+	// Status is the HTTP status code or the gRPC code
+	Status string `json:"status"`
+}
+
+// mockServer answers the HTTP requests and the gRPC calls as the spec says, and records them.
+type mockServer struct {
+	spec *mockSpec
+	// descriptors describe the services of the gRPC mocks, nil without -proto nor -protoset
+	descriptors *fileSource
+	// w is where the requests are printed, and log where they're written as JSON lines if not nil
+	w   io.Writer
+	log io.Writer
+
+	mu       sync.Mutex
+	requests []loggedRequest
+}
+
+func HandleServe(w io.Writer, args []string) error {
+	var specPath, addr, grpcAddr, logPath string
+	var gc grpcConfig
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(w)
+	fs.StringVar(&specPath, "spec", "", "File path of the YAML or JSON spec of the mocks")
+	fs.StringVar(&addr, "addr", "localhost:8080", "Address the HTTP mocks are served on, the requests they list included")
+	fs.StringVar(&grpcAddr, "grpc-addr", "localhost:50051", "Address the gRPC mocks are served on, with -proto or -protoset")
+	fs.StringVar(&logPath, "log", "", "File path where the requests are appended as JSON lines")
+	gc.descriptorFlags(fs)
+	fs.Usage = func() {
+		var usageString = `
+serve: A mock server answering HTTP requests, and gRPC calls with -proto or -protoset, as the spec says.
+serve: <options> -spec mocks.yaml
+
+The requests received are listed as JSON by GET ` + mockAdminPath + `, which
+takes the protocol, method, path and route as filters, and cleared by DELETE.`
+
+		fmt.Fprintln(w, usageString)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Options: ")
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if len(specPath) == 0 || fs.NArg() > 0 {
+		return ErrNoSpecSpecified
+	}
+
+	spec, err := loadMockSpec(specPath)
+	if err != nil {
+		return err
+	}
+	m := &mockServer{spec: spec, w: w}
+	if gc.hasLocalDescriptors() {
+		src, err := gc.descriptorSource(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		files := src.(fileSource)
+		m.descriptors = &files
+	}
+	if err = m.validate(); err != nil {
+		return err
+	}
+	if len(logPath) > 0 {
+		f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		m.log = f
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	hs := &http.Server{Handler: m}
+	defer hs.Close()
+	errs := make(chan error, 2)
+	go func() {
+		errs <- hs.Serve(l)
+	}()
+	fmt.Fprintf(w, "Serving the HTTP mocks on %s\n", l.Addr())
+
+	if m.descriptors != nil {
+		gl, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			return err
+		}
+		gs := m.grpcServer()
+		defer gs.Stop()
+		go func() {
+			errs <- gs.Serve(gl)
+		}()
+		fmt.Fprintf(w, "Serving the gRPC mocks on %s\n", gl.Addr())
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err = <-errs:
+		return err
+	}
+}
+
+func loadMockSpec(path string) (*mockSpec, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var spec mockSpec
+	if err = yaml.Unmarshal(b, &spec); err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", InvalidMockSpec, path, err)
+	}
+	return &spec, nil
+}
+
+// validate checks the spec, the methods of the gRPC mocks having to be described.
+func (m *mockServer) validate() error {
+	for _, r := range m.spec.Routes {
+		if r.Response.Status != 0 && (r.Response.Status < 100 || r.Response.Status > 999) {
+			return fmt.Errorf("%w: %s: invalid status %d", InvalidMockSpec, r.name(), r.Response.Status)
+		}
+		if err := r.Response.Fault.validate(r.name()); err != nil {
+			return err
+		}
+	}
+	if len(m.spec.Grpc) > 0 && m.descriptors == nil {
+		return fmt.Errorf("%w: the gRPC mocks need -proto or -protoset", InvalidMockSpec)
+	}
+	for i := range m.spec.Grpc {
+		mm := &m.spec.Grpc[i]
+		d, err := m.descriptors.FindSymbol(symbolName(mm.Method))
+		md, ok := d.(*desc.MethodDescriptor)
+		if err != nil || !ok {
+			return fmt.Errorf("%w: %s: unknown method %s", InvalidMockSpec, mm.name(), mm.Method)
+		}
+		if len(mm.Response.Messages) > 0 && !md.IsServerStreaming() {
+			return fmt.Errorf("%w: %s: only the server streams answer messages", InvalidMockSpec, mm.name())
+		}
+		if mm.Response.code, err = parseCode(mm.Response.Code, codes.OK); err != nil {
+			return fmt.Errorf("%w: %s", err, mm.name())
+		}
+		if err = mm.Response.Fault.validate(mm.name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *mockFault) validate(name string) error {
+	if f == nil {
+		return nil
+	}
+	if f.Rate < 0 || f.Rate > 1 {
+		return fmt.Errorf("%w: %s: the fault rate is between 0 and 1", InvalidMockSpec, name)
+	}
+	if f.Status != 0 && (f.Status < 100 || f.Status > 999) {
+		return fmt.Errorf("%w: %s: invalid fault status %d", InvalidMockSpec, name, f.Status)
+	}
+	var err error
+	if f.code, err = parseCode(f.Code, codes.Unavailable); err != nil {
+		return fmt.Errorf("%w: %s", err, name)
+	}
+	return nil
+}
+
+// injected reports whether the request fails, drawn at random.
+func (f *mockFault) injected() bool {
+	return f != nil && rand.Float64() < f.Rate
+}
+
+// parseCode parses a gRPC code written as NotFound or NOT_FOUND, the default one when empty.
+func parseCode(s string, def codes.Code) (codes.Code, error) {
+	if len(s) == 0 {
+		return def, nil
+	}
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if normalizeStatus(c.String()) == normalizeStatus(s) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: unknown gRPC code %s", InvalidMockSpec, s)
+}
+
+func (r *mockRoute) name() string {
+	if len(r.Name) > 0 {
+		return r.Name
+	}
+	return strings.TrimSpace(r.Method + " " + r.Path)
+}
+
+func (mm *mockMethod) name() string {
+	if len(mm.Name) > 0 {
+		return mm.Name
+	}
+	return mm.Method
+}
+
+func (m *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == mockAdminPath {
+		m.serveRequests(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logged := loggedRequest{
+		Time:     time.Now(),
+		Protocol: "http",
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Query:    r.URL.Query(),
+		Headers:  r.Header,
+		Body:     loggedBody(body),
+	}
+	route, params := m.matchRoute(r, body)
+	if route == nil {
+		m.record(logged, strconv.Itoa(http.StatusNotFound))
+		http.Error(w, fmt.Sprintf("no mock matches %s %s", r.Method, r.URL.Path), http.StatusNotFound)
+		return
+	}
+	logged.Route = route.name()
+	res := &route.Response
+	wait(r.Context(), res.Delay, res.Jitter)
+	if res.Fault.injected() {
+		if res.Fault.Status == 0 {
+			m.record(logged, "aborted")
+			// closes the connection without a response
+			panic(http.ErrAbortHandler)
+		}
+		m.record(logged, strconv.Itoa(res.Fault.Status))
+		http.Error(w, "injected fault", res.Fault.Status)
+		return
+	}
+
+	vars := variables{"method": r.Method, "path": r.URL.Path}
+	for k, v := range params {
+		vars["path."+k] = v
+	}
+	for k, v := range r.URL.Query() {
+		vars["query."+k] = v[0]
+	}
+	for k, v := range r.Header {
+		vars["header."+k] = v[0]
+	}
+	bodyVars(vars, body)
+
+	out, err := vars.expandBody(res.Body)
+	headers := make(http.Header)
+	for _, k := range sortedKeys(res.Headers) {
+		if err != nil {
+			break
+		}
+		var v string
+		v, err = vars.expand(res.Headers[k])
+		headers.Set(k, v)
+	}
+	if err != nil {
+		m.record(logged, strconv.Itoa(http.StatusInternalServerError))
+		http.Error(w, fmt.Sprintf("mock %s: %v", route.name(), err), http.StatusInternalServerError)
+		return
+	}
+	if len(headers.Get("Content-Type")) == 0 && res.Body != nil {
+		if _, ok := res.Body.(string); ok {
+			headers.Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			headers.Set("Content-Type", "application/json")
+		}
+	}
+	status := res.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	// the request is recorded before it's answered, so that the clients find it once answered
+	m.record(logged, strconv.Itoa(status))
+	for k, v := range headers {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(status)
+	io.WriteString(w, out)
+}
+
+// matchRoute returns the first route matching the request, with the values of the segments of its path.
+func (m *mockServer) matchRoute(r *http.Request, body []byte) (*mockRoute, map[string]string) {
+	for i := range m.spec.Routes {
+		route := &m.spec.Routes[i]
+		if len(route.Method) > 0 && !strings.EqualFold(route.Method, r.Method) {
+			continue
+		}
+		params, ok := matchPath(route.Path, r.URL.Path)
+		if ok && matchValues(route.Query, r.URL.Query().Get) && matchValues(route.Headers, r.Header.Get) && matchBody(route.Body, body) {
+			return route, params
+		}
+	}
+	return nil, nil
+}
+
+// matchPath matches the path against the pattern of a route, returning the values of its {name} segments.
+func matchPath(pattern, path string) (map[string]string, bool) {
+	if len(pattern) == 0 {
+		return nil, true
+	}
+	params := make(map[string]string)
+	patterns, segments := strings.Split(pattern, "/"), strings.Split(path, "/")
+	for i, p := range patterns {
+		if p == "*" && i == len(patterns)-1 {
+			return params, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		if len(p) > 2 && p[0] == '{' && p[len(p)-1] == '}' && len(segments[i]) > 0 {
+			params[p[1:len(p)-1]] = segments[i]
+		} else if p != segments[i] {
+			return nil, false
+		}
+	}
+	return params, len(patterns) == len(segments)
+}
+
+// matchValues reports whether the values got with `get`, as the headers, are those expected.
+func matchValues(expected map[string]string, get func(string) string) bool {
+	for k, v := range expected {
+		if get(k) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// matchBody reports whether the body matches: a string has to be contained in it, other values
+// to be a subset of the JSON body.
+func matchBody(expected interface{}, body []byte) bool {
+	if expected == nil {
+		return true
+	}
+	if s, ok := expected.(string); ok {
+		return bytes.Contains(body, []byte(s))
+	}
+	e, err := normalizeJSON(expected)
+	if err != nil {
+		return false
+	}
+	var got interface{}
+	if err = json.Unmarshal(body, &got); err != nil {
+		return false
+	}
+	return matchJSON(e, got)
+}
+
+// matchJSON reports whether `got` holds the fields of the objects of `expected`, the other values being equal.
+// A number also matches a string holding it, as the 64-bit integers of gRPC requests.
+func matchJSON(expected, got interface{}) bool {
+	e, ok := expected.(map[string]interface{})
+	if !ok {
+		n, isNumber := expected.(float64)
+		if s, isString := got.(string); isNumber && isString {
+			f, err := strconv.ParseFloat(s, 64)
+			return err == nil && f == n
+		}
+		return reflect.DeepEqual(expected, got)
+	}
+	g, ok := got.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for k, v := range e {
+		if gv, ok := g[k]; !ok || !matchJSON(v, gv) {
+			return false
+		}
+	}
+	return true
+}
+
+// bodyVars sets the variables of the body: `body` as it is and its JSON fields by their path, as body.user.name.
+func bodyVars(vars variables, body []byte) {
+	vars["body"] = string(body)
+	var v interface{}
+	if json.Unmarshal(body, &v) == nil {
+		flattenJSON(vars, "body", v)
+	}
+}
+
+func flattenJSON(vars variables, name string, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			flattenJSON(vars, name+"."+k, e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			flattenJSON(vars, name+"."+strconv.Itoa(i), e)
+		}
+	case string:
+		vars[name] = v
+	default:
+		b, _ := json.Marshal(v)
+		vars[name] = string(b)
+	}
+}
+
+// loggedBody decodes the body when it's JSON.
+func loggedBody(body []byte) interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+	var v interface{}
+	if json.Unmarshal(body, &v) == nil {
+		return v
+	}
+	return string(body)
+}
+
+// wait sleeps for the delay and a random part of the jitter, unless the request is canceled meanwhile.
+func wait(ctx context.Context, delay, jitter time.Duration) {
+	if jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(jitter) + 1))
+	}
+	if delay <= 0 {
+		return
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// record logs the request answered with the status.
+func (m *mockServer) record(req loggedRequest, status string) {
+	req.Status = status
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = append(m.requests, req)
+
+	target := req.Method
+	if req.Protocol == "http" {
+		target += " " + req.Path
+	}
+	if len(req.Route) > 0 {
+		fmt.Fprintf(m.w, "%s %s (%s)\n", target, status, req.Route)
+	} else {
+		fmt.Fprintf(m.w, "%s %s\n", target, status)
+	}
+	if m.log != nil {
+		if b, err := json.Marshal(req); err == nil {
+			m.log.Write(append(b, '\n'))
+		}
+	}
+}
+
+// serveRequests lists the requests received, filtered by the query parameters, or clears them.
+func (m *mockServer) serveRequests(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		filters := map[string]func(req loggedRequest) string{
+			"protocol": func(req loggedRequest) string { return req.Protocol },
+			"method":   func(req loggedRequest) string { return req.Method },
+			"path":     func(req loggedRequest) string { return req.Path },
+			"route":    func(req loggedRequest) string { return req.Route },
+		}
+		m.mu.Lock()
+		matched := make([]loggedRequest, 0, len(m.requests))
+		for _, req := range m.requests {
+			ok := true
+			for k, get := range filters {
+				if v := q.Get(k); len(v) > 0 && !strings.EqualFold(v, get(req)) {
+					ok = false
+				}
+			}
+			if ok {
+				matched = append(matched, req)
+			}
+		}
+		m.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(matched)
+	case http.MethodDelete:
+		m.mu.Lock()
+		m.requests = nil
+		m.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// grpcServer returns the gRPC server of the mocks, which serves the descriptors through reflection too.
+func (m *mockServer) grpcServer() *grpc.Server {
+	s := grpc.NewServer(grpc.UnknownServiceHandler(m.handleGrpc))
+	files := new(protoregistry.Files)
+	for _, fd := range m.descriptors.files {
+		files.RegisterFile(fd.UnwrapFile())
+	}
+	rpb.RegisterServerReflectionServer(s, reflection.NewServer(reflection.ServerOptions{Services: m, DescriptorResolver: files}))
+	return s
+}
+
+// GetServiceInfo lists the described services to the reflection service.
+func (m *mockServer) GetServiceInfo() map[string]grpc.ServiceInfo {
+	services, _ := m.descriptors.ListServices()
+	info := make(map[string]grpc.ServiceInfo, len(services))
+	for _, s := range services {
+		info[s] = grpc.ServiceInfo{}
+	}
+	return info
+}
+
+// handleGrpc answers the calls of unary and server streaming methods with the first mock matching.
+func (m *mockServer) handleGrpc(_ interface{}, stream grpc.ServerStream) error {
+	fullMethod, _ := grpc.MethodFromServerStream(stream)
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	logged := loggedRequest{
+		Time:     time.Now(),
+		Protocol: "grpc",
+		Method:   strings.TrimPrefix(fullMethod, "/"),
+		Headers:  md,
+	}
+	d, err := m.descriptors.FindSymbol(symbolName(fullMethod))
+	method, ok := d.(*desc.MethodDescriptor)
+	if err != nil || !ok || method.IsClientStreaming() {
+		m.record(logged, codes.Unimplemented.String())
+		return status.Errorf(codes.Unimplemented, "no mock for %s, the client streams aren't mocked", logged.Method)
+	}
+	req := dynamicpb.NewMessage(method.GetInputType().UnwrapMessage())
+	if err = stream.RecvMsg(req); err != nil {
+		return err
+	}
+	// the mocks refer to the fields by the names of the .proto file
+	body, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(req)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	logged.Body = loggedBody(body)
+
+	mock := m.matchMethod(fullMethod, md, body)
+	if mock == nil {
+		m.record(logged, codes.Unimplemented.String())
+		return status.Errorf(codes.Unimplemented, "no mock matches the call of %s", logged.Method)
+	}
+	logged.Route = mock.name()
+	res := &mock.Response
+	wait(stream.Context(), res.Delay, res.Jitter)
+	if res.Fault.injected() {
+		m.record(logged, res.Fault.code.String())
+		return status.Error(res.Fault.code, "injected fault")
+	}
+
+	vars := variables{"method": logged.Method}
+	for k, v := range md {
+		if len(v) > 0 {
+			vars["metadata."+k] = v[0]
+		}
+	}
+	bodyVars(vars, body)
+	bodies := res.Messages
+	if len(bodies) == 0 && (res.Body != nil || res.code == codes.OK) {
+		bodies = []interface{}{res.Body}
+	}
+	messages := make([]*dynamicpb.Message, 0, len(bodies))
+	for _, b := range bodies {
+		s, err := vars.expandBody(b)
+		if len(s) == 0 {
+			s = "{}"
+		}
+		msg := dynamicpb.NewMessage(method.GetOutputType().UnwrapMessage())
+		if err == nil {
+			err = protojson.Unmarshal([]byte(s), msg)
+		}
+		if err != nil {
+			m.record(logged, codes.Internal.String())
+			return status.Errorf(codes.Internal, "mock %s: %v", mock.name(), err)
+		}
+		messages = append(messages, msg)
+	}
+
+	m.record(logged, res.code.String())
+	for _, msg := range messages {
+		if err = stream.SendMsg(msg); err != nil {
+			return err
+		}
+	}
+	if res.code != codes.OK {
+		return status.Error(res.code, res.Message)
+	}
+	return nil
+}
+
+// matchMethod returns the first mock of the method matching the metadata and the request.
+func (m *mockServer) matchMethod(fullMethod string, md metadata.MD, body []byte) *mockMethod {
+	get := func(k string) string {
+		if v := md.Get(k); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	for i := range m.spec.Grpc {
+		mm := &m.spec.Grpc[i]
+		if symbolName(mm.Method) == symbolName(fullMethod) && matchValues(mm.Metadata, get) && matchBody(mm.Body, body) {
+			return mm
+		}
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const testMocks = `
+routes:
+  - name: get user
+    method: GET
+    path: /users/{id}
+    headers:
+      Authorization: Bearer abc
+    response:
+      headers:
+        X-User: "{{path.id}}"
+      body:
+        id: "{{path.id}}"
+        page: "{{query.page}}"
+  - name: create admin
+    method: POST
+    path: /users
+    body:
+      role: admin
+    response:
+      status: 201
+      body: "admin {{body.name}} created"
+  - name: create user
+    method: POST
+    path: /users
+    response:
+      status: 201
+      body: {"name": "{{body.name}}", "tags": ["{{body.tags.0}}"]}
+  - name: slow
+    path: /slow
+    response:
+      delay: 50ms
+  - name: broken
+    path: /broken
+    response:
+      body: "{{undefined}}"
+  - name: unavailable
+    path: /unavailable
+    response:
+      fault: {rate: 1, status: 503}
+  - name: aborted
+    path: /aborted/*
+    response:
+      fault: {rate: 1}
+`
+
+// startMockServer serves the mocks of the spec, returning the server and its URL.
+func startMockServer(t *testing.T, spec string, gc grpcConfig) (*mockServer, string) {
+	path := writeFile(t, t.TempDir(), "mocks.yaml", spec)
+	s, err := loadMockSpec(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockServer{spec: s, w: &bytes.Buffer{}}
+	if gc.hasLocalDescriptors() {
+		src, err := gc.descriptorSource(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := src.(fileSource)
+		m.descriptors = &files
+	}
+	if err = m.validate(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(m)
+	t.Cleanup(ts.Close)
+	return m, ts.URL
+}
+
+// loggedRequests returns the requests listed by the admin endpoint with the query.
+func loggedRequests(t *testing.T, url, query string) []loggedRequest {
+	res, err := http.Get(url + mockAdminPath + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var requests []loggedRequest
+	if err = json.NewDecoder(res.Body).Decode(&requests); err != nil {
+		t.Fatal(err)
+	}
+	return requests
+}
+
+func TestServeHttp(t *testing.T) {
+	_, url := startMockServer(t, testMocks, grpcConfig{})
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"-include", "-bearer", "abc", "-query", "page=2", url + "/users/42"}, "X-User: 42"},
+		{[]string{"-bearer", "abc", "-query", "page=1", url + "/users/42"}, `{"id":"42","page":"1"}`},
+		{[]string{"-verb", "POST", "-body", `{"name": "jane", "role": "admin"}`, url + "/users"}, "admin jane created"},
+		{[]string{"-verb", "POST", "-body", `{"name": "joe", "tags": ["a", "b"]}`, url + "/users"}, `{"name":"joe","tags":["a"]}`},
+	}
+	for _, tc := range tests {
+		if got := answer(t, tc.args...); !strings.Contains(got, tc.expected) {
+			t.Errorf("%q: Expected %q, Got: %q", tc.args, tc.expected, got)
+		}
+	}
+
+	// the headers have to match, and a missing variable fails the response
+	for path, expected := range map[string]int{"/users/42": http.StatusNotFound, "/broken": http.StatusInternalServerError, "/unavailable": http.StatusServiceUnavailable} {
+		res, err := http.Get(url + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != expected {
+			t.Errorf("%s: Expected %d, Got: %d", path, expected, res.StatusCode)
+		}
+	}
+
+	start := time.Now()
+	answer(t, url+"/slow")
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected a delay of 50ms, Got: %s", elapsed)
+	}
+}
+
+func TestServeFaults(t *testing.T) {
+	_, url := startMockServer(t, testMocks, grpcConfig{})
+	if err := HandleHttp(&bytes.Buffer{}, []string{url + "/unavailable"}); !errors.Is(err, ErrStatus) {
+		t.Errorf("Expected %v, Got: %v", ErrStatus, err)
+	}
+	if err := HandleHttp(&bytes.Buffer{}, []string{url + "/aborted/a/b"}); !errors.Is(err, ErrNetwork) {
+		t.Errorf("Expected %v, Got: %v", ErrNetwork, err)
+	}
+}
+
+func TestServeRequestLog(t *testing.T) {
+	m, url := startMockServer(t, testMocks, grpcConfig{})
+	logPath := filepath.Join(t.TempDir(), "requests.jsonl")
+	f, err := os.Create(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m.log = f
+
+	answer(t, "-verb", "POST", "-body", `{"name": "joe", "tags": ["a"]}`, url+"/users")
+	answer(t, "-bearer", "abc", "-query", "page=1", url+"/users/7")
+	HandleHttp(&bytes.Buffer{}, []string{url + "/missing"})
+
+	requests := loggedRequests(t, url, "")
+	if len(requests) != 3 {
+		t.Fatalf("Expected 3 requests, Got: %v", requests)
+	}
+	first := requests[0]
+	if first.Method != "POST" || first.Path != "/users" || first.Route != "create user" || first.Status != "201" ||
+		first.Body.(map[string]interface{})["name"] != "joe" {
+		t.Errorf("Expected the creation of joe, Got: %+v", first)
+	}
+	if requests[2].Route != "" || requests[2].Status != "404" {
+		t.Errorf("Expected an unmatched request, Got: %+v", requests[2])
+	}
+
+	for query, expected := range map[string]int{"?method=get": 2, "?route=get+user": 1, "?path=/users&protocol=http": 1, "?protocol=grpc": 0} {
+		if got := loggedRequests(t, url, query); len(got) != expected {
+			t.Errorf("%s: Expected %d requests, Got: %v", query, expected, got)
+		}
+	}
+
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(b)), "\n"); len(lines) != 3 || !strings.Contains(lines[1], `"route":"get user"`) {
+		t.Errorf("Expected the requests as JSON lines, Got: %q", b)
+	}
+	out := m.w.(*bytes.Buffer).String()
+	if expected := "POST /users 201 (create user)\nGET /users/7 200 (get user)\nGET /missing 404\n"; out != expected {
+		t.Errorf("Expected %q, Got: %q", expected, out)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, url+mockAdminPath, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got := loggedRequests(t, url, ""); res.StatusCode != http.StatusNoContent || len(got) != 0 {
+		t.Errorf("Expected the requests to be cleared, Got: %d %v", res.StatusCode, got)
+	}
+}
+
+const testGrpcMocks = `
+grpc:
+  - name: admin
+    method: Users/GetUser
+    metadata:
+      authorization: admin
+    response:
+      body: {"user": {"id": "{{body.id}}", "firstName": "admin"}}
+  - name: jane
+    method: Users/GetUser
+    body: {"email": "jane@example.com"}
+    response:
+      body:
+        user: {id: "{{body.id}}", firstName: jane, age: 36}
+  - name: unknown user
+    method: Users/GetUser
+    response:
+      code: NOT_FOUND
+      message: no such user
+  - name: joe's repos
+    method: Repo/GetRepos
+    body: {creator_id: joe}
+    response:
+      messages:
+        - repo: {id: "3"}
+  - name: repos
+    method: Repo/GetRepos
+    response:
+      messages:
+        - repo: {id: "1", name: "{{body.creator_id}}-first"}
+        - repo: {id: "2"}
+`
+
+func TestServeGrpc(t *testing.T) {
+	m, url := startMockServer(t, testGrpcMocks, grpcConfig{
+		protoFiles:  stringsFlag{"repositories.proto"},
+		importPaths: stringsFlag{protoDir},
+	})
+	l := bufconn.Listen(1024 * 1024)
+	s := m.grpcServer()
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+	opts := []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return l.Dial()
+		}),
+	}
+
+	tests := []struct {
+		method   string
+		body     string
+		md       []string
+		expected string
+		code     codes.Code
+	}{
+		{"Users/GetUser", `{"email": "jane@example.com", "id": "7"}`, nil, `"firstName":"jane"`, codes.OK},
+		{"Users/GetUser", `{"email": "jane@example.com", "id": "7"}`, []string{"authorization", "admin"}, `"firstName":"admin"`, codes.OK},
+		{"Users/GetUser", `{"email": "joe@example.com"}`, nil, "", codes.NotFound},
+		{"Repo/GetRepos", `{"creator_id": "jane"}`, nil, `"name":"jane-first"`, codes.OK},
+		{"Repo/GetRepos", `{"creatorId": "joe"}`, nil, `"id":"3"`, codes.OK},
+		{"Repo/CreateRepo", ``, nil, "", codes.Unimplemented},
+	}
+	for _, tc := range tests {
+		// the descriptors are resolved through the reflection service of the mock server
+		gc := grpcConfig{server: "bufnet", method: tc.method, body: tc.body, dialOptions: opts}
+		ctx := metadata.AppendToOutgoingContext(context.Background(), tc.md...)
+		var buf bytes.Buffer
+		err := gc.call(ctx, &buf)
+		if code := status.Code(err); code != tc.code {
+			t.Errorf("%s %s: Expected %v, Got: %v", tc.method, tc.body, tc.code, err)
+		}
+		if !strings.Contains(strings.Join(strings.Fields(buf.String()), ""), tc.expected) {
+			t.Errorf("%s %s: Expected %q, Got: %q", tc.method, tc.body, tc.expected, buf.String())
+		}
+	}
+
+	requests := loggedRequests(t, url, "?protocol=grpc&method=Users/GetUser")
+	if len(requests) != 3 || requests[1].Route != "admin" || requests[2].Status != "NotFound" {
+		t.Errorf("Expected the calls of Users/GetUser, Got: %+v", requests)
+	}
+}
+
+func TestServeInvalidSpec(t *testing.T) {
+	users := grpcConfig{protoFiles: stringsFlag{"users.proto"}, importPaths: stringsFlag{protoDir}}
+	tests := []struct {
+		spec string
+		gc   grpcConfig
+	}{
+		{"routes: {}", grpcConfig{}},
+		{"routes: [{path: /, response: {status: 42}}]", grpcConfig{}},
+		{"routes: [{path: /, response: {fault: {rate: 2}}}]", grpcConfig{}},
+		{"routes: [{path: /, response: {delay: soon}}]", grpcConfig{}},
+		{"grpc: [{method: Users/GetUser}]", grpcConfig{}},
+		{"grpc: [{method: Users/DeleteUser}]", users},
+		{"grpc: [{method: Users/GetUser, response: {code: BROKEN}}]", users},
+		{"grpc: [{method: Users/GetUser, response: {messages: [{}]}}]", users},
+	}
+	for _, tc := range tests {
+		var err error
+		path := writeFile(t, t.TempDir(), "mocks.yaml", tc.spec)
+		m := &mockServer{w: &bytes.Buffer{}}
+		if m.spec, err = loadMockSpec(path); err == nil {
+			if tc.gc.hasLocalDescriptors() {
+				src, _ := tc.gc.descriptorSource(context.Background(), nil)
+				files := src.(fileSource)
+				m.descriptors = &files
+			}
+			err = m.validate()
+		}
+		if !errors.Is(err, InvalidMockSpec) {
+			t.Errorf("%s: Expected %v, Got: %v", tc.spec, InvalidMockSpec, err)
+		}
+	}
+
+	if err := HandleServe(&bytes.Buffer{}, nil); !errors.Is(err, ErrNoSpecSpecified) {
+		t.Errorf("Expected %v, Got: %v", ErrNoSpecSpecified, err)
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		params        map[string]string
+		ok            bool
+	}{
+		{"", "/any", nil, true},
+		{"/users", "/users", nil, true},
+		{"/users", "/users/1", nil, false},
+		{"/users/{id}", "/users/1", map[string]string{"id": "1"}, true},
+		{"/users/{id}", "/users/", nil, false},
+		{"/users/{id}/repos/{repo}", "/users/1/repos/r", map[string]string{"id": "1", "repo": "r"}, true},
+		{"/files/*", "/files/a/b", nil, true},
+		{"/files/*", "/file", nil, false},
+	}
+	for _, tc := range tests {
+		params, ok := matchPath(tc.pattern, tc.path)
+		if ok != tc.ok || (ok && len(params) != len(tc.params)) {
+			t.Errorf("%s %s: Expected %v %v, Got: %v %v", tc.pattern, tc.path, tc.ok, tc.params, ok, params)
+		}
+		for k, v := range tc.params {
+			if params[k] != v {
+				t.Errorf("%s %s: Expected %s=%s, Got: %v", tc.pattern, tc.path, k, v, params)
+			}
+		}
+	}
+}
+
+func TestMatchBody(t *testing.T) {
+	tests := []struct {
+		expected interface{}
+		body     string
+		ok       bool
+	}{
+		{nil, `{"id": "1"}`, true},
+		{"jane", `{"name": "jane"}`, true},
+		{map[string]interface{}{"creator_id": "jane"}, `{"creator_id": "jane", "page": 2}`, true},
+		{map[string]interface{}{"creator_id": "jane"}, `{"creatorId": "jane"}`, false},
+		// the 64-bit integers of gRPC requests are strings
+		{map[string]interface{}{"size": 42}, `{"size": "42"}`, true},
+		{map[string]interface{}{"size": 42}, `{"size": "43"}`, false},
+		{map[string]interface{}{"size": 42}, `{"size": 42}`, true},
+	}
+	for _, tc := range tests {
+		if ok := matchBody(tc.expected, []byte(tc.body)); ok != tc.ok {
+			t.Errorf("%v %s: Expected %v, Got: %v", tc.expected, tc.body, tc.ok, ok)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/kballard/go-shellquote"
+	"github.com/peterh/liner"
+	"google.golang.org/grpc"
+)
+
+// completionTimeout bounds the reflection requests listing the methods to complete.
+const completionTimeout = 2 * time.Second
+
+// shellCommands are the commands of the shell, besides those of mync.
+var shellCommands = []string{"set", "unset", "show", "help", "exit"}
+
+// prompter reads the lines typed in the shell, liner.State being the interactive one.
+type prompter interface {
+	Prompt(prompt string) (string, error)
+	AppendHistory(item string)
+}
+
+// shell is the interactive prompt of mync. Its session holds headers added to the http commands, a base URL
+// which relative URLs are resolved against, and a default gRPC server.
+type shell struct {
+	w io.Writer
+	// run runs a command line of mync, printing the usage errors
+	run func(w io.Writer, args []string) error
+
+	headers []string
+	base    string
+	server  string
+
+	// urls and servers are those used before, in the order they were first used, for the completion
+	urls    []string
+	servers []string
+	// methods caches the methods of each server, as Service/Method
+	methods map[string][]string
+
+	// dialOptions are appended to the options the servers are dialed with to list their methods
+	dialOptions []grpc.DialOption
+}
+
+// HandleShell starts an interactive prompt running the commands of mync through `run`, which is mync's dispatcher.
+func HandleShell(w io.Writer, args []string, run func(w io.Writer, args []string) error) error {
+	var historyPath string
+	if home, err := os.UserHomeDir(); err == nil {
+		historyPath = filepath.Join(home, ".mync_history")
+	}
+	fs := flag.NewFlagSet("shell", flag.ContinueOnError)
+	fs.SetOutput(w)
+	fs.StringVar(&historyPath, "history", historyPath, "File path of the history of the commands, empty to not keep it")
+	fs.Usage = func() {
+		var usageString = `
+shell: An interactive prompt running the http and grpc commands, with history and completion.
+shell: <options>`
+
+		fmt.Fprintln(w, usageString)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Options: ")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	s := newShell(w, run)
+	l := liner.NewLiner()
+	defer l.Close()
+	l.SetCtrlCAborts(true)
+	l.SetWordCompleter(s.complete)
+	if len(historyPath) > 0 {
+		if b, err := os.ReadFile(historyPath); err == nil {
+			l.ReadHistory(bytes.NewReader(b))
+			for _, line := range strings.Split(string(b), "\n") {
+				s.learn(line)
+			}
+		}
+	}
+
+	err := s.loop(l)
+	if len(historyPath) > 0 {
+		f, herr := os.OpenFile(historyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if herr == nil {
+			_, herr = l.WriteHistory(f)
+			if cerr := f.Close(); herr == nil {
+				herr = cerr
+			}
+		}
+		if err == nil {
+			err = herr
+		}
+	}
+	return err
+}
+
+func newShell(w io.Writer, run func(w io.Writer, args []string) error) *shell {
+	return &shell{w: w, run: run, methods: make(map[string][]string)}
+}
+
+// loop runs the lines read until exit or the end of the input, Ctrl-C clearing the line.
+func (s *shell) loop(p prompter) error {
+	fmt.Fprintln(s.w, `mync shell, "help" lists the commands.`)
+	for {
+		line, err := p.Prompt("mync> ")
+		if errors.Is(err, liner.ErrPromptAborted) {
+			continue
+		}
+		if err == io.EOF {
+			fmt.Fprintln(s.w)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		p.AppendHistory(line)
+		exit, err := s.exec(line)
+		if err != nil {
+			fmt.Fprintln(s.w, "Error:", err)
+		}
+		if exit {
+			return nil
+		}
+	}
+}
+
+// exec runs a line, reporting whether the shell exits.
+func (s *shell) exec(line string) (bool, error) {
+	args, err := shellquote.Split(line)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s", InvalidShellCommand, err)
+	}
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch args[0] {
+	case "exit", "quit":
+		return true, nil
+	case "help":
+		s.help()
+		return false, nil
+	case "show":
+		s.show()
+		return false, nil
+	case "set":
+		return false, s.set(args[1:])
+	case "unset":
+		return false, s.unset(args[1:])
+	case "shell":
+		return false, ErrNestedShell
+	case "http":
+		args = s.httpArgs(args)
+	case "grpc":
+		args = s.grpcArgs(args)
+	case "run", "bench":
+	default:
+		return false, fmt.Errorf("%w: %s", InvalidShellCommand, args[0])
+	}
+	s.learnArgs(args)
+	return false, s.run(s.w, args)
+}
+
+func (s *shell) help() {
+	fmt.Fprintln(s.w, `Commands:
+  http <options> url          sends a HTTP request, a URL starting with / is resolved against the base URL
+  grpc <options> [server]     calls a gRPC method, on the session's server when none is given
+  run, bench                  as the mync commands, "-h" lists their options
+  set header Name: value      adds a header to the http commands of the session
+  set base url                sets the base URL of the session
+  set server host:port        sets the gRPC server of the session
+  unset header Name|base|server
+  show                        prints the session
+  exit                        leaves the shell, as Ctrl-D
+
+Tab completes the commands, the URLs used before and the gRPC methods after -method.`)
+}
+
+func (s *shell) show() {
+	fmt.Fprintf(s.w, "base: %s\n", s.base)
+	fmt.Fprintf(s.w, "server: %s\n", s.server)
+	for _, h := range s.headers {
+		fmt.Fprintf(s.w, "header: %s\n", h)
+	}
+}
+
+func (s *shell) set(args []string) error {
+	if len(args) < 2 {
+		return InvalidShellCommand
+	}
+	value := strings.Join(args[1:], " ")
+	switch args[0] {
+	case "header":
+		name, v, ok := strings.Cut(value, ":")
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if !ok || len(name) == 0 {
+			return fmt.Errorf("%w: %s", InvalidHttpHeader, value)
+		}
+		s.removeHeader(name)
+		s.headers = append(s.headers, name+": "+strings.TrimSpace(v))
+	case "base":
+		s.base = strings.TrimSuffix(value, "/")
+	case "server":
+		s.server = value
+	default:
+		return fmt.Errorf("%w: %s", InvalidShellCommand, args[0])
+	}
+	return nil
+}
+
+func (s *shell) unset(args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "header":
+		s.removeHeader(http.CanonicalHeaderKey(args[1]))
+	case len(args) == 1 && args[0] == "base":
+		s.base = ""
+	case len(args) == 1 && args[0] == "server":
+		s.server = ""
+	default:
+		return InvalidShellCommand
+	}
+	return nil
+}
+
+func (s *shell) removeHeader(name string) {
+	headers := s.headers[:0]
+	for _, h := range s.headers {
+		if n, _, _ := strings.Cut(h, ":"); n != name {
+			headers = append(headers, h)
+		}
+	}
+	s.headers = headers
+}
+
+// httpArgs adds the headers of the session to a http command, except those it sets itself, and
+// resolves its URL against the base URL.
+func (s *shell) httpArgs(args []string) []string {
+	rest := args[1:]
+	own := make(map[string]bool)
+	if hc, err := parseHttpArgs(io.Discard, rest); err == nil {
+		for _, h := range hc.headers {
+			name, _, _ := strings.Cut(h, ":")
+			own[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+		if len(s.base) > 0 && strings.HasPrefix(hc.url, "/") {
+			// the URL is the last argument, following the flags
+			rest = append(append([]string(nil), rest[:len(rest)-1]...), s.base+hc.url)
+		}
+	}
+	res := []string{args[0]}
+	for _, h := range s.headers {
+		if name, _, _ := strings.Cut(h, ":"); !own[name] {
+			res = append(res, "-H", h)
+		}
+	}
+	return append(res, rest...)
+}
+
+// grpcArgs adds the server of the session to a grpc command which has none.
+func (s *shell) grpcArgs(args []string) []string {
+	if len(s.server) == 0 {
+		return args
+	}
+	if len(args) > 1 && (args[1] == "list" || args[1] == "describe") {
+		// the server comes first, followed by the service or the symbol
+		gc := grpcConfig{}
+		rest, err := gc.parseInspectArgs(io.Discard, args[1], "", args[2:])
+		var positional int
+		switch {
+		case errors.Is(err, ErrNoServerSpecified):
+		case err != nil || gc.hasLocalDescriptors():
+			return args
+		default:
+			positional = len(rest) + 1
+		}
+		if positional >= 2 {
+			return args
+		}
+		i := len(args) - positional
+		return append(append(append([]string(nil), args[:i]...), s.server), args[i:]...)
+	}
+	if _, err := parseGrpcArgs(io.Discard, args[1:]); errors.Is(err, ErrNoServerSpecified) {
+		return append(append([]string(nil), args...), s.server)
+	}
+	return args
+}
+
+// learn records the URL or the gRPC server of a line of the history, for the completion.
+func (s *shell) learn(line string) {
+	if args, err := shellquote.Split(line); err == nil {
+		s.learnArgs(args)
+	}
+}
+
+func (s *shell) learnArgs(args []string) {
+	if len(args) < 2 {
+		return
+	}
+	switch args[0] {
+	case "http":
+		if hc, err := parseHttpArgs(io.Discard, args[1:]); err == nil && strings.Contains(hc.url, "://") {
+			s.urls = appendNew(s.urls, hc.url)
+		}
+	case "grpc":
+		if gc, err := parseGrpcArgs(io.Discard, args[1:]); err == nil {
+			s.servers = appendNew(s.servers, gc.server)
+		}
+	}
+}
+
+func appendNew(values []string, v string) []string {
+	for _, existing := range values {
+		if existing == v {
+			return values
+		}
+	}
+	return append(values, v)
+}
+
+// complete completes the word at the cursor: the commands first, then the URLs used before in
+// http commands and the methods of the gRPC server after -method.
+func (s *shell) complete(line string, pos int) (string, []string, string) {
+	head, tail := line[:pos], line[pos:]
+	i := strings.LastIndexAny(head, " \t") + 1
+	word := head[i:]
+	head = head[:i]
+	words := strings.Fields(head)
+
+	var candidates []string
+	switch {
+	case len(words) == 0:
+		candidates = append([]string{"http", "grpc", "run", "bench"}, shellCommands...)
+	case (words[0] == "set" || words[0] == "unset") && len(words) == 1:
+		candidates = []string{"header", "base", "server"}
+	case words[0] == "http" && !strings.HasPrefix(word, "-"):
+		for _, u := range s.urls {
+			candidates = append(candidates, u)
+			if len(s.base) > 0 && strings.HasPrefix(u, s.base+"/") {
+				candidates = append(candidates, strings.TrimPrefix(u, s.base))
+			}
+		}
+	case words[0] == "grpc" && len(words) == 1 && !strings.HasPrefix(word, "-"):
+		candidates = []string{"list", "describe"}
+	case words[0] == "grpc" && words[len(words)-1] == "-method":
+		candidates = s.serverMethods()
+	}
+
+	var completions []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			completions = appendNew(completions, c)
+		}
+	}
+	sort.Strings(completions)
+	return head, completions, tail
+}
+
+// serverMethods lists the methods of the session's server, or else of the servers used before,
+// through their reflection service.
+func (s *shell) serverMethods() []string {
+	servers := s.servers
+	if len(s.server) > 0 {
+		servers = []string{s.server}
+	}
+	var methods []string
+	for _, server := range servers {
+		if _, ok := s.methods[server]; !ok {
+			// a server which can't be reached is tried again on the next completion
+			if m := s.listMethods(server); len(m) > 0 {
+				s.methods[server] = m
+			}
+		}
+		methods = append(methods, s.methods[server]...)
+	}
+	return methods
+}
+
+// listMethods lists the methods of a server, none when they can't be listed.
+func (s *shell) listMethods(server string) []string {
+	gc := grpcConfig{server: server, timeout: completionTimeout, dialOptions: s.dialOptions}
+	var methods []string
+	gc.inspect(context.Background(), func(src descriptorSource) error {
+		services, err := src.ListServices()
+		if err != nil {
+			return err
+		}
+		for _, name := range services {
+			if strings.HasPrefix(name, "grpc.reflection.") {
+				continue
+			}
+			d, err := src.FindSymbol(name)
+			if err != nil {
+				return err
+			}
+			if sd, ok := d.(*desc.ServiceDescriptor); ok {
+				for _, md := range sd.GetMethods() {
+					methods = append(methods, name+"/"+md.GetName())
+				}
+			}
+		}
+		return nil
+	})
+	return methods
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// scriptedPrompter reads the lines of a script, as if they were typed.
+type scriptedPrompter struct {
+	lines   []string
+	history []string
+}
+
+func (p *scriptedPrompter) Prompt(prompt string) (string, error) {
+	if len(p.lines) == 0 {
+		return "", io.EOF
+	}
+	line := p.lines[0]
+	p.lines = p.lines[1:]
+	return line, nil
+}
+
+func (p *scriptedPrompter) AppendHistory(item string) {
+	p.history = append(p.history, item)
+}
+
+// recordingShell returns a shell recording the commands it runs instead of running them.
+func recordingShell(w io.Writer) (*shell, *[][]string) {
+	var ran [][]string
+	s := newShell(w, func(w io.Writer, args []string) error {
+		ran = append(ran, args)
+		return nil
+	})
+	return s, &ran
+}
+
+func TestShellSession(t *testing.T) {
+	var buf bytes.Buffer
+	s, ran := recordingShell(&buf)
+	p := &scriptedPrompter{lines: []string{
+		"set header X-Token: abc",
+		"set header Accept: text/plain",
+		"set base http://localhost:8080/",
+		"set server localhost:50051",
+		"http -verb POST -body '{\"name\": \"jane\"}' /users",
+		"http -H 'accept: application/json' https://example.com/users",
+		"grpc -method Users/GetUser",
+		"grpc -method Users/GetUser other:50051",
+		"grpc list",
+		"grpc describe Users",
+		"grpc list other:50051 Users",
+		"unset header x-token",
+		"unset base",
+		"show",
+		"",
+		"shell",
+		"exit",
+		"http /never/run",
+	}}
+	if err := s.loop(p); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"http", "-H", "X-Token: abc", "-H", "Accept: text/plain", "-verb", "POST", "-body", `{"name": "jane"}`, "http://localhost:8080/users"},
+		{"http", "-H", "X-Token: abc", "-H", "accept: application/json", "https://example.com/users"},
+		{"grpc", "-method", "Users/GetUser", "localhost:50051"},
+		{"grpc", "-method", "Users/GetUser", "other:50051"},
+		{"grpc", "list", "localhost:50051"},
+		{"grpc", "describe", "localhost:50051", "Users"},
+		{"grpc", "list", "other:50051", "Users"},
+	}
+	if !reflect.DeepEqual(*ran, expected) {
+		t.Errorf("Expected %q, Got: %q", expected, *ran)
+	}
+	if !strings.Contains(buf.String(), "base: \nserver: localhost:50051\nheader: Accept: text/plain\n") {
+		t.Errorf("Expected the session, Got: %q", buf.String())
+	}
+	if !strings.Contains(buf.String(), "Error: "+ErrNestedShell.Error()) {
+		t.Errorf("Expected the nested shell to be refused, Got: %q", buf.String())
+	}
+	if len(p.history) != 16 || len(p.lines) != 1 {
+		t.Errorf("Expected the lines up to exit in the history, Got: %q", p.history)
+	}
+}
+
+func TestShellErrors(t *testing.T) {
+	s, ran := recordingShell(io.Discard)
+	for _, line := range []string{"bogus", "set", "set color red", "set header nocolon", "unset header", "http 'unterminated"} {
+		if _, err := s.exec(line); err == nil {
+			t.Errorf("%s: Expected an error", line)
+		}
+	}
+	if _, err := s.exec("set header nocolon"); !errors.Is(err, InvalidHttpHeader) {
+		t.Errorf("Expected %v, Got: %v", InvalidHttpHeader, err)
+	}
+	if len(*ran) != 0 {
+		t.Errorf("Expected no command to run, Got: %q", *ran)
+	}
+}
+
+func TestShellComplete(t *testing.T) {
+	opts := startTestGrpcServerWithReflection(t, true)
+	s, _ := recordingShell(io.Discard)
+	s.dialOptions = opts
+	s.learn("http http://localhost:8080/users/1")
+	s.learn("http -verb POST http://localhost:8080/repos")
+	s.learn("grpc -method Users/GetUser bufnet")
+	s.base = "http://localhost:8080"
+
+	for _, tc := range []struct {
+		line     string
+		head     string
+		expected []string
+	}{
+		{"h", "", []string{"help", "http"}},
+		{"set b", "set ", []string{"base"}},
+		{"grpc d", "grpc ", []string{"describe"}},
+		{"http -verb GET http://lo", "http -verb GET ", []string{"http://localhost:8080/repos", "http://localhost:8080/users/1"}},
+		{"http /u", "http ", []string{"/users/1"}},
+		{"grpc -method ", "grpc -method ", []string{"Repo/CreateRepo", "Repo/GetRepos", "Users/GetHelp", "Users/GetUser"}},
+		{"grpc -method Users/GetU", "grpc -method ", []string{"Users/GetUser"}},
+	} {
+		head, completions, tail := s.complete(tc.line, len(tc.line))
+		if head != tc.head || !reflect.DeepEqual(completions, tc.expected) || tail != "" {
+			t.Errorf("%q: Expected %q %q, Got: %q %q %q", tc.line, tc.head, tc.expected, head, completions, tail)
+		}
+	}
+
+	// the cursor in the middle of the line
+	head, completions, tail := s.complete("ht -verb GET", 2)
+	if head != "" || !reflect.DeepEqual(completions, []string{"http"}) || tail != " -verb GET" {
+		t.Errorf("Expected the command to complete, Got: %q %q %q", head, completions, tail)
+	}
+}
@@ -0,0 +1,245 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type sseConfig struct {
+	// http holds the URL, the query parameters, the headers, the credentials and the connection options of the requests
+	http        httpConfig
+	lastEventId string
+	retry       time.Duration
+	reconnects  int
+	maxEvents   int
+	json        bool
+
+	// events counts the events received
+	events int
+	// connected is set once a stream was received, the connection being retried from then on
+	connected bool
+}
+
+// sseEvent is an event of a stream, printed as a JSON object with -json.
+type sseEvent struct {
+	Id    string `json:"id,omitempty"`
+	Event string `json:"event"`
+	Data  string `json:"data"`
+}
+
+func HandleSse(w io.Writer, args []string) error {
+	sc, err := parseSseArgs(w, args)
+	if err != nil {
+		return err
+	}
+	return sc.run(w)
+}
+
+// parseSseArgs parses the flags and the URL of the sse command.
+func parseSseArgs(w io.Writer, args []string) (*sseConfig, error) {
+	sc := sseConfig{http: httpConfig{maxRedirects: 10}}
+	fs := flag.NewFlagSet("sse", flag.ContinueOnError)
+	fs.SetOutput(w)
+	sc.http.requestFlags(fs)
+	sc.http.connectionFlags(fs)
+	fs.StringVar(&sc.lastEventId, "last-event-id", "", "ID of the last event received, sent in the Last-Event-ID header to resume the stream")
+	fs.DurationVar(&sc.retry, "retry", 3*time.Second, "Delay before reconnecting once the stream ends, until the server sets it")
+	fs.IntVar(&sc.reconnects, "reconnects", -1, "Number of reconnections once the stream ends, -1 for no limit")
+	fs.IntVar(&sc.maxEvents, "max-events", 0, "Stop after receiving this many events, 0 for no limit")
+	fs.BoolVar(&sc.json, "json", false, "Print each event as a JSON object on a line")
+	fs.Usage = func() {
+		var usageString = `
+sse: A Server-Sent Events client, printing the events of a text/event-stream.
+sse: <options> url
+
+The stream is resumed from the last event ID received when it ends, the
+server stopping it with a 204 No Content response.`
+
+		fmt.Fprintln(w, usageString)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Options: ")
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 1 {
+		return nil, ErrNoServerSpecified
+	}
+	sc.http.url = fs.Arg(0)
+	if sc.retry < 0 || sc.reconnects < -1 || sc.maxEvents < 0 {
+		return nil, InvalidStreamOption
+	}
+	if sc.http.transport, err = sc.http.newTransport(); err != nil {
+		return nil, err
+	}
+	if sc.http.verbose {
+		sc.http.trace = w
+	}
+	return &sc, nil
+}
+
+// run reads the stream, reconnecting once it ends or fails with a network error. The first connection failing
+// isn't retried, nor the responses which aren't a stream.
+func (sc *sseConfig) run(w io.Writer) error {
+	client := sc.http.client()
+	for reconnects := 0; ; reconnects++ {
+		done, err := sc.read(w, client)
+		if done || !sc.connected || (sc.reconnects >= 0 && reconnects >= sc.reconnects) {
+			return err
+		}
+		if sc.http.verbose {
+			if err != nil {
+				fmt.Fprintf(w, "* Stream failed: %v\n", err)
+			}
+			fmt.Fprintf(w, "* Reconnecting in %s\n", sc.retry)
+		}
+		time.Sleep(sc.retry)
+	}
+}
+
+// read connects to the stream and prints its events until it ends. `done` is set when the stream mustn't
+// be read again, as -max-events were received or the response isn't a stream.
+func (sc *sseConfig) read(w io.Writer, client *http.Client) (done bool, err error) {
+	req, err := sc.http.newRequest(context.Background(), http.MethodGet)
+	if err != nil {
+		return true, err
+	}
+	if len(req.Header.Get("Accept")) == 0 {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+	req.Header.Set("Cache-Control", "no-cache")
+	if len(sc.lastEventId) > 0 {
+		req.Header.Set("Last-Event-ID", sc.lastEventId)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return false, httpError(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNoContent {
+		return true, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return true, statusError(res)
+	}
+	if ct, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); ct != "text/event-stream" {
+		return true, fmt.Errorf("%w: %s", ErrNotEventStream, res.Header.Get("Content-Type"))
+	}
+	sc.connected = true
+	return sc.readEvents(w, res.Body)
+}
+
+// readEvents parses the stream as defined by the HTML standard, section 9.2.6, an event being dispatched
+// at each blank line. The event not ended when the stream ends is dropped.
+func (sc *sseConfig) readEvents(w io.Writer, r io.Reader) (bool, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxLineSize)
+	s.Split(scanEventLines)
+	var eventType string
+	var data strings.Builder
+	for first := true; s.Scan(); first = false {
+		line := s.Text()
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		if len(line) == 0 {
+			if data.Len() > 0 {
+				ev := sseEvent{Id: sc.lastEventId, Event: eventType, Data: strings.TrimSuffix(data.String(), "\n")}
+				if len(ev.Event) == 0 {
+					ev.Event = "message"
+				}
+				if err := sc.printEvent(w, ev); err != nil {
+					return true, err
+				}
+				if sc.events++; sc.maxEvents > 0 && sc.events >= sc.maxEvents {
+					return true, nil
+				}
+			}
+			eventType = ""
+			data.Reset()
+			continue
+		}
+		if line[0] == ':' {
+			// a comment
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				sc.lastEventId = value
+			}
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && strings.Trim(value, "0123456789") == "" {
+				sc.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return false, httpError(err)
+	}
+	return false, nil
+}
+
+// printEvent prints the event as the fields of the stream, with a blank line after it, or as JSON with -json.
+func (sc *sseConfig) printEvent(w io.Writer, ev sseEvent) error {
+	if sc.json {
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return enc.Encode(ev)
+	}
+	var b strings.Builder
+	if len(ev.Id) > 0 {
+		fmt.Fprintf(&b, "id: %s\n", ev.Id)
+	}
+	fmt.Fprintf(&b, "event: %s\n", ev.Event)
+	for _, line := range strings.Split(ev.Data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteByte('\n')
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// scanEventLines is a bufio.SplitFunc splitting the stream into lines ended by CRLF, LF or CR.
+func scanEventLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		switch {
+		case data[i] == '\n':
+			return i + 1, data[:i], nil
+		case i+1 < len(data) && data[i+1] == '\n':
+			return i + 2, data[:i], nil
+		case i+1 < len(data) || atEOF:
+			return i + 1, data[:i], nil
+		}
+		// the CR may be followed by a LF not received yet
+		return 0, nil, nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
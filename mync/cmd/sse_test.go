@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// runSse runs the sse command and returns what it printed.
+func runSse(args ...string) (string, error) {
+	var buf bytes.Buffer
+	err := HandleSse(&buf, args)
+	return buf.String(), err
+}
+
+func TestSseEvents(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		fmt.Fprintf(w, "\ufeff: a comment\n\n")
+		fmt.Fprintf(w, "data: first\n\n")
+		fmt.Fprintf(w, "id: 7\r\nevent: update\r\ndata: {\"a\": 1}\r\ndata:<b>\r\n\r\n")
+		fmt.Fprintf(w, "event: ignored\rdata\r\r")
+		fmt.Fprintf(w, "retry: soon\nunknown: field\nevent: empty\n\n")
+		fmt.Fprintf(w, "data: dropped, the stream ending before a blank line")
+	}))
+	t.Cleanup(ts.Close)
+
+	out, err := runSse("-reconnects", "0", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "event: message\ndata: first\n\n" +
+		"id: 7\nevent: update\ndata: {\"a\": 1}\ndata: <b>\n\n" +
+		"id: 7\nevent: ignored\ndata: \n\n"
+	if out != expected {
+		t.Errorf("Expected %q, Got: %q", expected, out)
+	}
+
+	out, err = runSse("-json", "-max-events", "2", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `{"event":"message","data":"first"}` + "\n" + `{"id":"7","event":"update","data":"{\"a\": 1}\n<b>"}` + "\n"
+	if out != expected {
+		t.Errorf("Expected %q, Got: %q", expected, out)
+	}
+}
+
+func TestSseReconnect(t *testing.T) {
+	var mu sync.Mutex
+	var lastIds []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		lastIds = append(lastIds, r.Header.Get("Last-Event-ID"))
+		n := len(lastIds)
+		mu.Unlock()
+		if r.Header.Get("Accept") != "text/event-stream" || r.Header.Get("X-Token") != "abc" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if n == 3 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "retry: 10\nid: %d\ndata: event %d\n\n", n, n)
+	}))
+	t.Cleanup(ts.Close)
+
+	out, err := runSse("-verbose", "-H", "X-Token: abc", "-last-event-id", "0", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(lastIds) != "[0 1 2]" {
+		t.Errorf("Expected the Last-Event-ID to follow the events, Got: %q", lastIds)
+	}
+	for _, expected := range []string{"id: 1\nevent: message\ndata: event 1\n", "* Reconnecting in 10ms\n", "id: 2\nevent: message\ndata: event 2\n"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q, Got: %q", expected, out)
+		}
+	}
+
+	// the number of reconnections is limited
+	lastIds = nil
+	if _, err = runSse("-H", "X-Token: abc", "-reconnects", "1", ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if len(lastIds) != 2 {
+		t.Errorf("Expected a single reconnection, Got: %q", lastIds)
+	}
+}
+
+func TestSseErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/plain" {
+			fmt.Fprint(w, "not a stream")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(ts.Close)
+	if _, err := runSse(ts.URL); !errors.Is(err, ErrStatus) {
+		t.Errorf("Expected %v, Got: %v", ErrStatus, err)
+	}
+	if _, err := runSse(ts.URL + "/plain"); !errors.Is(err, ErrNotEventStream) {
+		t.Errorf("Expected %v, Got: %v", ErrNotEventStream, err)
+	}
+	ts.Close()
+	if _, err := runSse(ts.URL); !errors.Is(err, ErrNetwork) {
+		t.Errorf("Expected the first connection not to be retried, Got: %v", err)
+	}
+
+	for _, tc := range []struct {
+		args     []string
+		expected error
+	}{
+		{nil, ErrNoServerSpecified},
+		{[]string{"-retry", "-1s", "http://localhost"}, InvalidStreamOption},
+		{[]string{"-reconnects", "-2", "http://localhost"}, InvalidStreamOption},
+		{[]string{"-proxy", "ftp://localhost", "http://localhost"}, InvalidProxy},
+	} {
+		if _, err := runSse(tc.args...); !errors.Is(err, tc.expected) {
+			t.Errorf("%q: Expected %v, Got: %v", tc.args, tc.expected, err)
+		}
+	}
+}
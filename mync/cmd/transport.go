@@ -0,0 +1,251 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// proxySchemes are the schemes of the proxies `-proxy` accepts, socks5h resolving the names on the proxy.
+var proxySchemes = map[string]bool{
+	"http":    true,
+	"https":   true,
+	"socks5":  true,
+	"socks5h": true,
+}
+
+// tlsVersions names the TLS versions in the traces.
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// connectionFlags registers the flags of the proxy, the TLS options and the tracing, which the ws
+// and sse commands take too.
+func (hc *httpConfig) connectionFlags(fs *flag.FlagSet) {
+	fs.StringVar(&hc.proxy, "proxy", "", "Proxy URL, as http://host:port or socks5://host:port, instead of the HTTP_PROXY and HTTPS_PROXY variables")
+	fs.StringVar(&hc.caCert, "cacert", "", "File path of the PEM CA certificates verifying the server")
+	fs.StringVar(&hc.clientCert, "cert", "", "File path of the PEM client certificate")
+	fs.StringVar(&hc.clientKey, "key", "", "File path of the PEM private key of the client certificate, when it isn't in the -cert file")
+	fs.BoolVar(&hc.insecure, "insecure", false, "Don't verify the server's certificate")
+	fs.BoolVar(&hc.verbose, "verbose", false, "Trace the DNS lookup, connection, TLS handshake and first byte timings")
+}
+
+// newTransport returns the transport sending the requests through the proxy, with the TLS options and the protocol forced if any.
+func (hc *httpConfig) newTransport() (http.RoundTripper, error) {
+	if hc.http2 && hc.http11 {
+		return nil, ErrConflictingProtocols
+	}
+	tlsConfig, err := hc.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	if t.Proxy, err = hc.proxyFunc(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case hc.http11:
+		// a non-nil empty map disables HTTP/2
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	case hc.http2:
+		return &http2Transport{
+			tls:     t,
+			proxied: len(hc.proxy) > 0,
+			cleartext: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, addr)
+				},
+			},
+		}, nil
+	}
+	return t, nil
+}
+
+// proxyFunc returns the proxy of the requests, the -proxy one or else the one of the environment.
+func (hc *httpConfig) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if len(hc.proxy) == 0 {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(hc.proxy)
+	if err != nil || !proxySchemes[u.Scheme] || len(u.Host) == 0 {
+		return nil, fmt.Errorf("%w: %s", InvalidProxy, hc.proxy)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// tlsConfig returns the TLS configuration with the CA and the client certificates given.
+func (hc *httpConfig) tlsConfig() (*tls.Config, error) {
+	c := &tls.Config{InsecureSkipVerify: hc.insecure}
+	if len(hc.caCert) > 0 {
+		b, err := os.ReadFile(hc.caCert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%w: no PEM certificate in %s", InvalidCertificate, hc.caCert)
+		}
+		c.RootCAs = pool
+	}
+
+	if len(hc.clientKey) > 0 && len(hc.clientCert) == 0 {
+		return nil, fmt.Errorf("%w: -key needs -cert", InvalidCertificate)
+	}
+	if len(hc.clientCert) > 0 {
+		// the key can be in the certificate's file
+		key := hc.clientKey
+		if len(key) == 0 {
+			key = hc.clientCert
+		}
+		cert, err := tls.LoadX509KeyPair(hc.clientCert, key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", InvalidCertificate, err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// http2Transport forces HTTP/2, negotiated with TLS for https URLs and spoken without upgrade over
+// cleartext (h2c) for http URLs.
+type http2Transport struct {
+	tls       *http.Transport
+	cleartext *http2.Transport
+	// proxied is set when a proxy is given, which can't carry cleartext HTTP/2
+	proxied bool
+}
+
+func (t *http2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		if t.proxied {
+			return nil, ErrCleartextProxy
+		}
+		return t.cleartext.RoundTrip(req)
+	}
+	res, err := t.tls.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.ProtoMajor != 2 {
+		res.Body.Close()
+		return nil, fmt.Errorf("%w: the server answered with %s", ErrHttp2Unsupported, res.Proto)
+	}
+	return res, nil
+}
+
+// withTrace returns the request traced with -verbose, the DNS, connect, TLS and first byte timings
+// being written as they occur.
+func (hc *httpConfig) withTrace(req *http.Request) *http.Request {
+	if hc.trace == nil {
+		return req
+	}
+	w := hc.trace
+	start := time.Now()
+	// the addresses of a host can be dialed in parallel
+	var mu sync.Mutex
+	var dnsStart, tlsStart time.Time
+	connectStarts := make(map[string]time.Time)
+	since := func(t time.Time) time.Duration {
+		return time.Since(t).Round(time.Microsecond)
+	}
+	printf := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, "* "+format+"\n", args...)
+	}
+
+	trace := &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			printf("Connecting to %s", hostPort)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				printf("Reusing the connection to %s", info.Conn.RemoteAddr())
+			}
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = time.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mu.Lock()
+			d := since(dnsStart)
+			mu.Unlock()
+			if info.Err != nil {
+				printf("DNS lookup failed after %s: %v", d, info.Err)
+				return
+			}
+			addrs := make([]string, len(info.Addrs))
+			for i, a := range info.Addrs {
+				addrs[i] = a.String()
+			}
+			printf("DNS lookup done in %s: %s", d, strings.Join(addrs, ", "))
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			connectStarts[addr] = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			d := since(connectStarts[addr])
+			mu.Unlock()
+			if err != nil {
+				printf("Connection to %s failed after %s: %v", addr, d, err)
+				return
+			}
+			printf("Connected to %s in %s", addr, d)
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			mu.Lock()
+			d := since(tlsStart)
+			mu.Unlock()
+			if err != nil {
+				printf("TLS handshake failed after %s: %v", d, err)
+				return
+			}
+			proto := cs.NegotiatedProtocol
+			if len(proto) == 0 {
+				proto = "http/1.1"
+			}
+			printf("TLS handshake done in %s: %s, %s", d, tlsVersions[cs.Version], proto)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err != nil {
+				printf("Sending the request failed after %s: %v", since(start), info.Err)
+				return
+			}
+			printf("Request sent after %s", since(start))
+		},
+		GotFirstResponseByte: func() {
+			printf("First response byte after %s", since(start))
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// protoHandler answers with the protocol of the request and the subject of the client certificate, if any.
+var protoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	client := ""
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		client = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	fmt.Fprintf(w, "%s %s", r.Proto, client)
+})
+
+// startTLSServer starts a HTTPS server and writes its certificate to a PEM file.
+func startTLSServer(t *testing.T, enableHTTP2 bool, clientAuth tls.ClientAuthType) (*httptest.Server, string) {
+	ts := httptest.NewUnstartedServer(protoHandler)
+	ts.EnableHTTP2 = enableHTTP2
+	ts.TLS = &tls.Config{ClientAuth: clientAuth}
+	// the handshakes rejected by the tests aren't logged
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ts, path
+}
+
+// writeClientCert writes a self-signed client certificate and its key to PEM files.
+func writeClientCert(t *testing.T, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	if err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// answer runs the http command and returns the body of the response.
+func answer(t *testing.T, args ...string) string {
+	var buf bytes.Buffer
+	if err := HandleHttp(&buf, args); err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return buf.String()
+}
+
+func TestHttpTLS(t *testing.T) {
+	ts, ca := startTLSServer(t, true, tls.RequestClientCert)
+
+	if got := answer(t, "-cacert", ca, ts.URL); got != "HTTP/2.0 " {
+		t.Errorf("Expected HTTP/2 to be negotiated, Got: %q", got)
+	}
+	if got := answer(t, "-insecure", "-http1.1", ts.URL); got != "HTTP/1.1 " {
+		t.Errorf("Expected HTTP/1.1, Got: %q", got)
+	}
+	if err := HandleHttp(&bytes.Buffer{}, []string{ts.URL}); !errors.Is(err, ErrNetwork) {
+		t.Errorf("Expected the certificate to be rejected, Got: %v", err)
+	}
+
+	cert, key := writeClientCert(t, "jane")
+	if got := answer(t, "-cacert", ca, "-cert", cert, "-key", key, ts.URL); got != "HTTP/2.0 jane" {
+		t.Errorf("Expected the client certificate, Got: %q", got)
+	}
+	if err := HandleHttp(&bytes.Buffer{}, []string{"-key", key, ts.URL}); !errors.Is(err, InvalidCertificate) {
+		t.Errorf("Expected %v, Got: %v", InvalidCertificate, err)
+	}
+	if err := HandleHttp(&bytes.Buffer{}, []string{"-cacert", key, ts.URL}); !errors.Is(err, InvalidCertificate) {
+		t.Errorf("Expected %v, Got: %v", InvalidCertificate, err)
+	}
+}
+
+func TestHttpForceHttp2(t *testing.T) {
+	// cleartext HTTP/2
+	ts := httptest.NewServer(h2c.NewHandler(protoHandler, &http2.Server{}))
+	t.Cleanup(ts.Close)
+	if got := answer(t, "-http2", ts.URL); got != "HTTP/2.0 " {
+		t.Errorf("Expected cleartext HTTP/2, Got: %q", got)
+	}
+	if got := answer(t, ts.URL); got != "HTTP/1.1 " {
+		t.Errorf("Expected HTTP/1.1 by default, Got: %q", got)
+	}
+
+	tls11, ca := startTLSServer(t, false, tls.NoClientCert)
+	err := HandleHttp(&bytes.Buffer{}, []string{"-http2", "-cacert", ca, tls11.URL})
+	if !errors.Is(err, ErrHttp2Unsupported) {
+		t.Errorf("Expected %v, Got: %v", ErrHttp2Unsupported, err)
+	}
+	err = HandleHttp(&bytes.Buffer{}, []string{"-http2", "-http1.1", ts.URL})
+	if !errors.Is(err, ErrConflictingProtocols) {
+		t.Errorf("Expected %v, Got: %v", ErrConflictingProtocols, err)
+	}
+}
+
+func TestHttpProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		fmt.Fprint(w, "proxied")
+	}))
+	t.Cleanup(proxy.Close)
+
+	if got := answer(t, "-proxy", proxy.URL, "http://example.invalid/users?id=1"); got != "proxied" {
+		t.Errorf("Expected the proxy's answer, Got: %q", got)
+	}
+	if len(proxied) != 1 || proxied[0] != "http://example.invalid/users?id=1" {
+		t.Errorf("Expected the request to go through the proxy, Got: %q", proxied)
+	}
+
+	for _, p := range []string{"ftp://localhost:21", "localhost:8080", "socks5://"} {
+		err := HandleHttp(&bytes.Buffer{}, []string{"-proxy", p, "http://example.invalid"})
+		if !errors.Is(err, InvalidProxy) {
+			t.Errorf("%s: Expected %v, Got: %v", p, InvalidProxy, err)
+		}
+	}
+	err := HandleHttp(&bytes.Buffer{}, []string{"-proxy", proxy.URL, "-http2", "http://example.invalid"})
+	if !errors.Is(err, ErrCleartextProxy) {
+		t.Errorf("Expected %v, Got: %v", ErrCleartextProxy, err)
+	}
+}
+
+func TestHttpCookieJar(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/", MaxAge: 3600, HttpOnly: true})
+			http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark"})
+			// rejected by the jar, another host's cookie
+			http.SetCookie(w, &http.Cookie{Name: "tracker", Value: "1", Domain: "example.com"})
+		case "/logout":
+			http.SetCookie(w, &http.Cookie{Name: "session", Path: "/", MaxAge: -1})
+		}
+		var names []string
+		for _, c := range r.Cookies() {
+			names = append(names, c.Name+"="+c.Value)
+		}
+		fmt.Fprint(w, strings.Join(names, "; "))
+	}))
+	t.Cleanup(ts.Close)
+	jar := filepath.Join(t.TempDir(), "cookies.json")
+
+	answer(t, "-cookie-jar", jar, ts.URL+"/login")
+	var saved []savedCookie
+	b, err := os.ReadFile(jar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(b, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 2 || saved[0].Name != "session" || saved[0].Expires == nil || !saved[0].HttpOnly || saved[1].Name != "theme" {
+		t.Errorf("Expected the cookies to be saved, Got: %s", b)
+	}
+
+	if got := answer(t, "-cookie-jar", jar, ts.URL+"/me"); got != "session=abc; theme=dark" {
+		t.Errorf("Expected the saved cookies, Got: %q", got)
+	}
+	answer(t, "-cookie-jar", jar, ts.URL+"/logout")
+	if got := answer(t, "-cookie-jar", jar, ts.URL+"/me"); got != "theme=dark" {
+		t.Errorf("Expected the session to be deleted, Got: %q", got)
+	}
+
+	if err = os.WriteFile(jar, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = HandleHttp(&bytes.Buffer{}, []string{"-cookie-jar", jar, ts.URL}); !errors.Is(err, InvalidCookieJar) {
+		t.Errorf("Expected %v, Got: %v", InvalidCookieJar, err)
+	}
+}
+
+func TestCookieJarPublicSuffix(t *testing.T) {
+	j, err := loadCookieJar(filepath.Join(t.TempDir(), "cookies.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://www.example.co.uk/")
+	j.SetCookies(u, []*http.Cookie{
+		{Name: "supercookie", Value: "1", Domain: "co.uk"},
+		{Name: "site", Value: "1", Domain: "example.co.uk"},
+	})
+	if len(j.cookies) != 1 {
+		t.Errorf("Expected the public suffix cookie to be rejected, Got: %v", j.cookies)
+	}
+	if cookies := j.Cookies(u); len(cookies) != 1 || cookies[0].Name != "site" {
+		t.Errorf("Expected the site's cookie only, Got: %v", cookies)
+	}
+}
+
+func TestHttpVerbose(t *testing.T) {
+	ts, ca := startTLSServer(t, true, tls.NoClientCert)
+	var buf bytes.Buffer
+	if err := HandleHttp(&buf, []string{"-verbose", "-cacert", ca, ts.URL}); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"* Connecting to " + strings.TrimPrefix(ts.URL, "https://"),
+		"* Connected to ",
+		"* TLS handshake done in ",
+		"TLS 1.3, h2",
+		"* Request sent after ",
+		"* First response byte after ",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Expected %q in the trace, Got: %q", expected, buf.String())
+		}
+	}
+}
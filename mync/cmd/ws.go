@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsWriteWait is the time given to the control frames to be written.
+const wsWriteWait = 5 * time.Second
+
+// wsCloseWait is how long the server is waited for to close the connection once the client closed it.
+var wsCloseWait = time.Second
+
+// maxLineSize is the maximum size of the lines read from the standard input.
+const maxLineSize = 1 << 20
+
+// wsSchemes maps the schemes of the URLs the ws command takes to those of WebSocket.
+var wsSchemes = map[string]string{
+	"ws":    "ws",
+	"wss":   "wss",
+	"http":  "ws",
+	"https": "wss",
+}
+
+type wsConfig struct {
+	// http holds the URL, the query parameters, the headers, the credentials and the connection options of the handshake
+	http         httpConfig
+	subprotocols stringsFlag
+	ping         time.Duration
+	timeout      time.Duration
+	maxMessages  int
+	keepOpen     bool
+
+	// stdin is read for the messages sent, a line each.
+	stdin io.Reader
+}
+
+func HandleWs(w io.Writer, args []string) error {
+	wc, err := parseWsArgs(w, args)
+	if err != nil {
+		return err
+	}
+	return wc.run(&lockedWriter{w: w})
+}
+
+// parseWsArgs parses the flags and the URL of the ws command.
+func parseWsArgs(w io.Writer, args []string) (*wsConfig, error) {
+	wc := wsConfig{stdin: os.Stdin}
+	fs := flag.NewFlagSet("ws", flag.ContinueOnError)
+	fs.SetOutput(w)
+	wc.http.requestFlags(fs)
+	wc.http.connectionFlags(fs)
+	fs.Var(&wc.subprotocols, "subprotocol", "Subprotocol offered to the server, can be repeated")
+	fs.DurationVar(&wc.ping, "ping", 30*time.Second, "Interval of the pings sent to the server, which has to answer within twice the interval, 0 to not send pings")
+	fs.DurationVar(&wc.timeout, "timeout", 10*time.Second, "Timeout of the opening handshake, 0 for no timeout")
+	fs.IntVar(&wc.maxMessages, "max-messages", 0, "Close the connection after receiving this many messages, 0 for no limit")
+	fs.BoolVar(&wc.keepOpen, "keep-open", false, "Keep the connection open when the standard input ends, until the server closes it")
+	fs.Usage = func() {
+		var usageString = `
+ws: A WebSocket client, sending the lines of the standard input as text messages.
+ws: <options> url
+
+The text messages received are printed as they are, a line each, and the
+binary ones in base64 after "binary: ".`
+
+		fmt.Fprintln(w, usageString)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Options: ")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 1 {
+		return nil, ErrNoServerSpecified
+	}
+
+	u, err := url.Parse(fs.Arg(0))
+	if err != nil || len(wsSchemes[u.Scheme]) == 0 || len(u.Host) == 0 {
+		return nil, fmt.Errorf("%w: %s", InvalidWebSocketURL, fs.Arg(0))
+	}
+	u.Scheme = wsSchemes[u.Scheme]
+	wc.http.url = u.String()
+	if wc.ping < 0 || wc.timeout < 0 || wc.maxMessages < 0 {
+		return nil, InvalidStreamOption
+	}
+	return &wc, nil
+}
+
+// run opens the connection and sends the lines of the standard input until it ends, printing the messages
+// received meanwhile. The connection is closed once the input ends, unless -keep-open is set.
+func (wc *wsConfig) run(w io.Writer) error {
+	if wc.http.verbose {
+		wc.http.trace = w
+	}
+	conn, err := wc.dial(w)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	lines := make(chan string)
+	inputErr := make(chan error, 1)
+	go func() {
+		s := bufio.NewScanner(wc.stdin)
+		s.Buffer(nil, maxLineSize)
+		for s.Scan() {
+			select {
+			case lines <- s.Text():
+			case <-done:
+				return
+			}
+		}
+		inputErr <- s.Err()
+	}()
+
+	var pings <-chan time.Time
+	if wc.ping > 0 {
+		t := time.NewTicker(wc.ping)
+		defer t.Stop()
+		pings = t.C
+		// the reads time out when no pong follows the pings
+		conn.SetReadDeadline(time.Now().Add(2 * wc.ping))
+		conn.SetPongHandler(func(string) error {
+			if wc.http.verbose {
+				fmt.Fprintln(w, "* Pong received")
+			}
+			return conn.SetReadDeadline(time.Now().Add(2 * wc.ping))
+		})
+	}
+	if wc.http.verbose {
+		conn.SetPingHandler(func(data string) error {
+			fmt.Fprintln(w, "* Ping received")
+			err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(wsWriteWait))
+			if errors.Is(err, websocket.ErrCloseSent) {
+				return nil
+			}
+			return err
+		})
+	}
+
+	received := make(chan error, 1)
+	go func() {
+		received <- wc.receive(conn, w)
+	}()
+	for {
+		select {
+		case line := <-lines:
+			if err = conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+				return httpError(err)
+			}
+		case err = <-inputErr:
+			if err != nil {
+				return err
+			}
+			if !wc.keepOpen {
+				return wc.close(conn, received, w)
+			}
+		case <-pings:
+			if err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return httpError(err)
+			}
+			if wc.http.verbose {
+				fmt.Fprintln(w, "* Ping sent")
+			}
+		case err = <-received:
+			if err == nil {
+				// -max-messages were received
+				return wc.close(conn, nil, w)
+			}
+			return wc.closeError(err, w)
+		}
+	}
+}
+
+// dial opens the connection, the handshake request holding the query parameters, the headers and the credentials.
+func (wc *wsConfig) dial(w io.Writer) (*websocket.Conn, error) {
+	hc := &wc.http
+	tlsConfig, err := hc.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := hc.proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, hc.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", InvalidWebSocketURL, err)
+	}
+	if err = hc.setHeaders(req); err != nil {
+		return nil, err
+	}
+	if len(req.Host) > 0 {
+		// the dialer takes the host in the headers
+		req.Header.Set("Host", req.Host)
+	}
+
+	d := websocket.Dialer{
+		Proxy:            proxy,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: wc.timeout,
+		Subprotocols:     wc.subprotocols,
+	}
+	conn, res, err := d.DialContext(hc.withTrace(req).Context(), req.URL.String(), req.Header)
+	if err != nil {
+		if errors.Is(err, websocket.ErrBadHandshake) && res != nil {
+			return nil, statusError(res)
+		}
+		return nil, httpError(err)
+	}
+	if hc.verbose {
+		fmt.Fprintf(w, "* Connected to %s\n", req.URL)
+		if len(conn.Subprotocol()) > 0 {
+			fmt.Fprintf(w, "* Subprotocol: %s\n", conn.Subprotocol())
+		}
+	}
+	return conn, nil
+}
+
+// receive prints the messages received until the connection is closed, or -max-messages were received
+// in which case it returns nil.
+func (wc *wsConfig) receive(conn *websocket.Conn, w io.Writer) error {
+	for n := 0; wc.maxMessages == 0 || n < wc.maxMessages; n++ {
+		kind, msg, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if kind == websocket.BinaryMessage {
+			fmt.Fprintf(w, "binary: %s\n", base64.StdEncoding.EncodeToString(msg))
+		} else {
+			fmt.Fprintf(w, "%s\n", msg)
+		}
+	}
+	return nil
+}
+
+// close starts the closing handshake and waits for the server to end it, for wsCloseWait at most.
+// The messages received meanwhile are printed, unless `received` is nil as nothing is read anymore.
+func (wc *wsConfig) close(conn *websocket.Conn, received <-chan error, w io.Writer) error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait)); err != nil {
+		return httpError(err)
+	}
+	if received == nil {
+		return nil
+	}
+	select {
+	case err := <-received:
+		if err == nil {
+			return nil
+		}
+		return wc.closeError(err, w)
+	case <-time.After(wsCloseWait):
+		return nil
+	}
+}
+
+// closeError classifies the error ending the reception, which is nil when the server closed the connection normally.
+func (wc *wsConfig) closeError(err error, w io.Writer) error {
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) {
+		if wc.http.verbose {
+			fmt.Fprintf(w, "* Connection closed: %d %s\n", ce.Code, ce.Text)
+		}
+		if ce.Code == websocket.CloseNormalClosure || ce.Code == websocket.CloseGoingAway {
+			return nil
+		}
+		return &requestError{kind: ErrStatus, err: fmt.Errorf("the server closed the connection: %w", err)}
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return &requestError{kind: ErrTimeout, err: fmt.Errorf("no pong received within %s", 2*wc.ping)}
+	}
+	return httpError(err)
+}
+
+// lockedWriter serializes the writes of the goroutines printing the messages and the traces.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startWsServer starts a WebSocket server running the handler on each connection.
+func startWsServer(t *testing.T, handle func(conn *websocket.Conn, r *http.Request)) string {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"chat"}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handle(conn, r)
+	}))
+	t.Cleanup(ts.Close)
+	return "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+// wsEcho greets the client with its subprotocol and token, then answers each text message in upper case.
+func wsEcho(conn *websocket.Conn, r *http.Request) {
+	greeting := "subprotocol=" + conn.Subprotocol() + " token=" + r.Header.Get("X-Token") + " " + r.URL.RawQuery
+	conn.WriteMessage(websocket.TextMessage, []byte(greeting))
+	conn.WriteMessage(websocket.BinaryMessage, []byte{0, 1, 2})
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(websocket.TextMessage, bytes.ToUpper(msg))
+	}
+}
+
+// runWs runs the ws command with the lines sent.
+func runWs(input string, args ...string) (string, error) {
+	var buf bytes.Buffer
+	wc, err := parseWsArgs(&buf, args)
+	if err != nil {
+		return "", err
+	}
+	wc.stdin = strings.NewReader(input)
+	err = wc.run(&lockedWriter{w: &buf})
+	return buf.String(), err
+}
+
+func TestWsSession(t *testing.T) {
+	url := startWsServer(t, wsEcho)
+	out, err := runWs("hello\nworld\n", "-subprotocol", "chat", "-H", "X-Token: abc", "-query", "room=1", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "subprotocol=chat token=abc room=1\nbinary: AAEC\nHELLO\nWORLD\n"; out != expected {
+		t.Errorf("Expected %q, Got: %q", expected, out)
+	}
+
+	// the http URLs are taken too
+	out, err = runWs("", "-verbose", "-keep-open", "-max-messages", "2", "http"+strings.TrimPrefix(url, "ws"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"* Connecting to ", "* Connected to " + url, "subprotocol= token= \nbinary: AAEC\n"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q, Got: %q", expected, out)
+		}
+	}
+}
+
+func TestWsPing(t *testing.T) {
+	// the server reads, so answers the pings, then closes the connection
+	url := startWsServer(t, func(conn *websocket.Conn, r *http.Request) {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "bye")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		}()
+		conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	out, err := runWs("", "-verbose", "-keep-open", "-ping", "20ms", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"* Ping sent\n", "* Pong received\n", "* Ping received\n", "* Connection closed: 1001 bye\n"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q, Got: %q", expected, out)
+		}
+	}
+
+	// the server doesn't read, so never answers the pings
+	url = startWsServer(t, func(conn *websocket.Conn, r *http.Request) {
+		time.Sleep(time.Second)
+	})
+	if _, err = runWs("", "-keep-open", "-ping", "20ms", url); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected %v, Got: %v", ErrTimeout, err)
+	}
+}
+
+func TestWsErrors(t *testing.T) {
+	url := startWsServer(t, func(conn *websocket.Conn, r *http.Request) {
+		msg := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "boom")
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		conn.ReadMessage()
+	})
+	if _, err := runWs("", "-keep-open", url); !errors.Is(err, ErrStatus) || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Expected %v, Got: %v", ErrStatus, err)
+	}
+
+	ts := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(ts.Close)
+	if _, err := runWs("", ts.URL); !errors.Is(err, ErrStatus) {
+		t.Errorf("Expected %v, Got: %v", ErrStatus, err)
+	}
+	ts.Close()
+	if _, err := runWs("", ts.URL); !errors.Is(err, ErrNetwork) {
+		t.Errorf("Expected %v, Got: %v", ErrNetwork, err)
+	}
+
+	for _, tc := range []struct {
+		args     []string
+		expected error
+	}{
+		{nil, ErrNoServerSpecified},
+		{[]string{"ftp://localhost"}, InvalidWebSocketURL},
+		{[]string{"localhost:8080"}, InvalidWebSocketURL},
+		{[]string{"-ping", "-1s", "ws://localhost"}, InvalidStreamOption},
+		{[]string{"-H", "nocolon", "ws://localhost"}, InvalidHttpHeader},
+	} {
+		if _, err := runWs("", tc.args...); !errors.Is(err, tc.expected) {
+			t.Errorf("%q: Expected %v, Got: %v", tc.args, tc.expected, err)
+		}
+	}
+}
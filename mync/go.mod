@@ -1,3 +1,32 @@
 module mync
 
 go 1.19
+
+require (
+	github.com/PaesslerAG/jsonpath v0.1.1
+	github.com/golang/protobuf v1.5.3
+	github.com/gorilla/websocket v1.5.0
+	github.com/itchyny/gojq v0.12.13
+	github.com/jhump/protoreflect v1.15.3
+	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51
+	github.com/lucaspere/grpc/multiple_services v1.2.3
+	github.com/peterh/liner v1.2.2
+	golang.org/x/net v0.9.0
+	google.golang.org/grpc v1.57.0
+	google.golang.org/protobuf v1.31.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/PaesslerAG/gval v1.0.0 // indirect
+	github.com/bufbuild/protocompile v0.6.0 // indirect
+	github.com/itchyny/timefmt-go v0.1.5 // indirect
+	github.com/mattn/go-runewidth v0.0.14 // indirect
+	github.com/rivo/uniseg v0.4.4 // indirect
+	golang.org/x/sync v0.3.0 // indirect
+	golang.org/x/sys v0.8.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230525234030-28d5490b6b19 // indirect
+)
+
+replace github.com/lucaspere/grpc/multiple_services => ../grpc/multiple-services/
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"mync/cmd"
@@ -10,10 +11,27 @@ import (
 
 var errInvalidSubCommand = errors.New("Invalid sub-command specified")
 
+// The exit codes of mync.
+const (
+	exitError   = 1
+	exitUsage   = 2
+	exitNetwork = 3
+	exitTimeout = 4
+	// exitStatus is for non-2xx HTTP responses and gRPC calls failing with an error status
+	exitStatus = 5
+)
+
 func printUsage(w io.Writer) {
-	fmt.Fprintf(w, "Usage: mync [http|grpc] -h\n")
+	fmt.Fprintf(w, "Usage: mync [http|grpc|ws|sse|run|bench|serve|shell|import-curl] -h\n")
 	cmd.HandleHttp(w, []string{"-h"})
 	cmd.HandleGrpc(w, []string{"-h"})
+	cmd.HandleWs(w, []string{"-h"})
+	cmd.HandleSse(w, []string{"-h"})
+	cmd.HandleRun(w, []string{"-h"})
+	cmd.HandleBench(w, []string{"-h"})
+	cmd.HandleServe(w, []string{"-h"})
+	cmd.HandleShell(w, []string{"-h"}, nil)
+	cmd.HandleImportCurl(w, []string{"-h"})
 }
 
 func handleCommand(w io.Writer, args []string) error {
@@ -27,6 +45,20 @@ func handleCommand(w io.Writer, args []string) error {
 			err = cmd.HandleHttp(w, args[1:])
 		case "grpc":
 			err = cmd.HandleGrpc(w, args[1:])
+		case "ws":
+			err = cmd.HandleWs(w, args[1:])
+		case "sse":
+			err = cmd.HandleSse(w, args[1:])
+		case "run":
+			err = cmd.HandleRun(w, args[1:])
+		case "bench":
+			err = cmd.HandleBench(w, args[1:])
+		case "serve":
+			err = cmd.HandleServe(w, args[1:])
+		case "shell":
+			err = cmd.HandleShell(w, args[1:], runInShell)
+		case "import-curl":
+			err = cmd.HandleImportCurl(w, args[1:])
 		case "-h":
 			printUsage(w)
 		case "--help":
@@ -35,16 +67,62 @@ func handleCommand(w io.Writer, args []string) error {
 			err = errInvalidSubCommand
 		}
 	}
-	if errors.Is(err, cmd.ErrNoServerSpecified) || errors.Is(err, errInvalidSubCommand) || errors.Is(err, cmd.InvalidHttpMethod) || errors.Is(err, cmd.InvalidJsonBody) {
+	if isUsageError(err) {
 		fmt.Fprintln(w, err)
 		printUsage(w)
 	}
 	return err
 }
 
+// runInShell runs a command line of the shell, whose usage errors are printed with the usage
+// by handleCommand and so aren't returned to be printed again.
+func runInShell(w io.Writer, args []string) error {
+	err := handleCommand(w, args)
+	if isUsageError(err) || errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
+
+// isUsageError reports whether the error comes from the command line, in which case the usage is printed.
+func isUsageError(err error) bool {
+	return errors.Is(err, cmd.ErrNoServerSpecified) || errors.Is(err, errInvalidSubCommand) || errors.Is(err, cmd.InvalidHttpMethod) || errors.Is(err, cmd.InvalidJsonBody) ||
+		errors.Is(err, cmd.ErrNoMethodSpecified) || errors.Is(err, cmd.InvalidGrpcMethod) || errors.Is(err, cmd.ErrNoSymbolSpecified) ||
+		errors.Is(err, cmd.InvalidHttpHeader) || errors.Is(err, cmd.InvalidQueryParam) || errors.Is(err, cmd.ErrConflictingAuth) ||
+		errors.Is(err, cmd.InvalidFormData) || errors.Is(err, cmd.ErrConflictingBody) ||
+		errors.Is(err, cmd.ErrNoCollectionSpecified) || errors.Is(err, cmd.InvalidVariable) ||
+		errors.Is(err, cmd.InvalidBenchTarget) || errors.Is(err, cmd.InvalidBenchOption) ||
+		errors.Is(err, cmd.InvalidOutputFormat) || errors.Is(err, cmd.InvalidJqFilter) ||
+		errors.Is(err, cmd.InvalidChecksum) || errors.Is(err, cmd.ErrContinueWithoutOutput) || errors.Is(err, cmd.ErrConflictingDownload) ||
+		errors.Is(err, cmd.ErrConflictingProtocols) || errors.Is(err, cmd.InvalidProxy) || errors.Is(err, cmd.InvalidCertificate) ||
+		errors.Is(err, cmd.ErrNoCurlCommand) || errors.Is(err, cmd.InvalidCurlCommand) || errors.Is(err, cmd.UnsupportedCurlOption) ||
+		errors.Is(err, cmd.InvalidWebSocketURL) || errors.Is(err, cmd.InvalidStreamOption) || errors.Is(err, cmd.ErrNoSpecSpecified)
+}
+
+// exitCode returns the exit code of mync for the error of a command.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case isUsageError(err) || errors.Is(err, flag.ErrHelp):
+		return exitUsage
+	case errors.Is(err, cmd.ErrTimeout):
+		return exitTimeout
+	case errors.Is(err, cmd.ErrNetwork):
+		return exitNetwork
+	case errors.Is(err, cmd.ErrStatus):
+		return exitStatus
+	default:
+		return exitError
+	}
+}
+
 func main() {
 	err := handleCommand(os.Stdout, os.Args[1:])
 	if err != nil {
-		os.Exit(1)
+		if !isUsageError(err) && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(exitCode(err))
 	}
 }
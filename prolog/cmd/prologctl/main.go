@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	plog "github.com/lucaspere/go_projects/proglog/internal/log"
+	"github.com/lucaspere/go_projects/proglog/internal/objstore"
+	"github.com/lucaspere/go_projects/proglog/internal/server"
+)
+
+var errInvalidSubCommand = errors.New("invalid sub-command specified")
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: prologctl [snapshot|restore|rekey|start-offset|segments|roll|schema] -h")
+}
+
+func handleCommand(w io.Writer, args []string) error {
+	var err error
+
+	if len(args) < 1 {
+		err = errInvalidSubCommand
+	} else {
+		switch args[0] {
+		case "snapshot":
+			err = handleSnapshot(w, args[1:])
+		case "restore":
+			err = handleRestore(w, args[1:])
+		case "rekey":
+			err = handleRekey(w, args[1:])
+		case "start-offset":
+			err = handleStartOffset(w, args[1:])
+		case "segments":
+			err = handleSegments(w, args[1:])
+		case "roll":
+			err = handleRoll(w, args[1:])
+		case "schema":
+			err = handleSchema(w, args[1:])
+		case "-h", "--help":
+			printUsage(w)
+		default:
+			err = errInvalidSubCommand
+		}
+	}
+	if errors.Is(err, errInvalidSubCommand) {
+		fmt.Fprintln(w, err)
+		printUsage(w)
+	}
+	return err
+}
+
+// handleSnapshot downloads a snapshot of a running server's log.
+func handleSnapshot(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	fs.SetOutput(w)
+	addr := fs.String("addr", "http://localhost:8080", "address of the prolog server")
+	output := fs.String("o", "", "file to write the snapshot to, standard output if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	res, err := http.Get(*addr + "/admin/snapshot")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("snapshot: %s: %s", res.Status, b)
+	}
+
+	out := w
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	_, err = io.Copy(out, res.Body)
+	return err
+}
+
+// handleRestore rebuilds a data directory from a snapshot, the server must not be running on it.
+func handleRestore(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.SetOutput(w)
+	dir := fs.String("dir", "data", "data directory to restore the log into")
+	input := fs.String("i", "", "file to read the snapshot from, standard input if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var in io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	if err := plog.Restore(*dir, in); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "restored log into %s\n", *dir)
+	return nil
+}
+
+// handleRekey rewraps the segments' data keys under the keyfile's current master key, after which the
+// previous master keys can be dropped from the keyfile. The keys of the segments offloaded to the tier's
+// object store, configured by the same TIER_* environment variables as the server, are rewrapped too.
+// With -reencrypt, the sealed segments are also rewritten under fresh data keys.
+// The server must not be running on the data directory.
+func handleRekey(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	fs.SetOutput(w)
+	dir := fs.String("dir", "data", "data directory of the log")
+	keyfile := fs.String("keyfile", "", "keyfile holding the current and the previous master keys")
+	reencrypt := fs.Bool("reencrypt", false, "rewrite the sealed segments under fresh data keys, encrypting the plain text ones")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keyfile == "" {
+		return errors.New("rekey: -keyfile is required")
+	}
+
+	c := plog.Config{}
+	keys, err := plog.LoadKeyFile(*keyfile)
+	if err != nil {
+		return err
+	}
+	c.Encryption.Keys = keys
+	if c.Tier.Store, err = objstore.FromEnv(); err != nil {
+		return err
+	}
+	n, err := plog.Rekey(*dir, c)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "rewrapped %d segment keys under %s\n", n, keys.Current)
+	if !*reencrypt {
+		return nil
+	}
+	if n, err = plog.Reencrypt(*dir, c); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "reencrypted %d segments\n", n)
+	return nil
+}
+
+// handleStartOffset moves the start offset of a running server's log, hiding the records below it.
+func handleStartOffset(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("start-offset", flag.ContinueOnError)
+	fs.SetOutput(w)
+	addr := fs.String("addr", "http://localhost:8080", "address of the prolog server")
+	offset := fs.Uint64("offset", 0, "new start offset of the log")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(server.StartOffsetRequest{Offset: *offset})
+	if err != nil {
+		return err
+	}
+	var res server.StartOffsetResponse
+	if err = adminRequest(http.MethodPost, *addr+"/admin/start-offset", bytes.NewReader(b), &res); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "lowest offset is now %d\n", res.LowestOffset)
+	return nil
+}
+
+// handleSegments lists the segments of a running server's log.
+func handleSegments(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("segments", flag.ContinueOnError)
+	fs.SetOutput(w)
+	addr := fs.String("addr", "http://localhost:8080", "address of the prolog server")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var res server.SegmentsResponse
+	if err := adminRequest(http.MethodGet, *addr+"/admin/segments", nil, &res); err != nil {
+		return err
+	}
+	printSegments(w, res.Segments)
+	return nil
+}
+
+// handleRoll seals the active segment of a running server's log and starts a new one.
+func handleRoll(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("roll", flag.ContinueOnError)
+	fs.SetOutput(w)
+	addr := fs.String("addr", "http://localhost:8080", "address of the prolog server")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var res server.SegmentsResponse
+	if err := adminRequest(http.MethodPost, *addr+"/admin/roll", nil, &res); err != nil {
+		return err
+	}
+	printSegments(w, res.Segments)
+	return nil
+}
+
+// handleSchema manages the schemas of a running server's log.
+func handleSchema(w io.Writer, args []string) error {
+	if len(args) < 1 || args[0] != "register" {
+		return fmt.Errorf("%w: prologctl schema register -h", errInvalidSubCommand)
+	}
+	return handleSchemaRegister(w, args[1:])
+}
+
+// handleSchemaRegister registers a new version of the schema of a running server's log,
+// the records appended from then on are validated against it.
+func handleSchemaRegister(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("schema register", flag.ContinueOnError)
+	fs.SetOutput(w)
+	addr := fs.String("addr", "http://localhost:8080", "address of the prolog server")
+	schemaType := fs.String("type", string(plog.SchemaJSON), "language of the schema, json or protobuf")
+	file := fs.String("file", "", "file holding the JSON Schema document or the serialized FileDescriptorSet")
+	message := fs.String("message", "", "full name of the protobuf message the records hold")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("schema register: -file is required")
+	}
+
+	definition, err := os.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(server.RegisterSchemaRequest{Schema: plog.Schema{
+		Type:       plog.SchemaType(*schemaType),
+		Definition: definition,
+		Message:    *message,
+	}})
+	if err != nil {
+		return err
+	}
+	var res server.RegisterSchemaResponse
+	if err = adminRequest(http.MethodPost, *addr+"/admin/schemas", bytes.NewReader(b), &res); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "registered schema version %d\n", res.Version)
+	return nil
+}
+
+func printSegments(w io.Writer, segments []plog.SegmentInfo) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BASE\tNEXT\tSTORE BYTES\tINDEX BYTES\tSTATE")
+	for _, s := range segments {
+		var state []string
+		if s.Active {
+			state = append(state, "active")
+		}
+		if s.Local {
+			state = append(state, "local")
+		}
+		if s.Remote {
+			state = append(state, "remote")
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%s\n",
+			s.BaseOffset, s.NextOffset, s.StoreBytes, s.IndexBytes, strings.Join(state, ","))
+	}
+	tw.Flush()
+}
+
+// adminRequest sends a request to an admin endpoint and decodes its JSON response into `v`.
+func adminRequest(method, url string, body io.Reader, v interface{}) error {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, url, res.Status, bytes.TrimSpace(b))
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func main() {
+	err := handleCommand(os.Stdout, os.Args[1:])
+	if err != nil {
+		if !errors.Is(err, errInvalidSubCommand) && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	plog "github.com/lucaspere/go_projects/proglog/internal/log"
+	"github.com/lucaspere/go_projects/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaRegister(t *testing.T) {
+	commitLog, err := plog.NewLog(t.TempDir(), plog.Config{})
+	require.NoError(t, err)
+	defer commitLog.Close()
+	srv := httptest.NewServer(server.NewHTTPServer("", server.Config{CommitLog: commitLog}).Handler)
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "schema.json")
+	require.NoError(t, os.WriteFile(file, []byte(`{"type": "object"}`), 0644))
+	var out bytes.Buffer
+	err = handleCommand(&out, []string{"schema", "register", "-addr", srv.URL, "-file", file})
+	require.NoError(t, err)
+	require.Equal(t, "registered schema version 1\n", out.String())
+	schemas := commitLog.Schemas()
+	require.Len(t, schemas, 1)
+	require.Equal(t, plog.SchemaJSON, schemas[0].Type)
+	require.JSONEq(t, `{"type": "object"}`, string(schemas[0].Definition))
+
+	// the server rejects schemas it can't compile
+	require.NoError(t, os.WriteFile(file, []byte(`{"type": 12}`), 0644))
+	err = handleCommand(&out, []string{"schema", "register", "-addr", srv.URL, "-file", file})
+	require.ErrorContains(t, err, "400 Bad Request")
+
+	out.Reset()
+	err = handleCommand(&out, []string{"schema", "unknown"})
+	require.ErrorIs(t, err, errInvalidSubCommand)
+}
@@ -1,12 +1,69 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
+	"os"
 
+	plog "github.com/lucaspere/go_projects/proglog/internal/log"
+	"github.com/lucaspere/go_projects/proglog/internal/objstore"
+	"github.com/lucaspere/go_projects/proglog/internal/quota"
 	"github.com/lucaspere/go_projects/proglog/internal/server"
 )
 
+// limiter returns the producers' limiter configured by the JSON quota file at QUOTA_CONFIG,
+// producers aren't throttled when it isn't set.
+func limiter() (*quota.Limiter, error) {
+	name := os.Getenv("QUOTA_CONFIG")
+	if len(name) == 0 {
+		return nil, nil
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var c quota.Config
+	if err = json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return quota.NewLimiter(c), nil
+}
+
 func main() {
-	srv := server.NewHTTPServer(":8080")
+	dir := os.Getenv("LOG_DIR")
+	if len(dir) == 0 {
+		dir = "data"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	c := plog.Config{}
+	store, err := objstore.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if store != nil {
+		c.Tier.Store = store
+	}
+	if keyfile := os.Getenv("ENCRYPTION_KEYFILE"); len(keyfile) > 0 {
+		if c.Encryption.Keys, err = plog.LoadKeyFile(keyfile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	commitLog, err := plog.NewLog(dir, c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	limiter, err := limiter()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := server.NewHTTPServer(":8080", server.Config{
+		CommitLog: commitLog,
+		Topic:     os.Getenv("TOPIC"),
+		Limiter:   limiter,
+	})
 	log.Fatal((srv.ListenAndServe()))
 }
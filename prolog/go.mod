@@ -2,12 +2,18 @@ module github.com/lucaspere/go_projects/proglog
 
 go 1.20
 
+require (
+	github.com/gorilla/mux v1.8.0
+	github.com/stretchr/testify v1.8.2
+	github.com/tysonmote/gommap v0.0.2
+	github.com/xeipuuv/gojsonschema v1.2.0
+	google.golang.org/protobuf v1.30.0
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.8.2 // indirect
-	github.com/tysonmote/gommap v0.0.2 // indirect
-	google.golang.org/protobuf v1.30.0 // indirect
+	github.com/xeipuuv/gojsonpointer v0.0.0-20180127040702-4e3ac2762d5f // indirect
+	github.com/xeipuuv/gojsonreference v0.0.0-20180127040603-bd5ef7bd5415 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
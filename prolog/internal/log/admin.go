@@ -0,0 +1,125 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// startOffsetFile is the checkpoint, in the log's directory, holding the log start offset.
+const startOffsetFile = "start-offset.checkpoint"
+
+// SegmentInfo describes a segment of the log, `NextOffset` being the offset following its last record.
+// Offloaded segments are `Remote`, and they're also `Local` while a copy is kept on disk.
+type SegmentInfo struct {
+	BaseOffset uint64 `json:"base_offset"`
+	NextOffset uint64 `json:"next_offset"`
+	// StoreBytes and IndexBytes are the sizes of the local files.
+	StoreBytes uint64 `json:"store_bytes,omitempty"`
+	IndexBytes uint64 `json:"index_bytes,omitempty"`
+	Active     bool   `json:"active"`
+	Local      bool   `json:"local"`
+	Remote     bool   `json:"remote"`
+}
+
+func loadStartOffset(fs FS, dir string) (uint64, error) {
+	b, err := readFile(fs, path.Join(dir, startOffsetFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+func writeStartOffset(fs FS, dir string, off uint64) error {
+	return writeFileAtomic(fs, path.Join(dir, startOffsetFile), []byte(strconv.FormatUint(off, 10)+"\n"))
+}
+
+// SetStartOffset moves the log start offset forward to `off`, which hides the records below it from
+// reads right away even when they share a segment with the records above. The offset is checkpointed
+// in the log's directory, and the segments holding hidden records only are removed, remote ones included.
+// Moving the start offset backward does nothing, and it can't go past the end of the log.
+func (l *Log) SetStartOffset(off uint64) error {
+	l.retain.Lock()
+	defer l.retain.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if next := l.activeSegment.nextOffset; off > next {
+		return fmt.Errorf("%w: %d is past the end of the log at %d", ErrOffsetOutOfRange, off, next)
+	}
+	if off <= l.startOffset {
+		return nil
+	}
+	if err := writeStartOffset(l.Config.fs(), l.Dir, off); err != nil {
+		return err
+	}
+	l.startOffset = off
+
+	var segments []*segment
+	for _, s := range l.segments {
+		if s != l.activeSegment && s.nextOffset <= off {
+			if err := s.Remove(); err != nil {
+				return err
+			}
+			continue
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	return l.truncateRemote(off - 1)
+}
+
+// Segments lists the segments of the log, remote ones included, ordered by base offset.
+func (l *Log) Segments() []SegmentInfo {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var infos []SegmentInfo
+	for _, r := range l.remote {
+		if len(l.segments) > 0 && r.baseOffset >= l.segments[0].baseOffset {
+			break
+		}
+		infos = append(infos, SegmentInfo{
+			BaseOffset: r.baseOffset,
+			NextOffset: r.nextOffset,
+			Remote:     true,
+		})
+	}
+	for _, s := range l.segments {
+		infos = append(infos, SegmentInfo{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			StoreBytes: s.store.size,
+			IndexBytes: s.index.size,
+			Active:     s == l.activeSegment,
+			Local:      true,
+			Remote:     l.isRemote(s.baseOffset),
+		})
+	}
+	return infos
+}
+
+// Roll seals the active segment and starts a new one, as if the active segment was maxed.
+// An empty active segment is kept.
+func (l *Log) Roll() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.activeSegment
+	if s.nextOffset == s.baseOffset {
+		return nil
+	}
+	if err := s.Seal(); err != nil {
+		return err
+	}
+	if err := l.newSegment(s.nextOffset); err != nil {
+		return err
+	}
+	if err := l.checkpointProducers(); err != nil {
+		return err
+	}
+	l.notifyOffload()
+	return nil
+}
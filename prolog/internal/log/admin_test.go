@@ -0,0 +1,134 @@
+package log
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	api "github.com/lucaspere/go_projects/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogStartOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "start-offset-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	// three records per segment
+	c.Segment.MaxStoreBytes = 60
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.Segments(), 3)
+
+	// mid-segment
+	require.NoError(t, log.SetStartOffset(4))
+	_, err = log.Read(3)
+	require.True(t, errors.Is(err, ErrOffsetOutOfRange))
+	_, err = log.Read(4)
+	require.NoError(t, err)
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	// the first segment only held hidden records
+	segments := log.Segments()
+	require.Len(t, segments, 2)
+	require.Equal(t, uint64(3), segments[0].BaseOffset)
+
+	// never backward nor past the end
+	require.NoError(t, log.SetStartOffset(2))
+	require.True(t, errors.Is(log.SetStartOffset(9), ErrOffsetOutOfRange))
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	off, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	_, err = log.Read(3)
+	require.True(t, errors.Is(err, ErrOffsetOutOfRange))
+}
+
+// removeFailFS is the OS's filesystem, except that removing the file named `fail` fails.
+type removeFailFS struct {
+	osFS
+	fail string
+}
+
+func (fs removeFailFS) Remove(name string) error {
+	if path.Base(name) == fs.fail {
+		return syscall.EIO
+	}
+	return fs.osFS.Remove(name)
+}
+
+func TestLogStartOffsetRemoveFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "start-offset-remove-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 60
+	c.FS = removeFailFS{fail: "3.store"}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 8; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	bases := func() []uint64 {
+		var bases []uint64
+		for _, s := range log.segments {
+			bases = append(bases, s.baseOffset)
+		}
+		return bases
+	}
+	require.Equal(t, []uint64{0, 3, 6}, bases())
+
+	// the segments are left as they were, the records below the start offset are hidden anyway
+	require.True(t, errors.Is(log.SetStartOffset(7), syscall.EIO))
+	require.Equal(t, []uint64{0, 3, 6}, bases())
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+	read, err := log.Read(7)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), read.Offset)
+}
+
+func TestLogRoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	// an empty active segment is kept
+	require.NoError(t, log.Roll())
+	require.Len(t, log.Segments(), 1)
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Roll())
+	segments := log.Segments()
+	require.Len(t, segments, 2)
+	require.False(t, segments[0].Active)
+	require.Equal(t, uint64(1), segments[0].NextOffset)
+	require.True(t, segments[1].Active)
+	require.Equal(t, uint64(1), segments[1].BaseOffset)
+
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+}
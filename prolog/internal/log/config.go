@@ -1,9 +1,33 @@
 package log
 
+import "github.com/lucaspere/go_projects/proglog/internal/objstore"
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// IndexVersion selects the on-disk format of the indexes created for new segments.
+		// Existing indexes keep the format they were written with.
+		IndexVersion IndexVersion
+		// IndexIntervalBytes makes new indexes sparse when it is greater than zero:
+		// an entry is only written once at least this many store bytes were appended since the previous entry.
+		IndexIntervalBytes uint64
+	}
+	Tier struct {
+		// Store receives the sealed segments, they stay on local disk when it's nil.
+		Store objstore.ObjectStore
+		// LocalSegments is the number of offloaded sealed segments kept on local disk.
+		// It defaults to 2, and a negative number keeps none.
+		LocalSegments int
+		// CacheSegments is the number of remote segments kept on local disk after being fetched by reads.
+		// It defaults to 2.
+		CacheSegments int
+	}
+	Encryption struct {
+		// Keys encrypts the records of new segments when it's set, it's also required to read encrypted segments.
+		Keys KeyProvider
 	}
+	// FS opens the files of the segments, it defaults to the OS's filesystem.
+	FS FS
 }
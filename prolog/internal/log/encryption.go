@@ -0,0 +1,392 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	api "github.com/lucaspere/go_projects/proglog/api/v1"
+	"github.com/lucaspere/go_projects/proglog/internal/objstore"
+)
+
+// dataKeySize is the size of the AES-256 keys generated for each segment.
+const dataKeySize = 32
+
+// ErrNoKeyProvider is returned when opening an encrypted segment without a `KeyProvider`.
+var ErrNoKeyProvider = errors.New("segment is encrypted but no key provider is configured")
+
+// KeyProvider gives access to the master keys that encrypt the segments' data keys.
+//
+// Each segment's records are encrypted with AES-GCM under a data key of their own, and the data key is stored
+// next to the segment, encrypted under a master key. Rotating the master key only rewraps the data keys,
+// `Reencrypt` rotates the data keys themselves.
+type KeyProvider interface {
+	// CurrentKey returns the ID and the master key the data keys of new segments are wrapped with.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the master key with the given ID.
+	Key(id string) ([]byte, error)
+}
+
+// KeyFile is a `KeyProvider` whose master keys are read from a JSON file such as:
+//
+//	{"current": "2023-04", "keys": {"2023-01": "<base64 key>", "2023-04": "<base64 key>"}}
+//
+// Keys are 16, 24 or 32 bytes long.
+type KeyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// LoadKeyFile reads the master keys from the file at `name`.
+func LoadKeyFile(name string) (*KeyFile, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	kf := &KeyFile{}
+	if err = json.Unmarshal(b, kf); err != nil {
+		return nil, err
+	}
+	if _, ok := kf.Keys[kf.Current]; !ok {
+		return nil, fmt.Errorf("keyfile %s: current key %q not found", name, kf.Current)
+	}
+	return kf, nil
+}
+
+func (kf *KeyFile) CurrentKey() (string, []byte, error) {
+	key, err := kf.Key(kf.Current)
+	return kf.Current, key, err
+}
+
+func (kf *KeyFile) Key(id string) ([]byte, error) {
+	key, ok := kf.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+// segmentKey is the content of a segment's `.key` file: the ID of the master key and the wrapped data key.
+type segmentKey struct {
+	KeyID      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// openSegmentCipher returns the cipher of the segment whose key file is `name`.
+// A key is generated for new segments when `keys` is set, and a nil cipher means the segment is in plain text.
+func openSegmentCipher(fs FS, name string, fresh bool, keys KeyProvider) (cipher.AEAD, error) {
+	b, err := readFile(fs, name)
+	if os.IsNotExist(err) {
+		if !fresh || keys == nil {
+			return nil, nil
+		}
+		return newSegmentKey(fs, name, keys)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		return nil, ErrNoKeyProvider
+	}
+	sk := segmentKey{}
+	if err = json.Unmarshal(b, &sk); err != nil {
+		return nil, err
+	}
+	master, err := keys.Key(sk.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := unwrap(master, sk.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(dataKey)
+}
+
+func newSegmentKey(fs FS, name string, keys KeyProvider) (cipher.AEAD, error) {
+	id, master, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err = rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	if err = writeSegmentKey(fs, name, id, master, dataKey); err != nil {
+		return nil, err
+	}
+	return newGCM(dataKey)
+}
+
+func writeSegmentKey(fs FS, name, id string, master, dataKey []byte) error {
+	wrapped, err := wrap(master, dataKey)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(segmentKey{KeyID: id, WrappedKey: wrapped})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fs, name, b)
+}
+
+// Rekey rewraps the data keys of the segments in `dir`, and of the segments in `c.Tier.Store` when it's set,
+// that aren't under the current master key of `c.Encryption.Keys`, so the old master keys can be retired.
+// It returns the number of rewrapped segments, counting a segment once for each copy.
+func Rekey(dir string, c Config) (int, error) {
+	keys := c.Encryption.Keys
+	if keys == nil {
+		return 0, ErrNoKeyProvider
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.key"))
+	if err != nil {
+		return 0, err
+	}
+	id, current, err := keys.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, name := range names {
+		b, err := readFile(c.fs(), name)
+		if err != nil {
+			return n, err
+		}
+		b, err = rewrap(b, keys, id, current)
+		if err != nil {
+			return n, fmt.Errorf("%s: %w", name, err)
+		}
+		if b == nil {
+			continue
+		}
+		if err = writeFileAtomic(c.fs(), name, b); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if c.Tier.Store == nil {
+		return n, nil
+	}
+	ctx := context.Background()
+	objects, err := c.Tier.Store.List(ctx, "")
+	if err != nil {
+		return n, err
+	}
+	for _, key := range objects {
+		if !strings.HasSuffix(key, ".key") {
+			continue
+		}
+		b, err := getObject(ctx, c.Tier.Store, key)
+		if err != nil {
+			return n, err
+		}
+		b, err = rewrap(b, keys, id, current)
+		if err != nil {
+			return n, fmt.Errorf("%s: %w", key, err)
+		}
+		if b == nil {
+			continue
+		}
+		if err = c.Tier.Store.Put(ctx, key, bytes.NewReader(b), int64(len(b))); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// rewrap returns the key file `b` with its data key wrapped under the master key `current`, or nil when it already is.
+func rewrap(b []byte, keys KeyProvider, id string, current []byte) ([]byte, error) {
+	sk := segmentKey{}
+	if err := json.Unmarshal(b, &sk); err != nil {
+		return nil, err
+	}
+	if sk.KeyID == id {
+		return nil, nil
+	}
+	old, err := keys.Key(sk.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := unwrap(old, sk.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := wrap(current, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(segmentKey{KeyID: id, WrappedKey: wrapped})
+}
+
+func getObject(ctx context.Context, store objstore.ObjectStore, key string) ([]byte, error) {
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// reencryptDir holds, inside the log's directory, the segment being rewritten by `Reencrypt`.
+// It's renamed to `reencryptDoneDir` once the segment is complete, which commits the rewrite:
+// its files then replace the segment's, and opening the log finishes the swap after a crash.
+const (
+	reencryptDir     = "reencrypt"
+	reencryptDoneDir = "reencrypt.done"
+)
+
+// Reencrypt rewrites the sealed segments in `dir` under fresh data keys wrapped with the current master key
+// of `c.Encryption.Keys`: each segment's records are appended to a new segment, whose files then replace the
+// segment's. It encrypts the segments written in plain text and rotates out compromised data keys.
+// The active segment is left as it is, roll it first. The log must not be open, and the segments
+// offloaded to `c.Tier.Store` can't be rewritten, Reencrypt fails when there are some.
+// It returns the number of rewritten segments.
+func Reencrypt(dir string, c Config) (int, error) {
+	if c.Encryption.Keys == nil {
+		return 0, ErrNoKeyProvider
+	}
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = 1024
+	}
+	if c.Tier.Store != nil {
+		objects, err := c.Tier.Store.List(context.Background(), "")
+		if err != nil {
+			return 0, err
+		}
+		if len(objects) > 0 {
+			return 0, fmt.Errorf("reencrypt: %d objects were offloaded to the tier's object store", len(objects))
+		}
+	}
+	if err := finishReencrypt(c.fs(), dir); err != nil {
+		return 0, err
+	}
+	l := &Log{Dir: dir}
+	baseOffsets, err := l.baseOffsets()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	// the last segment is the active one
+	for i := 0; i+1 < len(baseOffsets); i++ {
+		if err = reencryptSegment(dir, baseOffsets[i], c); err != nil {
+			return n, fmt.Errorf("reencrypt segment %d: %w", baseOffsets[i], err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// reencryptSegment rewrites the segment starting at `baseOffset` under a fresh data key.
+func reencryptSegment(dir string, baseOffset uint64, c Config) (err error) {
+	tmp := filepath.Join(dir, reencryptDir)
+	if err = os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err = os.Mkdir(tmp, 0755); err != nil {
+		return err
+	}
+	old, err := newSegment(dir, baseOffset, c)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := old.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	// the rewritten index keeps the format of the segment's
+	nc := c
+	nc.Segment.IndexVersion = old.index.version
+	nc.Segment.IndexIntervalBytes = old.index.interval
+	s, err := newSegment(tmp, baseOffset, nc)
+	if err != nil {
+		return err
+	}
+	if err = old.Scan(func(record *api.Record) error {
+		_, err := s.Append(record)
+		return err
+	}); err != nil {
+		s.Close()
+		return err
+	}
+	if err = s.Close(); err != nil {
+		return err
+	}
+	if err = c.fs().Rename(tmp, filepath.Join(dir, reencryptDoneDir)); err != nil {
+		return err
+	}
+	return finishReencrypt(c.fs(), dir)
+}
+
+// finishReencrypt moves the files of a segment rewritten by `Reencrypt` over the segment's, if there's one.
+func finishReencrypt(fs FS, dir string) error {
+	done := filepath.Join(dir, reencryptDoneDir)
+	entries, err := os.ReadDir(done)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err = fs.Rename(filepath.Join(done, e.Name()), filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(done)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func wrap(master, dataKey []byte) ([]byte, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, dataKey, nil)
+}
+
+func unwrap(master, wrapped []byte) ([]byte, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, wrapped, nil)
+}
+
+// seal encrypts `p` with a random nonce, which prefixes the returned ciphertext.
+func seal(aead cipher.AEAD, p, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(p)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, p, ad), nil
+}
+
+func open(aead cipher.AEAD, c, ad []byte) ([]byte, error) {
+	if len(c) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, c[:aead.NonceSize()], c[aead.NonceSize():], ad)
+}
+
+// keyFileName returns the name of the key file of the segment whose store is `storeName`.
+func keyFileName(storeName string) string {
+	return strings.TrimSuffix(storeName, ".store") + ".key"
+}
@@ -0,0 +1,233 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/lucaspere/go_projects/proglog/api/v1"
+	"github.com/lucaspere/go_projects/proglog/internal/objstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keys := &KeyFile{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+		},
+	}
+	c := Config{}
+	c.Segment.MaxStoreBytes = 256
+	c.Encryption.Keys = keys
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	secret := []byte("social security number")
+	for i := uint64(0); i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: secret})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	stores, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, f := range stores {
+		if path.Ext(f.Name()) != ".store" {
+			continue
+		}
+		b, err := os.ReadFile(path.Join(dir, f.Name()))
+		require.NoError(t, err)
+		require.NotContains(t, string(b), string(secret))
+	}
+
+	_, err = NewLog(dir, Config{})
+	require.Equal(t, ErrNoKeyProvider, err)
+
+	// rotate the master key, the old one is still needed until the segments are rewrapped
+	keys.Keys["k2"] = bytes.Repeat([]byte{2}, 32)
+	keys.Current = "k2"
+	n, err := Rekey(dir, c)
+	require.NoError(t, err)
+	require.Greater(t, n, 1)
+	n, err = Rekey(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	delete(keys.Keys, "k1")
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := uint64(0); i < 10; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, secret, read.Value)
+	}
+
+	// snapshots carry the segments' keys
+	var buf bytes.Buffer
+	require.NoError(t, log.Snapshot(&buf))
+	restored := path.Join(dir, "restored")
+	require.NoError(t, Restore(restored, &buf))
+	n2, err := NewLog(restored, c)
+	require.NoError(t, err)
+	defer n2.Close()
+	read, err := n2.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, secret, read.Value)
+}
+
+func TestEncryptionRekeyRemote(t *testing.T) {
+	dir := t.TempDir()
+	remote, err := objstore.NewLocal(t.TempDir())
+	require.NoError(t, err)
+
+	keys := &KeyFile{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+		},
+	}
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Encryption.Keys = keys
+	c.Tier.Store = remote
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Offload())
+	require.NoError(t, log.Close())
+
+	// the remote key objects are rewrapped along with the local key files
+	keys.Keys["k2"] = bytes.Repeat([]byte{2}, 32)
+	keys.Current = "k2"
+	_, err = Rekey(dir, c)
+	require.NoError(t, err)
+	delete(keys.Keys, "k1")
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.NotEmpty(t, log.remote)
+	require.Greater(t, log.remote[0].nextOffset, uint64(0))
+	read, err := log.readRemote(log.remote[0], 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+
+	// offloaded segments can't be rewritten
+	_, err = Reencrypt(dir, c)
+	require.Error(t, err)
+}
+
+func TestEncryptionReencrypt(t *testing.T) {
+	dir := t.TempDir()
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	secret := []byte("social security number")
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: secret})
+		require.NoError(t, err)
+	}
+	segments := len(log.Segments())
+	require.NoError(t, log.Close())
+	plain, err := os.ReadFile(path.Join(dir, "0.store"))
+	require.NoError(t, err)
+	require.Contains(t, string(plain), string(secret))
+
+	// the plain text segments are encrypted, the active one is left as it is
+	c.Encryption.Keys = &KeyFile{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+		},
+	}
+	n, err := Reencrypt(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, segments-1, n)
+	b, err := os.ReadFile(path.Join(dir, "0.store"))
+	require.NoError(t, err)
+	require.NotContains(t, string(b), string(secret))
+	key, err := os.ReadFile(path.Join(dir, "0.key"))
+	require.NoError(t, err)
+
+	// rewriting again rotates the data keys
+	_, err = Reencrypt(dir, c)
+	require.NoError(t, err)
+	rotated, err := os.ReadFile(path.Join(dir, "0.key"))
+	require.NoError(t, err)
+	require.NotEqual(t, key, rotated)
+
+	// a crash once the rewrite is committed may leave the old store in place, opening the log finishes the swap
+	done := path.Join(dir, reencryptDoneDir)
+	require.NoError(t, os.Mkdir(done, 0755))
+	for _, ext := range []string{".store", ".index", ".key"} {
+		require.NoError(t, os.Rename(path.Join(dir, "0"+ext), path.Join(done, "0"+ext)))
+	}
+	require.NoError(t, os.WriteFile(path.Join(dir, "0.store"), plain, 0644))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = os.Stat(done)
+	require.True(t, os.IsNotExist(err))
+	for i := uint64(0); i < 10; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+		require.Equal(t, secret, read.Value)
+	}
+}
+
+func TestEncryptionAuthenticatesOffset(t *testing.T) {
+	dataKey := bytes.Repeat([]byte{3}, dataKeySize)
+	aead, err := newGCM(dataKey)
+	require.NoError(t, err)
+	s := &segment{aead: aead}
+
+	p, err := s.encode(&api.Record{Value: []byte("hello world"), Offset: 4})
+	require.NoError(t, err)
+	_, err = s.decode(5, p)
+	require.Error(t, err)
+	read, err := s.decode(4, p)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "keyfile")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	require.NoError(t, json.NewEncoder(f).Encode(KeyFile{
+		Current: "missing",
+		Keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+	}))
+	_, err = LoadKeyFile(f.Name())
+	require.Error(t, err)
+
+	require.NoError(t, f.Truncate(0))
+	_, err = f.Seek(0, 0)
+	require.NoError(t, err)
+	require.NoError(t, json.NewEncoder(f).Encode(KeyFile{
+		Current: "k1",
+		Keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+	}))
+	kf, err := LoadKeyFile(f.Name())
+	require.NoError(t, err)
+	id, key, err := kf.CurrentKey()
+	require.NoError(t, err)
+	require.Equal(t, "k1", id)
+	require.Len(t, key, 32)
+}
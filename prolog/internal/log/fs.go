@@ -0,0 +1,119 @@
+package log
+
+import (
+	"io"
+	"os"
+)
+
+// FS is the filesystem the segments' stores and indexes are opened through, snapshots and restores too.
+// It defaults to the OS's, tests replace it to inject faults and crashes.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	// Link creates `newname` as a hard link to the file `oldname`.
+	Link(oldname, newname string) error
+	// MkdirTemp creates a new directory in `dir` whose name starts with `pattern`, and returns its path.
+	MkdirTemp(dir, pattern string) (string, error)
+	// RemoveAll removes `path` and everything it contains, it doesn't fail when `path` doesn't exist.
+	RemoveAll(path string) error
+}
+
+// File is a file opened by an `FS`.
+// Indexes and sealed stores are memory mapped through `Fd`, their writes and reads
+// through the mapping don't go through the `File`.
+type File interface {
+	io.Writer
+	io.ReaderAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+	Fd() uintptr
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) MkdirTemp(dir, pattern string) (string, error) {
+	return os.MkdirTemp(dir, pattern)
+}
+
+func (osFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+// fs returns the filesystem of the config, the OS's when it isn't set.
+func (c Config) fs() FS {
+	if c.FS == nil {
+		return osFS{}
+	}
+	return c.FS
+}
+
+// readFile reads the whole file through `fs`.
+func readFile(fs FS, name string) ([]byte, error) {
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, fi.Size())
+	if n, err := f.ReadAt(b, 0); n < len(b) {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeFile writes `b` to the file at `name` through `fs`, creating or truncating it.
+func writeFile(fs FS, name string, b []byte) error {
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFileAtomic replaces the file at `name` with `b` through `fs`, readers see either the old or the new content.
+func writeFileAtomic(fs FS, name string, b []byte) error {
+	tmp := name + ".tmp"
+	f, err := fs.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fs.Remove(tmp)
+		return err
+	}
+	return fs.Rename(tmp, name)
+}
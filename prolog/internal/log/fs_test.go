@@ -0,0 +1,269 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// errCrashed is returned by every operation of a `faultFS` once its simulated crash happened.
+var errCrashed = errors.New("simulated crash")
+
+// fileState is what a `faultFS` knows about the durability of a file.
+type fileState struct {
+	// synced is the content of the file at its last sync
+	synced []byte
+	// durable is false until the file is synced for the first time, a crash removes it until then
+	durable bool
+}
+
+// faultFS is an `FS` over the OS's whose writes, syncs and truncations fail at random, and which
+// simulates crashes: `Crash` rewrites every file with what could be left on disk after a power loss.
+// Faults are drawn from a seeded source so failing runs can be replayed.
+type faultFS struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+	// failRate is the probability of each write, sync and truncation to fail
+	failRate float64
+	// crashAfter is the number of operations left before the crash, after which every
+	// operation fails with `errCrashed`. It's disabled when negative.
+	crashAfter int
+	files      map[string]*fileState
+	open       []*os.File
+}
+
+func newFaultFS(seed int64) *faultFS {
+	return &faultFS{
+		rng:        rand.New(rand.NewSource(seed)),
+		crashAfter: -1,
+		files:      make(map[string]*fileState),
+	}
+}
+
+// arm enables the faults, and a crash after a random number of operations below `maxOps`.
+func (fs *faultFS) arm(failRate float64, maxOps int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.failRate = failRate
+	fs.crashAfter = fs.rng.Intn(maxOps)
+}
+
+// disarm disables the faults and the crash.
+func (fs *faultFS) disarm() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.failRate = 0
+	fs.crashAfter = -1
+}
+
+// fault returns the error the next operation fails with, or nil.
+func (fs *faultFS) fault(err error) error {
+	if fs.crashAfter == 0 {
+		return errCrashed
+	}
+	if fs.crashAfter > 0 {
+		fs.crashAfter--
+	}
+	if fs.rng.Float64() < fs.failRate {
+		return err
+	}
+	return nil
+}
+
+func (fs *faultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.crashAfter == 0 {
+		return nil, errCrashed
+	}
+	if _, ok := fs.files[name]; !ok {
+		// files that were there before the filesystem are durable
+		b, err := os.ReadFile(name)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		fs.files[name] = &fileState{synced: b, durable: err == nil}
+	}
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fs.open = append(fs.open, f)
+	return &faultFile{File: f, fs: fs}, nil
+}
+
+func (fs *faultFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.fault(syscall.EIO); err != nil {
+		return err
+	}
+	delete(fs.files, name)
+	return os.Remove(name)
+}
+
+// Rename moves the file and what's known about its durability, renames are taken as atomic and durable.
+func (fs *faultFS) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.fault(syscall.EIO); err != nil {
+		return err
+	}
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	if st, ok := fs.files[oldpath]; ok {
+		fs.files[newpath] = st
+		delete(fs.files, oldpath)
+	}
+	return nil
+}
+
+// Link links the file, crashes leave the link as it is.
+func (fs *faultFS) Link(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.fault(syscall.EIO); err != nil {
+		return err
+	}
+	return os.Link(oldname, newname)
+}
+
+func (fs *faultFS) MkdirTemp(dir, pattern string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.fault(syscall.EIO); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(dir, pattern)
+}
+
+// RemoveAll removes the directory and forgets about the files it held.
+func (fs *faultFS) RemoveAll(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.fault(syscall.EIO); err != nil {
+		return err
+	}
+	for name := range fs.files {
+		if name == path || strings.HasPrefix(name, path+string(os.PathSeparator)) {
+			delete(fs.files, name)
+		}
+	}
+	return os.RemoveAll(path)
+}
+
+// Crash closes every file and reverts them to a state a crash could have left them in: the files
+// never synced are gone, and the others hold the content of their last sync overwritten by the
+// writes since, which reached the disk in order up to a random point. The faults are disabled.
+func (fs *faultFS) Crash() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, f := range fs.open {
+		f.Close()
+	}
+	fs.open = nil
+	fs.failRate = 0
+	fs.crashAfter = -1
+	// visit the files in order so runs replay
+	names := make([]string, 0, len(fs.files))
+	for name := range fs.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		st := fs.files[name]
+		if !st.durable {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			delete(fs.files, name)
+			continue
+		}
+		cur, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		cut := fs.rng.Intn(len(cur) + 1)
+		b := append([]byte(nil), cur[:cut]...)
+		if cut < len(st.synced) {
+			b = append(b, st.synced[cut:]...)
+		}
+		st.synced = b
+		if bytes.Equal(b, cur) {
+			continue
+		}
+		// rewrite a new file, the memory mappings of the crashed log
+		// keep pointing at the old one
+		if err = os.WriteFile(name+".crash", b, 0644); err != nil {
+			return err
+		}
+		if err = os.Rename(name+".crash", name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// faultFile is a file opened by a `faultFS`. Reads aren't faulted.
+type faultFile struct {
+	*os.File
+	fs *faultFS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	err := f.fs.fault(io.ErrShortWrite)
+	if err == io.ErrShortWrite && f.fs.rng.Intn(2) == 0 {
+		err = syscall.ENOSPC
+	}
+	n := 0
+	if err == io.ErrShortWrite && len(p) > 0 {
+		n = f.fs.rng.Intn(len(p))
+	}
+	f.fs.mu.Unlock()
+	switch err {
+	case nil:
+		return f.File.Write(p)
+	case io.ErrShortWrite:
+		n, werr := f.File.Write(p[:n])
+		if werr != nil {
+			return n, werr
+		}
+		return n, err
+	default:
+		return 0, err
+	}
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.fs.fault(syscall.EIO); err != nil {
+		return err
+	}
+	// the durability is simulated, skip the real sync
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		return err
+	}
+	if st, ok := f.fs.files[f.Name()]; ok {
+		st.synced, st.durable = b, true
+	}
+	return nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.fs.fault(syscall.EIO); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
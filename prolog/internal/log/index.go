@@ -1,8 +1,11 @@
 package log
 
 import (
+	"bytes"
+	"errors"
 	"io"
-	"os"
+	"math"
+	"sort"
 
 	"github.com/tysonmote/gommap"
 )
@@ -11,23 +14,55 @@ var (
 	offWidth uint64 = 4
 	posWidth uint64 = 8
 	entWidth        = offWidth + posWidth
+
+	// v2 indexes store 8-byte relative offsets.
+	offWidthV2 uint64 = 8
+	entWidthV2        = offWidthV2 + posWidth
+
+	// The header is made of the magic, the version, three reserved bytes and the sparse interval.
+	indexMagic         = []byte("PIDX")
+	hdrWidth    uint64 = 16
+	hdrVerPos   uint64 = 4
+	hdrIntvlPos uint64 = 8
+)
+
+// ErrIndexOffsetOverflow is returned when a relative offset doesn't fit in the index format.
+var ErrIndexOffsetOverflow = errors.New("relative offset overflows the index format")
+
+// IndexVersion identifies the on-disk format of an index file.
+type IndexVersion uint8
+
+const (
+	// IndexV1 stores 4-byte offsets relative to the segment's base offset, so a segment can't hold more than 2^32 records.
+	// Dense V1 indexes have no header, which keeps them compatible with the files written before versioning existed.
+	IndexV1 IndexVersion = iota + 1
+	// IndexV2 stores 8-byte relative offsets and always starts with a header.
+	IndexV2
 )
 
 // Index represents a log file that can be appended record indexes to and read from.
 //
 // The `file` pointer is the file that will be used to write and read.
 // It `mmap` is a Memory mapping that allows us to efficiently i/o operations in the file that it map to.
-// `size` is the amount of bytes in the `file`.
+// `size` is the amount of bytes in the `file`, header included.
+// `version`, `header` and `width` describe the layout of the file, and `interval` is the minimum amount of store bytes
+// between two entries of a sparse index (zero for a dense one). `lastPos` is the store position of the last entry.
 type index struct {
-	file *os.File
-	mmap gommap.MMap
-	size uint64
+	file     File
+	mmap     gommap.MMap
+	size     uint64
+	version  IndexVersion
+	header   uint64
+	width    uint64
+	interval uint64
+	lastPos  uint64
 }
 
 // `newIndex` creates a `index` struct with the `f` file pointer and trucates the its size basedo on `c.Segment.MaxIndexBytes`.
+// The format is read from the file's header when it already has entries, otherwise it's taken from `c`.
 // It also create a Memory mapping, and returns a index pointer or an error.
-func newIndex(f *os.File, c Config) (*index, error) {
-	fi, err := os.Stat(f.Name())
+func newIndex(f File, c Config) (*index, error) {
+	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
@@ -36,8 +71,26 @@ func newIndex(f *os.File, c Config) (*index, error) {
 		size: uint64(fi.Size()),
 	}
 
-	if err = os.Truncate(
-		f.Name(), int64(c.Segment.MaxIndexBytes),
+	fresh := idx.size == 0
+	if fresh {
+		idx.version = c.Segment.IndexVersion
+		idx.interval = c.Segment.IndexIntervalBytes
+		if idx.version == IndexV2 || idx.interval > 0 {
+			idx.header = hdrWidth
+		}
+	} else if err = idx.readHeader(); err != nil {
+		return nil, err
+	}
+	if idx.version == 0 {
+		idx.version = IndexV1
+	}
+	idx.width = entWidth
+	if idx.version == IndexV2 {
+		idx.width = entWidthV2
+	}
+
+	if err = f.Truncate(
+		int64(c.Segment.MaxIndexBytes),
 	); err != nil {
 		return nil, err
 	}
@@ -50,19 +103,63 @@ func newIndex(f *os.File, c Config) (*index, error) {
 		return nil, err
 	}
 
+	if fresh && idx.header > 0 {
+		if uint64(len(idx.mmap)) < idx.header {
+			return nil, io.EOF
+		}
+		copy(idx.mmap, indexMagic)
+		idx.mmap[hdrVerPos] = byte(idx.version)
+		enc.PutUint64(idx.mmap[hdrIntvlPos:hdrWidth], idx.interval)
+		idx.size = idx.header
+	}
+	if _, pos, err := idx.Read(-1); err == nil {
+		idx.lastPos = pos
+	}
+
 	return idx, nil
 }
 
+// `readHeader` detects the format of an existing index file.
+// Files that don't start with the magic are legacy dense V1 indexes.
+func (i *index) readHeader() error {
+	if i.size < hdrWidth {
+		return nil
+	}
+	hdr := make([]byte, hdrWidth)
+	if _, err := i.file.ReadAt(hdr, 0); err != nil {
+		return err
+	}
+	if !bytes.Equal(hdr[:hdrVerPos], indexMagic) {
+		return nil
+	}
+	i.header = hdrWidth
+	i.version = IndexVersion(hdr[hdrVerPos])
+	i.interval = enc.Uint64(hdr[hdrIntvlPos:hdrWidth])
+	if i.version != IndexV1 && i.version != IndexV2 {
+		return errors.New("unknown index version")
+	}
+	return nil
+}
+
+// `Sync` flushes the `mmap` and `file` data to the disk.
+func (i *index) Sync() error {
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	return i.file.Sync()
+}
+
 // `Close` method closes the file index.
 // Before it closed, it flush the `mmap` and `file` data to the disk.
 // It also truncate the file size with the current `index.size`.
 func (i *index) Close() error {
-	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+	if err := i.Sync(); err != nil {
 		return err
 	}
-	if err := i.file.Sync(); err != nil {
+	if err := i.mmap.UnsafeUnmap(); err != nil {
 		return err
 	}
+	i.mmap = nil
 	if err := i.file.Truncate(int64(i.size)); err != nil {
 		return err
 	}
@@ -72,38 +169,108 @@ func (i *index) Close() error {
 
 // `Read method` reads the file data from the memory mapping based on the `in` argument.
 // It returns the offset (`out`), position of the record (`pos`), and a error if it occurred.
-func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
-	if i.size == 0 {
+// Sparse indexes return the closest entry whose offset isn't greater than `in`, so `out` may be lower than `in`.
+func (i *index) Read(in int64) (out uint64, pos uint64, err error) {
+	entries := i.entries()
+	if entries == 0 {
 		return 0, 0, io.EOF
 	}
-	if in == -1 {
-		out = uint32((i.size / entWidth) - 1)
-	} else {
-		out = uint32(in)
+	var n uint64
+	switch {
+	case in == -1:
+		n = entries - 1
+	case i.interval > 0:
+		// the first entry whose offset is greater than `in` follows the one we want
+		j := sort.Search(int(entries), func(j int) bool {
+			off, _ := i.entry(uint64(j))
+			return off > uint64(in)
+		})
+		if j == 0 {
+			return 0, 0, io.EOF
+		}
+		n = uint64(j - 1)
+	default:
+		n = uint64(in)
 	}
-	pos = uint64(out) * entWidth
-	if i.size < pos+entWidth {
+	if n >= entries {
 		return 0, 0, io.EOF
 	}
-	out = enc.Uint32(i.mmap[pos : pos+offWidth])
-	pos = enc.Uint64(i.mmap[pos+offWidth : pos+entWidth])
+	out, pos = i.entry(n)
 	return out, pos, nil
 }
 
 // `Write` method writes the record's offset (`pos`) and its position (`pos`) in index file.
+// Sparse indexes skip the record when it's within `interval` bytes of the last entry.
 // It returns immediately a error if it occurred.
-func (i *index) Write(off uint32, pos uint64) error {
-	if uint64(len(i.mmap)) < i.size+entWidth {
+func (i *index) Write(off uint64, pos uint64) error {
+	if i.interval > 0 && i.entries() > 0 && pos-i.lastPos < i.interval {
+		return nil
+	}
+	if !i.fits(off) {
+		return ErrIndexOffsetOverflow
+	}
+	if uint64(len(i.mmap)) < i.size+i.width {
 		return io.EOF
 	}
 
-	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
-	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
-	i.size += uint64(entWidth)
+	ent := i.mmap[i.size : i.size+i.width]
+	if i.version == IndexV2 {
+		enc.PutUint64(ent[:offWidthV2], off)
+		enc.PutUint64(ent[offWidthV2:], pos)
+	} else {
+		enc.PutUint32(ent[:offWidth], uint32(off))
+		enc.PutUint64(ent[offWidth:], pos)
+	}
+	i.size += i.width
+	i.lastPos = pos
 
 	return nil
 }
 
+// `fits` reports whether the relative offset `off` can be stored by the index format.
+// `trim` drops the entries a crash left behind: the ones pointing at or past `storeSize`, and the
+// preallocated space of a file that wasn't truncated on close, whose zeroed entries don't increase.
+// The dropped entries are zeroed so they can't be mistaken for valid ones later.
+func (i *index) trim(storeSize uint64) {
+	var n, prevOff, prevPos uint64
+	for ; n < i.entries(); n++ {
+		off, pos := i.entry(n)
+		if pos >= storeSize {
+			break
+		}
+		if n == 0 && (off != 0 || pos != 0) || n > 0 && (off <= prevOff || pos <= prevPos) {
+			break
+		}
+		prevOff, prevPos = off, pos
+	}
+	size := i.header + n*i.width
+	end := i.size
+	if end > uint64(len(i.mmap)) {
+		end = uint64(len(i.mmap))
+	}
+	for j := size; j < end; j++ {
+		i.mmap[j] = 0
+	}
+	i.size = size
+	i.lastPos = prevPos
+}
+
+func (i *index) fits(off uint64) bool {
+	return i.version == IndexV2 || off <= math.MaxUint32
+}
+
+func (i *index) entries() uint64 {
+	return (i.size - i.header) / i.width
+}
+
+func (i *index) entry(n uint64) (off uint64, pos uint64) {
+	ent := i.mmap[i.header+n*i.width : i.header+(n+1)*i.width]
+	if i.version == IndexV2 {
+		return enc.Uint64(ent[:offWidthV2]), enc.Uint64(ent[offWidthV2:])
+	}
+	return uint64(enc.Uint32(ent[:offWidth])), enc.Uint64(ent[offWidth:])
+}
+
 func (i *index) Name() string {
 	return i.file.Name()
 }
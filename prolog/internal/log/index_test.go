@@ -3,6 +3,7 @@ package log
 import (
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"testing"
 
@@ -23,7 +24,7 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, f.Name(), idx.Name())
 
 	entries := []struct {
-		Off uint32
+		Off uint64
 		Pos uint64
 	}{
 		{Off: 0, Pos: 0},
@@ -53,7 +54,89 @@ func TestIndex(t *testing.T) {
 		require.NoError(t, err)
 		off, pos, err := idx.Read(-1)
 		require.NoError(t, err)
-		require.Equal(t, uint32(1), off)
+		require.Equal(t, uint64(1), off)
 		require.Equal(t, entries[1].Pos, pos)
 	})
 }
+
+func TestIndexFormats(t *testing.T) {
+	for scenario, cfg := range map[string]struct {
+		version  IndexVersion
+		interval uint64
+		header   uint64
+		width    uint64
+	}{
+		"legacy v1":  {version: IndexV1, width: entWidth},
+		"v2":         {version: IndexV2, header: hdrWidth, width: entWidthV2},
+		"sparse v1":  {version: IndexV1, interval: 32, header: hdrWidth, width: entWidth},
+		"sparse v2":  {version: IndexV2, interval: 32, header: hdrWidth, width: entWidthV2},
+		"zero value": {width: entWidth},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			f, err := ioutil.TempFile(os.TempDir(), "index_test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = 1024
+			c.Segment.IndexVersion = cfg.version
+			c.Segment.IndexIntervalBytes = cfg.interval
+			idx, err := newIndex(f, c)
+			require.NoError(t, err)
+			require.Equal(t, cfg.header, idx.size)
+
+			// every record is 20 bytes long
+			for off := uint64(0); off < 8; off++ {
+				require.NoError(t, idx.Write(off, off*20))
+			}
+			require.NoError(t, idx.Close())
+
+			// the format comes from the file, not the config
+			f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+			require.NoError(t, err)
+			idx, err = newIndex(f, Config{Segment: c.Segment})
+			require.NoError(t, err)
+			defer idx.Close()
+			require.Equal(t, cfg.width, idx.width)
+			require.Equal(t, cfg.interval, idx.interval)
+
+			for off := uint64(0); off < 8; off++ {
+				out, pos, err := idx.Read(int64(off))
+				require.NoError(t, err)
+				require.LessOrEqual(t, out, off)
+				require.Equal(t, out*20, pos)
+				if cfg.interval == 0 {
+					require.Equal(t, off, out)
+				} else {
+					require.Less(t, off-out, uint64(2))
+				}
+			}
+		})
+	}
+}
+
+func TestIndexOffsetOverflow(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	require.Equal(t, ErrIndexOffsetOverflow, idx.Write(math.MaxUint32+1, 0))
+	require.NoError(t, idx.Close())
+
+	f, err = ioutil.TempFile(os.TempDir(), "index_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c.Segment.IndexVersion = IndexV2
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	require.NoError(t, idx.Write(math.MaxUint32+1, 0))
+	off, _, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(math.MaxUint32+1), off)
+	require.NoError(t, idx.Close())
+}
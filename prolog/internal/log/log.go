@@ -1,11 +1,12 @@
 package log
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
 	"path"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -14,14 +15,31 @@ import (
 	api "github.com/lucaspere/go_projects/proglog/api/v1"
 )
 
+// ErrOffsetOutOfRange is returned when reading an offset that isn't in the log.
+var ErrOffsetOutOfRange = errors.New("offset out of range")
+
 type Log struct {
 	mu sync.RWMutex
+	// retain is held for reading while segments are used without holding `mu`,
+	// closing segments waits for it. It must be acquired before `mu`.
+	retain sync.RWMutex
 
 	Dir    string
 	Config Config
 
 	activeSegment *segment
 	segments      []*segment
+	producers     producers
+	schemas       *schemaRegistry
+	// startOffset is the log start offset, the records below it are hidden even when they're still on disk
+	startOffset uint64
+
+	// remote lists the segments offloaded to `Config.Tier.Store`, ordered by base offset
+	remote      []remoteSegment
+	cache       *tierCache
+	offloadMu   sync.Mutex
+	offloadc    chan struct{}
+	offloadDone chan struct{}
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -40,56 +58,173 @@ func NewLog(dir string, c Config) (*Log, error) {
 }
 
 func (l *Log) setup() error {
-	files, err := ioutil.ReadDir(l.Dir)
+	// a segment rewritten by Reencrypt may not have replaced the segment's files yet
+	if err := finishReencrypt(l.Config.fs(), l.Dir); err != nil {
+		return err
+	}
+	// snapshots interrupted by a crash leave their links behind
+	tmps, err := filepath.Glob(filepath.Join(l.Dir, snapshotTmpPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, tmp := range tmps {
+		if err = l.Config.fs().RemoveAll(tmp); err != nil {
+			return err
+		}
+	}
+	baseOffsets, err := l.baseOffsets()
 	if err != nil {
 		return err
 	}
+	for i := 0; i < len(baseOffsets); i++ {
+		if err = l.newSegment(baseOffsets[i]); err != nil {
+			return err
+		}
+	}
+	// only the active segment takes writes
+	for i := 0; i+1 < len(l.segments); i++ {
+		if err = l.segments[i].Seal(); err != nil {
+			return err
+		}
+	}
+	if l.segments == nil {
+		if err = l.newSegment(
+			l.Config.Segment.InitialOffset,
+		); err != nil {
+			return err
+		}
+	}
+	if err = l.activeSegment.recover(); err != nil {
+		return err
+	}
+	if l.startOffset, err = loadStartOffset(l.Config.fs(), l.Dir); err != nil {
+		return err
+	}
+	if l.schemas, err = loadSchemas(l.Config.fs(), l.Dir); err != nil {
+		return err
+	}
+	if err = l.setupTier(); err != nil {
+		return err
+	}
+	return l.loadProducers()
+}
+
+// baseOffsets returns the base offsets of the segments in the log's directory, in order.
+func (l *Log) baseOffsets() ([]uint64, error) {
+	files, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
 	var baseOffsets []uint64
 	for _, file := range files {
+		// the directory also holds files that aren't segments, every
+		// segment has exactly one store
+		if path.Ext(file.Name()) != ".store" {
+			continue
+		}
 		offStr := strings.TrimSuffix(
 			file.Name(),
 			path.Ext(file.Name()),
 		)
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			continue
+		}
 		baseOffsets = append(baseOffsets, off)
 	}
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
-			return err
-		}
-		// baseOffset contains dup for index and store so we skip
-		// the dup
-		i++
+	return baseOffsets, nil
+}
+
+// loadProducers rebuilds the producers' state from its checkpoint and the records appended after it.
+// Every segment is scanned when there's no checkpoint.
+func (l *Log) loadProducers() error {
+	c, err := loadProducersCheckpoint(l.Config.fs(), l.Dir)
+	if err != nil {
+		return err
 	}
-	if l.segments == nil {
-		if err = l.newSegment(
-			l.Config.Segment.InitialOffset,
-		); err != nil {
+	if c.Offset > l.activeSegment.nextOffset {
+		// records past the checkpoint were lost in a crash, it doesn't describe this log
+		c = producersCheckpoint{Producers: make(producers)}
+	}
+	l.producers = c.Producers
+	for _, s := range l.segments {
+		if s.nextOffset <= c.Offset {
+			continue
+		}
+		if err = s.Scan(func(record *api.Record) error {
+			if record.Offset >= c.Offset {
+				l.producers.track(record, record.Offset)
+			}
+			return nil
+		}); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// checkpointProducers saves the producers' state, the next startup only scans the records appended after it.
+func (l *Log) checkpointProducers() error {
+	return writeProducersCheckpoint(l.Config.fs(), l.Dir, producersCheckpoint{
+		Offset:    l.activeSegment.nextOffset,
+		Producers: l.producers,
+	})
+}
+
+// Append appends the record to the active segment and returns its offset.
+// When the log has schemas, the record must validate against the latest one or the version it refers to.
+// Records of idempotent producers are deduplicated: a retry returns the offset of the
+// original record, and a gap in the sequence numbers returns `ErrOutOfOrderSequence`.
 func (l *Log) Append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	off, err := l.activeSegment.Append(record)
+	off, dup, err := l.producers.check(record)
+	if err != nil || dup {
+		return off, err
+	}
+	if err = l.schemas.Validate(record); err != nil {
+		return 0, err
+	}
+	off, err = l.activeSegment.Append(record)
 	if err != nil {
 		return 0, err
 	}
+	l.producers.track(record, off)
 	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
+		if err = l.activeSegment.Seal(); err != nil {
+			return off, err
+		}
+		if err = l.newSegment(off + 1); err != nil {
+			return off, err
+		}
+		if err = l.checkpointProducers(); err == nil {
+			l.notifyOffload()
+		}
 	}
 	return off, err
 }
 
-func (l *Log) Read(off uint64) (*api.Record, error) {
+// Duplicate reports whether the record is a retry of a record of an idempotent producer that the log holds,
+// and returns the original's offset. Append deduplicates on its own, Duplicate spots the retries beforehand.
+func (l *Log) Duplicate(record *api.Record) (uint64, bool) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	off, dup, err := l.producers.check(record)
+	return off, dup && err == nil
+}
+
+// Read returns the record at `off`. Offsets below the local segments are read from the
+// tier's object store, which are fetched into a local cache first.
+// Offsets below the log start offset are out of range.
+func (l *Log) Read(off uint64) (*api.Record, error) {
+	l.mu.RLock()
+	if off < l.startOffset {
+		l.mu.RUnlock()
+		return nil, fmt.Errorf("%w: %d is below the log start offset", ErrOffsetOutOfRange, off)
+	}
 	var s *segment
 	for _, segment := range l.segments {
 		if segment.baseOffset <= off && off < segment.nextOffset {
@@ -97,10 +232,40 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 			break
 		}
 	}
-	if s == nil || s.nextOffset <= off {
-		return nil, fmt.Errorf("offset out of range: %d", off)
+	if s != nil {
+		defer l.mu.RUnlock()
+		return s.Read(off)
+	}
+	// don't hold the lock while fetching the segment
+	r, ok := l.findRemote(off)
+	l.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrOffsetOutOfRange, off)
 	}
-	return s.Read(off)
+	return l.readRemote(r, off)
+}
+
+// Sync commits the records appended to the active segment to stable storage, they survive crashes once it returns.
+// The records of sealed segments were committed when their segment was sealed.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.activeSegment.Sync()
+}
+
+// RegisterSchema registers a new version of the log's schema, which new records are validated against.
+// It returns the version assigned to the schema.
+func (l *Log) RegisterSchema(s Schema) (uint32, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.schemas.Register(s)
+}
+
+// Schemas returns the schemas registered to the log, oldest first.
+func (l *Log) Schemas() []Schema {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]Schema(nil), l.schemas.schemas...)
 }
 
 func (l *Log) newSegment(off uint64) error {
@@ -114,6 +279,11 @@ func (l *Log) newSegment(off uint64) error {
 }
 
 func (l *Log) Close() error {
+	if err := l.closeTier(); err != nil {
+		return err
+	}
+	l.retain.Lock()
+	defer l.retain.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	for _, segment := range l.segments {
@@ -121,14 +291,14 @@ func (l *Log) Close() error {
 			return err
 		}
 	}
-	return nil
+	return l.checkpointProducers()
 }
 
 func (l *Log) Remove() error {
 	if err := l.Close(); err != nil {
 		return err
 	}
-	return os.RemoveAll(l.Dir)
+	return l.Config.fs().RemoveAll(l.Dir)
 }
 
 func (l *Log) Reset() error {
@@ -138,10 +308,19 @@ func (l *Log) Reset() error {
 	return l.setup()
 }
 
+// LowestOffset returns the lowest offset that can be read: the log start offset, unless the
+// segments starting above it were removed.
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	return l.segments[0].baseOffset, nil
+	off := l.segments[0].baseOffset
+	if len(l.remote) > 0 && l.remote[0].baseOffset < off {
+		off = l.remote[0].baseOffset
+	}
+	if l.startOffset > off {
+		off = l.startOffset
+	}
+	return off, nil
 }
 
 func (l *Log) HighestOffset() (uint64, error) {
@@ -155,6 +334,8 @@ func (l *Log) HighestOffset() (uint64, error) {
 }
 
 func (l *Log) Truncate(lowest uint64) error {
+	l.retain.Lock()
+	defer l.retain.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	var segments []*segment
@@ -168,9 +349,11 @@ func (l *Log) Truncate(lowest uint64) error {
 		segments = append(segments, s)
 	}
 	l.segments = segments
-	return nil
+	return l.truncateRemote(lowest)
 }
 
+// Reader returns a reader of the stores of the local segments, each record being prefixed by its length.
+// Reading after the segments are closed, truncated or removed returns an error.
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
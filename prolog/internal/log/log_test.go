@@ -1,8 +1,13 @@
 package log
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path"
+	"sync"
 	"testing"
 
 	api "github.com/lucaspere/go_projects/proglog/api/v1"
@@ -17,8 +22,13 @@ func TestLog(t *testing.T) {
 		"append and read a record succeeds": testAppendRead,
 		"offset out of range error":         testOutOfRangeErr,
 		"init with existing segments":       testInitExisting,
+		"init ignores non-segment files":    testInitIgnoresOtherFiles,
 		"reader":                            testReader,
+		"reader after close":                testReaderAfterClose,
 		"truncate":                          testTruncate,
+		"seal rolled segments":              testSeal,
+		"idempotent producer":               testIdempotentProducer,
+		"producers state survives restart":  testProducersRestart,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -82,6 +92,42 @@ func testInitExisting(t *testing.T, o *Log) {
 	require.Equal(t, uint64(2), off)
 }
 
+func testInitIgnoresOtherFiles(t *testing.T, o *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := o.Append(append)
+		require.NoError(t, err)
+	}
+	_, err := o.RegisterSchema(Schema{Type: SchemaJSON, Definition: []byte(`{"type": "object"}`)})
+	require.NoError(t, err)
+	require.NoError(t, o.SetStartOffset(1))
+	require.NoError(t, o.Close())
+
+	// files of the log that aren't segments, a stray index without its store,
+	// and files which aren't the log's at all
+	for _, name := range []string{"9.index", "notes.txt", "backup.store", "README"} {
+		require.NoError(t, os.WriteFile(path.Join(o.Dir, name), []byte("{}"), 0644))
+	}
+	require.NoError(t, os.Mkdir(path.Join(o.Dir, "17"), 0755))
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	require.Len(t, n.segments, len(o.segments))
+	for i, s := range n.segments {
+		require.Equal(t, o.segments[i].baseOffset, s.baseOffset)
+	}
+	off, err := n.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.Len(t, n.Schemas(), 1)
+}
+
 func testReader(t *testing.T, log *Log) {
 	append := &api.Record{
 		Value: []byte("hello world"),
@@ -100,6 +146,23 @@ func testReader(t *testing.T, log *Log) {
 	require.Equal(t, append.Value, read.Value)
 }
 
+func testReaderAfterClose(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	require.NotNil(t, log.segments[0].store.sealed.Load())
+
+	// the sealed stores are unmapped by Close, reading them fails instead of crashing
+	reader := log.Reader()
+	require.NoError(t, log.Close())
+	_, err := ioutil.ReadAll(reader)
+	require.Error(t, err)
+}
+
 func testTruncate(t *testing.T, log *Log) {
 	append := &api.Record{
 		Value: []byte("hello world"),
@@ -115,3 +178,333 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func TestLogIndexFormats(t *testing.T) {
+	for scenario, version := range map[string]IndexVersion{
+		"v1": IndexV1,
+		"v2": IndexV2,
+	} {
+		for _, interval := range []uint64{0, 48} {
+			t.Run(fmt.Sprintf("%s interval %d", scenario, interval), func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "log-index-test")
+				require.NoError(t, err)
+				defer os.RemoveAll(dir)
+
+				c := Config{}
+				c.Segment.MaxStoreBytes = 128
+				c.Segment.IndexVersion = version
+				c.Segment.IndexIntervalBytes = interval
+				log, err := NewLog(dir, c)
+				require.NoError(t, err)
+
+				record := &api.Record{Value: []byte("hello world")}
+				for i := uint64(0); i < 20; i++ {
+					off, err := log.Append(record)
+					require.NoError(t, err)
+					require.Equal(t, i, off)
+				}
+				require.NoError(t, log.Close())
+
+				// the formats are read back from the files, whatever the config says
+				log, err = NewLog(dir, Config{})
+				require.NoError(t, err)
+				defer log.Close()
+				off, err := log.HighestOffset()
+				require.NoError(t, err)
+				require.Equal(t, uint64(19), off)
+				for i := uint64(0); i < 20; i++ {
+					read, err := log.Read(i)
+					require.NoError(t, err)
+					require.Equal(t, i, read.Offset)
+				}
+			})
+		}
+	}
+}
+
+func testSeal(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	for _, s := range log.segments[:len(log.segments)-1] {
+		require.NotNil(t, s.store.sealed.Load())
+	}
+	require.Nil(t, log.activeSegment.store.sealed.Load())
+
+	for i := uint64(0); i < 3; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, append.Value, read.Value)
+	}
+}
+
+func testIdempotentProducer(t *testing.T, log *Log) {
+	for seq := uint64(0); seq < 3; seq++ {
+		off, err := log.Append(&api.Record{
+			Value:      []byte("hello world"),
+			ProducerId: "producer",
+			Sequence:   seq,
+		})
+		require.NoError(t, err)
+		require.Equal(t, seq, off)
+	}
+
+	// a retry gets the original offset back
+	off, err := log.Append(&api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: "producer",
+		Sequence:   1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	_, err = log.Append(&api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: "producer",
+		Sequence:   5,
+	})
+	require.Equal(t, ErrOutOfOrderSequence, err)
+
+	// producers are tracked independently
+	off, err = log.Append(&api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: "other",
+		Sequence:   1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+func testProducersRestart(t *testing.T, o *Log) {
+	for seq := uint64(0); seq < 3; seq++ {
+		_, err := o.Append(&api.Record{
+			Value:      []byte("hello world"),
+			ProducerId: "producer",
+			Sequence:   seq,
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, o.Close())
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	off, err := n.Append(&api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: "producer",
+		Sequence:   2,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	off, err = n.Append(&api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: "producer",
+		Sequence:   3,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+// BenchmarkLogReadWrite mixes producers and consumers, run it with `-race` to catch
+// unsynchronized access to the sealed stores' mappings.
+func BenchmarkLogReadWrite(b *testing.B) {
+	for _, writers := range []int{0, 1, 4} {
+		b.Run(fmt.Sprintf("writers=%d", writers), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "log-bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 4096
+			log, err := NewLog(dir, c)
+			require.NoError(b, err)
+			defer log.Close()
+
+			record := &api.Record{Value: []byte("hello world")}
+			for i := 0; i < 1000; i++ {
+				_, err := log.Append(record)
+				require.NoError(b, err)
+			}
+
+			var wg sync.WaitGroup
+			done := make(chan struct{})
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						if _, err := log.Append(&api.Record{Value: record.Value}); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				off := uint64(0)
+				for pb.Next() {
+					if _, err := log.Read(off % 1000); err != nil {
+						b.Error(err)
+						return
+					}
+					off++
+				}
+			})
+			b.StopTimer()
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+// TestLogCrashModel appends to, reads from, syncs and restarts logs whose filesystem injects faults and
+// crashes at random points, and checks them against a model: the slice of the records they acknowledged.
+// A failing seed replays the same run.
+func TestLogCrashModel(t *testing.T) {
+	seeds := int64(20)
+	if testing.Short() {
+		seeds = 5
+	}
+	for seed := int64(1); seed <= seeds; seed++ {
+		seed := seed
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			testLogCrashModel(t, seed)
+		})
+	}
+}
+
+func testLogCrashModel(t *testing.T, seed int64) {
+	dir := t.TempDir()
+	rng := rand.New(rand.NewSource(seed))
+	fs := newFaultFS(seed)
+
+	c := Config{FS: fs}
+	c.Segment.MaxStoreBytes = 256
+	c.Segment.MaxIndexBytes = 256
+	switch seed % 3 {
+	case 1:
+		c.Segment.IndexVersion = IndexV2
+	case 2:
+		c.Segment.IndexIntervalBytes = 64
+	}
+	// the key files of encrypted segments go through the faulty filesystem too
+	if seed%2 == 0 {
+		c.Encryption.Keys = &KeyFile{Current: "k1", Keys: map[string][]byte{"k1": make([]byte, 32)}}
+	}
+
+	// model holds the acknowledged records, the first `durable` ones must survive crashes
+	// and `pending` is the record of a failed append, which may have made it or not
+	var model [][]byte
+	var durable int
+	var pending []byte
+
+	// restart crashes the filesystem and opens the log again, crashing while recovering too
+	restart := func(l *Log) *Log {
+		var err error
+		for i := 0; ; i++ {
+			abandon(l)
+			require.NoError(t, fs.Crash())
+			if i < 3 {
+				fs.arm(0.05, 20)
+			}
+			if l, err = NewLog(dir, c); err == nil {
+				break
+			}
+			if i > 5 {
+				t.Fatal(err)
+			}
+		}
+		fs.disarm()
+
+		var got [][]byte
+		for off := uint64(0); ; off++ {
+			record, err := l.Read(off)
+			if errors.Is(err, ErrOffsetOutOfRange) {
+				break
+			}
+			require.NoError(t, err, "offset %d", off)
+			got = append(got, record.Value)
+		}
+		want := model
+		if pending != nil {
+			want = append(model[:len(model):len(model)], pending)
+		}
+		require.GreaterOrEqual(t, len(got), durable, "durable records were lost")
+		require.LessOrEqual(t, len(got), len(want), "unknown records")
+		for i := range got {
+			require.Equal(t, want[i], got[i], "offset %d", i)
+		}
+		model, durable, pending = got, len(got), nil
+		return l
+	}
+
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	fs.arm(0.01, 200)
+	for i := 0; i < 400; i++ {
+		switch n := rng.Intn(10); {
+		case n < 6:
+			value := make([]byte, 1+rng.Intn(48))
+			rng.Read(value)
+			var off uint64
+			if off, err = l.Append(&api.Record{Value: value}); err == nil {
+				require.Equal(t, uint64(len(model)), off)
+				model = append(model, value)
+			} else {
+				pending = value
+			}
+		case n < 8:
+			if len(model) == 0 {
+				continue
+			}
+			off := rng.Intn(len(model))
+			var record *api.Record
+			if record, err = l.Read(uint64(off)); err == nil {
+				require.Equal(t, model[off], record.Value, "offset %d", off)
+			}
+		case n < 9:
+			if err = l.Sync(); err == nil {
+				durable = len(model)
+			}
+		default:
+			if err = l.Close(); err == nil {
+				durable = len(model)
+				l, err = NewLog(dir, c)
+			}
+		}
+		if err != nil {
+			l = restart(l)
+			fs.arm(0.01, 200)
+		}
+	}
+	l = restart(l)
+	require.NoError(t, l.Close())
+}
+
+// abandon releases the memory mappings of a log left behind by a crash, without touching its files.
+func abandon(l *Log) {
+	if l == nil {
+		return
+	}
+	for _, s := range l.segments {
+		if s.index.mmap != nil {
+			s.index.mmap.UnsafeUnmap()
+		}
+		if m := s.store.sealed.Swap(nil); m != nil {
+			m.UnsafeUnmap()
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+
+	api "github.com/lucaspere/go_projects/proglog/api/v1"
+)
+
+// producerWindow is the number of recent records remembered per producer,
+// retries of older records can't be told apart from out-of-order ones.
+const producerWindow = 5
+
+// ErrOutOfOrderSequence is returned when a producer skips sequence numbers or
+// retries a record that is older than the records it remembers.
+var ErrOutOfOrderSequence = errors.New("out of order sequence number")
+
+// producersFile is the checkpoint, in the log's directory, holding the producers' state.
+const producersFile = "producers.checkpoint"
+
+// producerState holds the sequence numbers and offsets of a producer's last records, oldest first.
+type producerState struct {
+	Sequences []uint64 `json:"sequences"`
+	Offsets   []uint64 `json:"offsets"`
+}
+
+// producers tracks the idempotent producers that appended to a log.
+type producers map[string]*producerState
+
+// check returns the offset of the record when it's a duplicate of a recent one.
+// It returns `ErrOutOfOrderSequence` when the record can't be appended after the producer's last record.
+func (p producers) check(record *api.Record) (offset uint64, dup bool, err error) {
+	if record.ProducerId == "" {
+		return 0, false, nil
+	}
+	s, ok := p[record.ProducerId]
+	if !ok {
+		// the first sequence of a producer is accepted as is
+		return 0, false, nil
+	}
+	last := s.Sequences[len(s.Sequences)-1]
+	if record.Sequence == last+1 {
+		return 0, false, nil
+	}
+	for i, seq := range s.Sequences {
+		if seq == record.Sequence {
+			return s.Offsets[i], true, nil
+		}
+	}
+	return 0, false, ErrOutOfOrderSequence
+}
+
+// track records that the producer's record was appended at `offset`.
+func (p producers) track(record *api.Record, offset uint64) {
+	if record.ProducerId == "" {
+		return
+	}
+	s, ok := p[record.ProducerId]
+	if !ok {
+		s = &producerState{}
+		p[record.ProducerId] = s
+	}
+	s.Sequences = append(s.Sequences, record.Sequence)
+	s.Offsets = append(s.Offsets, offset)
+	if len(s.Sequences) > producerWindow {
+		s.Sequences = s.Sequences[1:]
+		s.Offsets = s.Offsets[1:]
+	}
+}
+
+// producersCheckpoint is the producers' state once the records below `Offset` were tracked.
+type producersCheckpoint struct {
+	Offset    uint64    `json:"offset"`
+	Producers producers `json:"producers"`
+}
+
+// loadProducersCheckpoint returns the checkpointed producers' state, an empty state at offset 0 when
+// there's no checkpoint.
+func loadProducersCheckpoint(fs FS, dir string) (producersCheckpoint, error) {
+	c := producersCheckpoint{Producers: make(producers)}
+	b, err := readFile(fs, path.Join(dir, producersFile))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	if err = json.Unmarshal(b, &c); err != nil {
+		return c, err
+	}
+	if c.Producers == nil {
+		c.Producers = make(producers)
+	}
+	return c, nil
+}
+
+func writeProducersCheckpoint(fs FS, dir string, c producersCheckpoint) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fs, path.Join(dir, producersFile), b)
+}
@@ -0,0 +1,88 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/lucaspere/go_projects/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProducersWindow(t *testing.T) {
+	p := make(producers)
+	for seq := uint64(10); seq < 20; seq++ {
+		record := &api.Record{ProducerId: "producer", Sequence: seq}
+		_, dup, err := p.check(record)
+		require.NoError(t, err)
+		require.False(t, dup)
+		p.track(record, seq*2)
+	}
+
+	for seq := uint64(20 - producerWindow); seq < 20; seq++ {
+		off, dup, err := p.check(&api.Record{ProducerId: "producer", Sequence: seq})
+		require.NoError(t, err)
+		require.True(t, dup)
+		require.Equal(t, seq*2, off)
+	}
+
+	// too old to be told apart from a reordering
+	_, _, err := p.check(&api.Record{ProducerId: "producer", Sequence: 20 - producerWindow - 1})
+	require.Equal(t, ErrOutOfOrderSequence, err)
+
+	// records without a producer are never deduplicated
+	_, dup, err := p.check(&api.Record{Sequence: 12})
+	require.NoError(t, err)
+	require.False(t, dup)
+}
+
+func TestProducersCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	// one record per segment
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world"), ProducerId: "old", Sequence: 0})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// the producer's state is checkpointed, however many segments followed its last record
+	c.Segment.MaxStoreBytes = 0
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	off, dup := log.Duplicate(&api.Record{ProducerId: "old", Sequence: 0})
+	require.True(t, dup)
+	require.Equal(t, uint64(0), off)
+	// the records appended to the active segment after the checkpoint are scanned
+	_, err = log.Append(&api.Record{Value: []byte("hello world"), ProducerId: "new", Sequence: 0})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world"), ProducerId: "new", Sequence: 1})
+	require.NoError(t, err)
+	require.NoError(t, log.Sync())
+
+	// a crash skips the checkpoint of Close, the one of the last roll is used
+	crashed, err := NewLog(dir, c)
+	require.NoError(t, err)
+	off, dup = crashed.Duplicate(&api.Record{ProducerId: "old", Sequence: 0})
+	require.True(t, dup)
+	require.Equal(t, uint64(0), off)
+	off, dup = crashed.Duplicate(&api.Record{ProducerId: "new", Sequence: 1})
+	require.True(t, dup)
+	require.Equal(t, uint64(12), off)
+	require.NoError(t, crashed.Close())
+	require.NoError(t, log.Close())
+
+	// without a checkpoint every segment is scanned
+	require.NoError(t, os.Remove(filepath.Join(dir, producersFile)))
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	off, dup = log.Duplicate(&api.Record{ProducerId: "old", Sequence: 0})
+	require.True(t, dup)
+	require.Equal(t, uint64(0), off)
+}
@@ -0,0 +1,206 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	api "github.com/lucaspere/go_projects/proglog/api/v1"
+	"github.com/xeipuuv/gojsonschema"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// schemasFile is the name of the file, in the log's directory, that holds the registered schemas.
+const schemasFile = "schemas.json"
+
+var (
+	// ErrInvalidRecord is returned when a record doesn't match the log's schema.
+	ErrInvalidRecord = errors.New("record doesn't match the schema")
+	// ErrUnknownSchemaVersion is returned when a record refers to a schema version that wasn't registered.
+	ErrUnknownSchemaVersion = errors.New("unknown schema version")
+	// ErrInvalidSchema is returned when registering a schema that can't be compiled.
+	ErrInvalidSchema = errors.New("invalid schema")
+)
+
+// SchemaType is the language a schema is written in.
+type SchemaType string
+
+const (
+	// SchemaJSON schemas are JSON Schema documents, and records hold JSON values.
+	SchemaJSON SchemaType = "json"
+	// SchemaProtobuf schemas are serialized `FileDescriptorSet`s, and records hold a serialized message.
+	SchemaProtobuf SchemaType = "protobuf"
+)
+
+// contentType is the media type stamped into the records validated against a schema of the type.
+func (t SchemaType) contentType() string {
+	if t == SchemaProtobuf {
+		return "application/x-protobuf"
+	}
+	return "application/json"
+}
+
+// Schema describes the values of a log's records.
+//
+// `Definition` holds the JSON Schema document or the serialized `FileDescriptorSet`, and
+// `Message` the full name of the protobuf message the values must decode into.
+// `Version` is assigned when the schema is registered, starting at one.
+type Schema struct {
+	Version    uint32     `json:"version"`
+	Type       SchemaType `json:"type"`
+	Definition []byte     `json:"definition"`
+	Message    string     `json:"message,omitempty"`
+}
+
+type validator func(value []byte) error
+
+// schemaRegistry holds the schemas registered to a log, persisted as JSON in the log's directory.
+// A log without schemas accepts any record.
+type schemaRegistry struct {
+	fs         FS
+	path       string
+	schemas    []Schema
+	validators []validator
+}
+
+// loadSchemas reads the schemas registered in `dir`, if any.
+func loadSchemas(fs FS, dir string) (*schemaRegistry, error) {
+	r := &schemaRegistry{fs: fs, path: path.Join(dir, schemasFile)}
+	b, err := readFile(fs, r.path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var schemas []Schema
+	if err = json.Unmarshal(b, &schemas); err != nil {
+		return nil, err
+	}
+	for _, s := range schemas {
+		if err = r.add(s); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Register adds `s` as the latest version of the schema and persists the registry.
+func (r *schemaRegistry) Register(s Schema) (uint32, error) {
+	s.Version = uint32(len(r.schemas)) + 1
+	if err := r.add(s); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidSchema, err)
+	}
+	b, err := json.Marshal(r.schemas)
+	if err == nil {
+		err = writeFileAtomic(r.fs, r.path, b)
+	}
+	if err != nil {
+		r.schemas = r.schemas[:len(r.schemas)-1]
+		r.validators = r.validators[:len(r.validators)-1]
+		return 0, err
+	}
+	return s.Version, nil
+}
+
+func (r *schemaRegistry) add(s Schema) error {
+	var v validator
+	var err error
+	switch s.Type {
+	case SchemaJSON:
+		v, err = newJSONValidator(s)
+	case SchemaProtobuf:
+		v, err = newProtobufValidator(s)
+	default:
+		err = fmt.Errorf("unknown schema type %q", s.Type)
+	}
+	if err != nil {
+		return err
+	}
+	r.schemas = append(r.schemas, s)
+	r.validators = append(r.validators, v)
+	return nil
+}
+
+// Validate checks the record's value against the schema version it refers to, or the latest one,
+// and stamps the version and content type into the record.
+func (r *schemaRegistry) Validate(record *api.Record) error {
+	if len(r.schemas) == 0 {
+		return nil
+	}
+	version := record.SchemaVersion
+	if version == 0 {
+		version = uint32(len(r.schemas))
+	}
+	if version > uint32(len(r.schemas)) {
+		return fmt.Errorf("%w: %d", ErrUnknownSchemaVersion, version)
+	}
+	s := r.schemas[version-1]
+	ct := s.Type.contentType()
+	if record.ContentType != "" && record.ContentType != ct {
+		return fmt.Errorf("%w: content type %q instead of %q", ErrInvalidRecord, record.ContentType, ct)
+	}
+	if err := r.validators[version-1](record.Value); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRecord, err)
+	}
+	record.SchemaVersion = version
+	record.ContentType = ct
+	return nil
+}
+
+func newJSONValidator(s Schema) (validator, error) {
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(s.Definition))
+	if err != nil {
+		return nil, err
+	}
+	return func(value []byte) error {
+		res, err := schema.Validate(gojsonschema.NewBytesLoader(value))
+		if err != nil {
+			return err
+		}
+		if !res.Valid() {
+			errs := make([]string, len(res.Errors()))
+			for i, e := range res.Errors() {
+				errs[i] = e.String()
+			}
+			return errors.New(strings.Join(errs, "; "))
+		}
+		return nil
+	}, nil
+}
+
+func newProtobufValidator(s Schema) (validator, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(s.Definition, set); err != nil {
+		return nil, err
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(s.Message))
+	if err != nil {
+		return nil, err
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a message", s.Message)
+	}
+	return func(value []byte) error {
+		msg := dynamicpb.NewMessage(md)
+		if err := proto.Unmarshal(value, msg); err != nil {
+			return err
+		}
+		if len(msg.GetUnknown()) > 0 {
+			return errors.New("unknown fields")
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,94 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/lucaspere/go_projects/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const userSchema = `{
+	"type": "object",
+	"properties": {"name": {"type": "string"}},
+	"required": ["name"]
+}`
+
+func TestSchemaJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	// no schema, anything goes
+	_, err = log.Append(&api.Record{Value: []byte("not json")})
+	require.NoError(t, err)
+
+	version, err := log.RegisterSchema(Schema{Type: SchemaJSON, Definition: []byte(userSchema)})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), version)
+
+	_, err = log.Append(&api.Record{Value: []byte(`{"age": 3}`)})
+	require.ErrorIs(t, err, ErrInvalidRecord)
+	_, err = log.Append(&api.Record{
+		Value:       []byte(`{"name": "jane"}`),
+		ContentType: "text/plain",
+	})
+	require.ErrorIs(t, err, ErrInvalidRecord)
+	_, err = log.Append(&api.Record{Value: []byte(`{"name": "jane"}`), SchemaVersion: 2})
+	require.ErrorIs(t, err, ErrUnknownSchemaVersion)
+
+	off, err := log.Append(&api.Record{
+		Value:   []byte(`{"name": "jane"}`),
+		Headers: map[string]string{"trace-id": "abc"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// the schemas are reloaded with the log
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	require.Len(t, log.Schemas(), 1)
+
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), read.SchemaVersion)
+	require.Equal(t, "application/json", read.ContentType)
+	require.Equal(t, "abc", read.Headers["trace-id"])
+
+	_, err = log.Append(&api.Record{Value: []byte(`{}`)})
+	require.ErrorIs(t, err, ErrInvalidRecord)
+}
+
+func TestSchemaProtobuf(t *testing.T) {
+	set := &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{
+			protodesc.ToFileDescriptorProto(api.File_api_v1_log_proto),
+		},
+	}
+	definition, err := proto.Marshal(set)
+	require.NoError(t, err)
+
+	r := &schemaRegistry{path: os.DevNull}
+	_, err = r.Register(Schema{Type: SchemaProtobuf, Definition: definition, Message: "log.v1.Unknown"})
+	require.ErrorIs(t, err, ErrInvalidSchema)
+	require.NoError(t, r.add(Schema{Type: SchemaProtobuf, Definition: definition, Message: "log.v1.Record", Version: 1}))
+
+	value, err := proto.Marshal(&api.Record{Value: []byte("nested")})
+	require.NoError(t, err)
+	record := &api.Record{Value: value}
+	require.NoError(t, r.Validate(record))
+	require.Equal(t, uint32(1), record.SchemaVersion)
+	require.Equal(t, "application/x-protobuf", record.ContentType)
+
+	// field 15 doesn't exist in log.v1.Record
+	require.ErrorIs(t, r.Validate(&api.Record{Value: []byte{0x78, 0x01}}), ErrInvalidRecord)
+	require.ErrorIs(t, r.Validate(&api.Record{Value: []byte{0xff}}), ErrInvalidRecord)
+}
@@ -1,7 +1,9 @@
 package log
 
 import (
+	"crypto/cipher"
 	"fmt"
+	"io"
 	"os"
 	"path"
 
@@ -14,6 +16,8 @@ type segment struct {
 	index                  *index
 	baseOffset, nextOffset uint64
 	config                 Config
+	// aead encrypts the records of encrypted segments, it's nil for plain text ones
+	aead cipher.AEAD
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
@@ -22,7 +26,7 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		config:     c,
 	}
 	var err error
-	storeFile, err := os.OpenFile(
+	storeFile, err := c.fs().OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND,
 		0644,
@@ -33,7 +37,15 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.store, err = newStore(storeFile); err != nil {
 		return nil, err
 	}
-	indexFile, err := os.OpenFile(
+	if s.aead, err = openSegmentCipher(
+		c.fs(),
+		keyFileName(storeFile.Name()),
+		s.store.size == 0,
+		c.Encryption.Keys,
+	); err != nil {
+		return nil, err
+	}
+	indexFile, err := c.fs().OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
 		os.O_RDWR|os.O_CREATE,
 		0644,
@@ -45,19 +57,71 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
-	if off, _, err := s.index.Read(-1); err != nil {
+	s.index.trim(s.store.size)
+	if off, pos, err := s.index.Read(-1); err != nil {
 		s.nextOffset = baseOffset
 	} else {
-		s.nextOffset = baseOffset + uint64(off) + 1
+		// sparse indexes don't point at every record, so count the
+		// records stored after the last entry
+		_, n, err := s.scan(pos, nil)
+		if err != nil {
+			return nil, err
+		}
+		s.nextOffset = baseOffset + off + n
 	}
 
 	return s, nil
 }
 
+// scan calls fn, unless it's nil, with the position of every record stored from `pos` on, a record torn by a crash
+// ends the scan. It returns the position following the last complete record and the number of records.
+func (s *segment) scan(pos uint64, fn func(pos uint64) error) (end, n uint64, err error) {
+	for pos+lenWidth <= s.store.size {
+		next, err := s.store.Next(pos)
+		if err != nil {
+			return pos, n, err
+		}
+		if next > s.store.size {
+			break
+		}
+		if fn != nil {
+			if err = fn(pos); err != nil {
+				return pos, n, err
+			}
+		}
+		n++
+		pos = next
+	}
+	return pos, n, nil
+}
+
+// recover rebuilds the index of the segment that was active when the log crashed, none of its entries is trusted
+// as the ones written since the last sync may be torn. The store is truncated after its last complete record,
+// and both are synced so the dropped data can't resurface after another crash.
+func (s *segment) recover() error {
+	s.index.trim(0)
+	var rel uint64
+	end, n, err := s.scan(0, func(pos uint64) error {
+		err := s.index.Write(rel, pos)
+		rel++
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.nextOffset = s.baseOffset + n
+	if end < s.store.size {
+		if err = s.store.Truncate(end); err != nil {
+			return err
+		}
+	}
+	return s.index.Sync()
+}
+
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	cur := s.nextOffset
 	record.Offset = cur
-	p, err := proto.Marshal(record)
+	p, err := s.encode(record)
 	if err != nil {
 		return 0, err
 	}
@@ -67,7 +131,7 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	}
 	if err = s.index.Write(
 		// index offsets are relative to base offset
-		uint32(s.nextOffset-uint64(s.baseOffset)),
+		s.nextOffset-s.baseOffset,
 		pos,
 	); err != nil {
 		return 0, err
@@ -77,31 +141,109 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 }
 
 func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
-	if err != nil {
-		return nil, err
+	if off < s.baseOffset || off >= s.nextOffset {
+		return nil, io.EOF
 	}
-	p, err := s.store.Read(pos)
+	rel := off - s.baseOffset
+	out, pos, err := s.index.Read(int64(rel))
 	if err != nil {
 		return nil, err
 	}
+	// sparse indexes point at the nearest preceding record, so
+	// scan forward from there
+	for ; out < rel; out++ {
+		if pos, err = s.store.Next(pos); err != nil {
+			return nil, err
+		}
+	}
+	var record *api.Record
+	err = s.store.View(pos, func(p []byte) error {
+		record, err = s.decode(off, p)
+		return err
+	})
+	return record, err
+}
+
+// encode marshals the record and encrypts it when the segment is encrypted,
+// the offset is authenticated so records can't be swapped around.
+func (s *segment) encode(record *api.Record) ([]byte, error) {
+	p, err := proto.Marshal(record)
+	if err != nil || s.aead == nil {
+		return p, err
+	}
+	return seal(s.aead, p, offsetAD(record.Offset))
+}
+
+// decode is the reverse of encode for the record stored at `off`.
+func (s *segment) decode(off uint64, p []byte) (*api.Record, error) {
+	var err error
+	if s.aead != nil {
+		if p, err = open(s.aead, p, offsetAD(off)); err != nil {
+			return nil, err
+		}
+	}
 	record := &api.Record{}
 	err = proto.Unmarshal(p, record)
 	return record, err
 }
 
+func offsetAD(off uint64) []byte {
+	ad := make([]byte, 8)
+	enc.PutUint64(ad, off)
+	return ad
+}
+
 func (s *segment) IsMaxed() bool {
 	return s.store.size >= s.config.Segment.MaxStoreBytes ||
-		s.index.size >= s.config.Segment.MaxIndexBytes
+		s.index.size+s.index.width > s.config.Segment.MaxIndexBytes ||
+		!s.index.fits(s.nextOffset-s.baseOffset)
 }
 
-func (s *segment) Close() error {
-	if err := s.index.Close(); err != nil {
+// Scan calls fn with every record of the segment, in offset order.
+func (s *segment) Scan(fn func(*api.Record) error) error {
+	var pos uint64
+	for off := s.baseOffset; off < s.nextOffset; off++ {
+		var record *api.Record
+		if err := s.store.View(pos, func(p []byte) error {
+			var err error
+			record, err = s.decode(off, p)
+			pos += lenWidth + uint64(len(p))
+			return err
+		}); err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Seal marks the segment as immutable, its store is then read through a memory mapping.
+// Both the store and the index are synced, so only the active segment needs recovering after a crash.
+func (s *segment) Seal() error {
+	if err := s.store.Seal(); err != nil {
 		return err
 	}
+	return s.index.Sync()
+}
+
+// Sync commits the segment's records to stable storage. The store goes first so
+// the index never points at records that could be lost.
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
+func (s *segment) Close() error {
 	if err := s.store.Close(); err != nil {
 		return err
 	}
+	if err := s.index.Close(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -109,10 +251,13 @@ func (s *segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
 	}
-	if err := os.Remove(s.index.Name()); err != nil {
+	if err := s.config.fs().Remove(s.index.Name()); err != nil {
+		return err
+	}
+	if err := s.config.fs().Remove(s.store.Name()); err != nil {
 		return err
 	}
-	if err := os.Remove(s.store.Name()); err != nil {
+	if err := s.config.fs().Remove(keyFileName(s.store.Name())); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	return nil
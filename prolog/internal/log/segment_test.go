@@ -55,3 +55,40 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentSparseIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-sparse-test")
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexVersion = IndexV2
+	c.Segment.IndexIntervalBytes = 64
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := uint64(0); i < 10; i++ {
+		off, err := s.Append(want)
+		require.NoError(t, err)
+		require.Equal(t, 16+i, off)
+	}
+	// only a fraction of the records got an entry
+	require.Less(t, s.index.entries(), uint64(10))
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(26), s.nextOffset)
+	for off := uint64(16); off < 26; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+		require.Equal(t, want.Value, got.Value)
+	}
+	_, err = s.Read(26)
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, s.Remove())
+}
@@ -0,0 +1,283 @@
+package log
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/lucaspere/go_projects/proglog/internal/objstore"
+)
+
+// manifestFile is the first entry of a snapshot, it describes the segments that follow.
+const manifestFile = "manifest.json"
+
+// snapshotTmpPrefix prefixes the temporary directories, inside the log's, that snapshots link the segments' files into.
+const snapshotTmpPrefix = "snapshot-"
+
+// ErrInvalidSnapshot is returned when restoring a stream that isn't a complete snapshot.
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// Manifest lists the segments of a snapshot and the range of offsets they hold,
+// the records below `StartOffset` being hidden.
+type Manifest struct {
+	Segments    []SegmentManifest `json:"segments"`
+	StartOffset uint64            `json:"start_offset,omitempty"`
+}
+
+// SegmentManifest describes a segment in a snapshot, `NextOffset` being the offset
+// following its last record. The sizes are the lengths of the segment's files.
+type SegmentManifest struct {
+	BaseOffset uint64 `json:"base_offset"`
+	NextOffset uint64 `json:"next_offset"`
+	StoreBytes uint64 `json:"store_bytes"`
+	IndexBytes uint64 `json:"index_bytes"`
+	// KeyBytes is the size of the key file of encrypted segments.
+	KeyBytes uint64 `json:"key_bytes,omitempty"`
+}
+
+// captureSnapshot links the files of the segments into `tmp`, as they are at a point in time, and returns
+// their manifest, the schemas and the remote segments that aren't on local disk. The sealed stores are
+// immutable and the active one is only appended to, so the links hold the captured prefix of every store.
+func (l *Log) captureSnapshot(tmp string) (Manifest, []remoteSegment, []byte, error) {
+	fs := l.Config.fs()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	manifest := Manifest{StartOffset: l.startOffset}
+	var remote []remoteSegment
+	for _, r := range l.remote {
+		if len(l.segments) > 0 && r.baseOffset >= l.segments[0].baseOffset {
+			break
+		}
+		remote = append(remote, r)
+	}
+	for _, s := range l.segments {
+		if s == l.activeSegment {
+			// the buffered records aren't in the file yet
+			if err := s.store.Sync(); err != nil {
+				return manifest, nil, nil, err
+			}
+		}
+		base := path.Join(tmp, fmt.Sprintf("%d", s.baseOffset))
+		if err := fs.Link(s.store.Name(), base+".store"); err != nil {
+			return manifest, nil, nil, err
+		}
+		if err := writeFile(fs, base+".index", s.index.mmap[:s.index.size]); err != nil {
+			return manifest, nil, nil, err
+		}
+		key, err := readFile(fs, keyFileName(s.store.Name()))
+		if err == nil {
+			err = writeFile(fs, base+".key", key)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return manifest, nil, nil, err
+		}
+		manifest.Segments = append(manifest.Segments, SegmentManifest{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			StoreBytes: s.store.size,
+			IndexBytes: s.index.size,
+			KeyBytes:   uint64(len(key)),
+		})
+	}
+	schemas, err := readFile(fs, l.schemas.path)
+	if err != nil && !os.IsNotExist(err) {
+		return manifest, nil, nil, err
+	}
+	return manifest, remote, schemas, nil
+}
+
+// fetchSnapshot downloads the files of the remote segment `r` into `tmp` and returns its manifest.
+func (l *Log) fetchSnapshot(tmp string, r remoteSegment) (SegmentManifest, error) {
+	m := SegmentManifest{BaseOffset: r.baseOffset, NextOffset: r.nextOffset}
+	ctx := context.Background()
+	for _, f := range []struct {
+		ext  string
+		size *uint64
+	}{{".store", &m.StoreBytes}, {".index", &m.IndexBytes}, {".key", &m.KeyBytes}} {
+		b, err := getObject(ctx, l.Config.Tier.Store, remoteKey(r.baseOffset, r.nextOffset, f.ext))
+		if f.ext == ".key" && errors.Is(err, objstore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return m, err
+		}
+		if err = writeFile(l.Config.fs(), path.Join(tmp, fmt.Sprintf("%d%s", r.baseOffset, f.ext)), b); err != nil {
+			return m, err
+		}
+		*f.size = uint64(len(b))
+	}
+	return m, nil
+}
+
+// Snapshot writes a tar stream of the log to `w`: a manifest, the registered schemas and the
+// files of every segment, the ones offloaded to the tier's object store included. The segments
+// are captured as they were when Snapshot was called, records appended while the stream is written
+// are left out. The segments' files are linked into a temporary directory, so the log isn't
+// locked while the stream is written.
+func (l *Log) Snapshot(w io.Writer) error {
+	fs := l.Config.fs()
+	tmp, err := fs.MkdirTemp(l.Dir, snapshotTmpPrefix)
+	if err != nil {
+		return err
+	}
+	// a directory left behind is removed when the log is opened
+	defer fs.RemoveAll(tmp)
+	// the segments can't be removed while their files are linked
+	l.retain.RLock()
+	manifest, remote, schemas, err := l.captureSnapshot(tmp)
+	l.retain.RUnlock()
+	if err != nil {
+		return err
+	}
+	segments := make([]SegmentManifest, 0, len(remote)+len(manifest.Segments))
+	for _, r := range remote {
+		m, err := l.fetchSnapshot(tmp, r)
+		if err != nil {
+			return err
+		}
+		segments = append(segments, m)
+	}
+	manifest.Segments = append(segments, manifest.Segments...)
+
+	tw := tar.NewWriter(w)
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err = writeTarFile(tw, manifestFile, b); err != nil {
+		return err
+	}
+	if schemas != nil {
+		if err = writeTarFile(tw, schemasFile, schemas); err != nil {
+			return err
+		}
+	}
+	for _, s := range manifest.Segments {
+		files := []struct {
+			ext  string
+			size uint64
+		}{{".store", s.StoreBytes}, {".index", s.IndexBytes}, {".key", s.KeyBytes}}
+		for _, f := range files {
+			if f.ext == ".key" && f.size == 0 {
+				continue
+			}
+			name := fmt.Sprintf("%d%s", s.BaseOffset, f.ext)
+			if err = writeTarPath(fs, tw, path.Join(tmp, name), name, f.size); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// writeTarPath writes the first `size` bytes of the file at `name`, opened through `fs`, as the entry `entry`.
+func writeTarPath(fs FS, tw *tar.Writer, name, entry string, size uint64) error {
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeTarEntry(tw, entry, size, io.NewSectionReader(f, 0, int64(size)))
+}
+
+func writeTarFile(tw *tar.Writer, name string, b []byte) error {
+	return writeTarEntry(tw, name, uint64(len(b)), bytes.NewReader(b))
+}
+
+func writeTarEntry(tw *tar.Writer, name string, size uint64, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(size),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tw, r, int64(size))
+	return err
+}
+
+// Restore rebuilds, in `dir`, the data directory of the log whose snapshot is read from `r`.
+// `dir` is created if needed and must not hold a log already.
+func Restore(dir string, r io.Reader) error {
+	return restore(osFS{}, dir, r)
+}
+
+// restore is Restore writing the files through `fs`.
+func restore(fs FS, dir string, r io.Reader) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("restore: directory %s isn't empty", dir)
+	}
+
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != manifestFile {
+		return fmt.Errorf("%w: missing manifest", ErrInvalidSnapshot)
+	}
+	var manifest Manifest
+	if err = json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+	want := map[string]uint64{}
+	for _, s := range manifest.Segments {
+		want[fmt.Sprintf("%d.store", s.BaseOffset)] = s.StoreBytes
+		want[fmt.Sprintf("%d.index", s.BaseOffset)] = s.IndexBytes
+		if s.KeyBytes > 0 {
+			want[fmt.Sprintf("%d.key", s.BaseOffset)] = s.KeyBytes
+		}
+	}
+
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := hdr.Name
+		size, ok := want[name]
+		if name != schemasFile && (!ok || uint64(hdr.Size) != size) {
+			return fmt.Errorf("%w: unexpected entry %s", ErrInvalidSnapshot, name)
+		}
+		delete(want, name)
+		if err = restoreFile(fs, path.Join(dir, name), tr); err != nil {
+			return err
+		}
+	}
+	if len(want) > 0 {
+		return fmt.Errorf("%w: %d missing files", ErrInvalidSnapshot, len(want))
+	}
+	if manifest.StartOffset > 0 {
+		return writeStartOffset(fs, dir, manifest.StartOffset)
+	}
+	return nil
+}
+
+func restoreFile(fs FS, name string, r io.Reader) error {
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,253 @@
+package log
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/lucaspere/go_projects/proglog/api/v1"
+	"github.com/lucaspere/go_projects/proglog/internal/objstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	c.Segment.IndexVersion = IndexV2
+	require.NoError(t, os.Mkdir(path.Join(dir, "live"), 0755))
+	log, err := NewLog(path.Join(dir, "live"), c)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.RegisterSchema(Schema{Type: SchemaJSON, Definition: []byte(userSchema)})
+	require.NoError(t, err)
+
+	record := &api.Record{Value: []byte(`{"name": "jane"}`)}
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+
+	// writes go on while the snapshot is taken
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			_, err := log.Append(&api.Record{Value: record.Value})
+			require.NoError(t, err)
+		}
+	}()
+	var buf bytes.Buffer
+	require.NoError(t, log.Snapshot(&buf))
+	wg.Wait()
+
+	restored := path.Join(dir, "restored")
+	require.NoError(t, Restore(restored, bytes.NewReader(buf.Bytes())))
+	// never over an existing log
+	require.Error(t, Restore(restored, bytes.NewReader(buf.Bytes())))
+
+	n, err := NewLog(restored, Config{})
+	require.NoError(t, err)
+	defer n.Close()
+	require.Len(t, n.Schemas(), 1)
+
+	lowest, err := n.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	highest, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, highest, uint64(9))
+	for off := lowest; off <= highest; off++ {
+		read, err := n.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+		require.Equal(t, record.Value, read.Value)
+	}
+
+	// the restored log takes writes where the snapshot stopped
+	off, err := n.Append(&api.Record{Value: record.Value})
+	require.NoError(t, err)
+	require.Equal(t, highest+1, off)
+}
+
+func TestRestoreInvalidSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, writeTarFile(tw, "0.store", []byte("data")))
+	require.NoError(t, tw.Close())
+	require.ErrorIs(t, Restore(path.Join(dir, "no-manifest"), &buf), ErrInvalidSnapshot)
+
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	require.NoError(t, writeTarFile(tw, manifestFile, []byte(`{"segments": [{"base_offset": 0}]}`)))
+	require.NoError(t, writeTarFile(tw, "../0.store", nil))
+	require.NoError(t, tw.Close())
+	require.ErrorIs(t, Restore(path.Join(dir, "traversal"), &buf), ErrInvalidSnapshot)
+
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	require.NoError(t, writeTarFile(tw, manifestFile, []byte(`{"segments": [{"base_offset": 0}]}`)))
+	require.NoError(t, writeTarFile(tw, "0.store", nil))
+	require.NoError(t, tw.Close())
+	require.ErrorIs(t, Restore(path.Join(dir, "missing"), &buf), ErrInvalidSnapshot)
+}
+
+// blockingWriter signals `writing` on its first write, which then waits for `release`.
+type blockingWriter struct {
+	once             sync.Once
+	writing, release chan struct{}
+	buf              bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.writing)
+		<-w.release
+	})
+	return w.buf.Write(p)
+}
+
+func TestSnapshotUnlocked(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	w := &blockingWriter{writing: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		done <- log.Snapshot(w)
+	}()
+	<-w.writing
+	// the segments are removed while the stream is written
+	truncated := make(chan error)
+	go func() {
+		truncated <- log.Truncate(100)
+	}()
+	select {
+	case err := <-truncated:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("truncate waited for the snapshot")
+	}
+	close(w.release)
+	require.NoError(t, <-done)
+
+	restored := path.Join(t.TempDir(), "restored")
+	require.NoError(t, Restore(restored, &w.buf))
+	n, err := NewLog(restored, Config{})
+	require.NoError(t, err)
+	defer n.Close()
+	for off := uint64(0); off < 10; off++ {
+		read, err := n.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		require.False(t, strings.HasPrefix(e.Name(), snapshotTmpPrefix), e.Name())
+	}
+}
+
+func TestSnapshotRemote(t *testing.T) {
+	remote, err := objstore.NewLocal(t.TempDir())
+	require.NoError(t, err)
+	log := newTierLog(t, remote, -1)
+	defer log.Close()
+	require.NoError(t, log.Offload())
+	require.NotEmpty(t, log.remote)
+
+	// the offloaded segments are in the snapshot
+	var buf bytes.Buffer
+	require.NoError(t, log.Snapshot(&buf))
+	restored := path.Join(t.TempDir(), "restored")
+	require.NoError(t, Restore(restored, &buf))
+	n, err := NewLog(restored, Config{})
+	require.NoError(t, err)
+	defer n.Close()
+	for off := uint64(0); off < 20; off++ {
+		read, err := n.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+}
+
+// TestSnapshotRestoreFaults takes snapshots and restores them through filesystems whose operations fail
+// at random: they either fail or produce a complete log, and a failed snapshot leaves nothing behind.
+func TestSnapshotRestoreFaults(t *testing.T) {
+	var failed, succeeded int
+	for seed := int64(1); seed <= 40; seed++ {
+		fs := newFaultFS(seed)
+		c := Config{FS: fs}
+		c.Segment.MaxStoreBytes = 128
+		dir := t.TempDir()
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			_, err := log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+
+		// only the snapshot's writes fail, not the flush of the buffered records
+		require.NoError(t, log.Sync())
+
+		var buf bytes.Buffer
+		fs.failRate = 0.2
+		err = log.Snapshot(&buf)
+		fs.disarm()
+		if err == nil {
+			restored := path.Join(t.TempDir(), "restored")
+			fs.failRate = 0.2
+			err = restore(fs, restored, &buf)
+			fs.disarm()
+			if err == nil {
+				n, err := NewLog(restored, Config{})
+				require.NoError(t, err, "seed %d", seed)
+				for off := uint64(0); off < 10; off++ {
+					read, err := n.Read(off)
+					require.NoError(t, err, "seed %d", seed)
+					require.Equal(t, []byte("hello world"), read.Value)
+				}
+				require.NoError(t, n.Close())
+			}
+		}
+		if err != nil {
+			failed++
+		} else {
+			succeeded++
+		}
+
+		// the links of a snapshot that couldn't remove them are removed when the log is opened again
+		require.NoError(t, log.Close())
+		log, err = NewLog(dir, c)
+		require.NoError(t, err)
+		tmps, err := filepath.Glob(filepath.Join(dir, snapshotTmpPrefix+"*"))
+		require.NoError(t, err)
+		require.Empty(t, tmps, "seed %d", seed)
+		require.NoError(t, log.Close())
+	}
+	require.NotZero(t, failed)
+	require.NotZero(t, succeeded)
+}
@@ -3,8 +3,12 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
-	"os"
+	"errors"
+	"io"
 	"sync"
+	"sync/atomic"
+
+	"github.com/tysonmote/gommap"
 )
 
 var (
@@ -15,26 +19,35 @@ const (
 	lenWidth = 8
 )
 
+// ErrStoreSealed is returned when appending to a store that was sealed.
+var ErrStoreSealed = errors.New("store is sealed")
+
 // Store represents a log file that can be appended record to and read record from.
 //
-// Embedding the `*os.File` pointer in the struct allows the `store` struct to access all the fields and methods of the `os.File` type, effectively inheriting its functionaly.
-// This makes it easy to use function from the `os` package to interact with the file, while also adding additional functionality for appending and reading data.
+// Embedding the `File` in the struct allows the `store` struct to access all the methods of the file, effectively inheriting its functionaly.
+// This makes it easy to interact with the file, while also adding additional functionality for appending and reading data.
 //
 // The `sync.Mutex` is used to ensure that only one goroutine can access the file at a time, preventing concurrent writes from interfering with each other.
 // The `*bufio.Writer` is used to buffer writes to the file, which can improve performance by reducing the number of system calls needed to write data.
 // The `size` fiel represents the current size of the file.
+//
+// Once the store's segment is closed for writes, `sealed` holds a read-only memory mapping of the file
+// so reads skip the mutex and the buffer. `mapMu` is held for reading while the mapping is read,
+// and `Close` takes it for writing so the mapping is never unmapped under a reader.
 type store struct {
-	*os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer
-	size uint64
+	File
+	mu     sync.Mutex
+	buf    *bufio.Writer
+	size   uint64
+	sealed atomic.Pointer[gommap.MMap]
+	mapMu  sync.RWMutex
 }
 
-// The `newStore` creates a `store` based on `*os.File` which represents a file that has already been opened.
+// The `newStore` creates a `store` based on a `File` which has already been opened.
 //
 // It returns a pointer to a `store` or a error if occurs.
-func newStore(f *os.File) (*store, error) {
-	fi, err := os.Stat(f.Name())
+func newStore(f File) (*store, error) {
+	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
@@ -53,6 +66,9 @@ func newStore(f *os.File) (*store, error) {
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.sealed.Load() != nil {
+		return 0, 0, ErrStoreSealed
+	}
 
 	pos = s.size
 	if err = binary.Write(s.buf, enc, uint64(len(p))); err != nil {
@@ -73,6 +89,39 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 // Read method reads data from the store at the specified position (`pos`).
 // It returns the buffer that holds the data. If there is an error reading the data, the method returns it.
 func (s *store) Read(pos uint64) ([]byte, error) {
+	var b []byte
+	err := s.View(pos, func(p []byte) error {
+		b = append([]byte(nil), p...)
+		return nil
+	})
+	return b, err
+}
+
+// View calls fn with the data stored at `pos`. The data of a sealed store is a slice of the memory mapping
+// which is only valid until fn returns, fn must not modify nor retain it.
+func (s *store) View(pos uint64, fn func(p []byte) error) error {
+	s.mapMu.RLock()
+	if m := s.sealed.Load(); m != nil {
+		defer s.mapMu.RUnlock()
+		size, err := mmapSlice(*m, pos, lenWidth)
+		if err != nil {
+			return err
+		}
+		p, err := mmapSlice(*m, pos+lenWidth, enc.Uint64(size))
+		if err != nil {
+			return err
+		}
+		return fn(p)
+	}
+	s.mapMu.RUnlock()
+	b, err := s.readUnsealed(pos)
+	if err != nil {
+		return err
+	}
+	return fn(b)
+}
+
+func (s *store) readUnsealed(pos uint64) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if err := s.buf.Flush(); err != nil {
@@ -90,10 +139,54 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 	return b, nil
 }
 
+// Next returns the position of the record that follows the one stored at `pos`.
+// It returns `io.EOF` when `pos` is at or past the end of the store.
+func (s *store) Next(pos uint64) (uint64, error) {
+	s.mapMu.RLock()
+	if m := s.sealed.Load(); m != nil {
+		defer s.mapMu.RUnlock()
+		if pos >= uint64(len(*m)) {
+			return 0, io.EOF
+		}
+		size, err := mmapSlice(*m, pos, lenWidth)
+		if err != nil {
+			return 0, err
+		}
+		return pos + lenWidth + enc.Uint64(size), nil
+	}
+	s.mapMu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pos >= s.size {
+		return 0, io.EOF
+	}
+	if err := s.buf.Flush(); err != nil {
+		return 0, err
+	}
+	size := make([]byte, lenWidth)
+	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+		return 0, err
+	}
+	return pos + lenWidth + enc.Uint64(size), nil
+}
+
 // The ReadAt reads data from the store at the specified offset.
 // It takes a byte slice p and an off argument as the offset from which to read the data.
-// It returns the number of bytes read and any error that occurred.
+// It returns the number of bytes read and any error that occurred, reading a closed store fails.
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
+	s.mapMu.RLock()
+	if m := s.sealed.Load(); m != nil {
+		defer s.mapMu.RUnlock()
+		if off >= int64(len(*m)) {
+			return 0, io.EOF
+		}
+		n := copy(p, (*m)[off:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	s.mapMu.RUnlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if err := s.buf.Flush(); err != nil {
@@ -103,15 +196,87 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
+// Sync flushes the buffer and commits the file to stable storage, the records appended before it survive crashes.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sync()
+}
+
+func (s *store) sync() error {
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+// Truncate drops the bytes of the store from `size` on, which must be the position of a record.
+// The truncation is synced so the dropped bytes can't come back after a crash.
+func (s *store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sealed.Load() != nil {
+		return ErrStoreSealed
+	}
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	return s.File.Sync()
+}
+
+// Seal syncs the file and memory maps it read-only, after which the store rejects appends.
+// Empty stores can't be mapped and keep using the buffered path.
+func (s *store) Seal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sealed.Load() != nil || s.size == 0 {
+		return nil
+	}
+	if err := s.sync(); err != nil {
+		return err
+	}
+	m, err := gommap.MapRegion(
+		s.File.Fd(), 0, int64(s.size),
+		gommap.PROT_READ,
+		gommap.MAP_SHARED,
+	)
+	if err != nil {
+		return err
+	}
+	s.sealed.Store(&m)
+	return nil
+}
+
 // The Close method closes the file that is represented by the store.
-// Before closing it, the method flushes the buffer to ensure that any data in the buffer is written to the fie.
+// Before closing it, the method flushes the buffer and syncs the file to ensure that any data in the buffer is written to the disk.
 // It returns an error if occurs during the closed.
+// The mapping of a sealed store is unmapped once the reads in progress are done.
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
+	s.mapMu.Lock()
+	m := s.sealed.Swap(nil)
+	s.mapMu.Unlock()
+	if m != nil {
+		if err := m.UnsafeUnmap(); err != nil {
+			return err
+		}
+	}
+	if err := s.sync(); err != nil {
 		return err
 	}
 
 	return s.File.Close()
 }
+
+// mmapSlice returns the `n` bytes of `m` starting at `pos`, without copying them.
+func mmapSlice(m gommap.MMap, pos, n uint64) ([]byte, error) {
+	if pos+n > uint64(len(m)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return m[pos : pos+n : pos+n], nil
+}
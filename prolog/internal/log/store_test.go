@@ -1,9 +1,11 @@
 package log
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -132,3 +134,104 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	}
 	return f, fi.Size(), nil
 }
+
+func TestStoreSeal(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_seal_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	s, err := newStore(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err = s.Append(write); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = s.Append(write); err != ErrStoreSealed {
+		t.Errorf("Expect %v to be equal %v", err, ErrStoreSealed)
+	}
+
+	var pos uint64
+	for i := 0; i < 3; i++ {
+		read, err := s.Read(pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(read, write) {
+			t.Errorf("Expect %v to be equal %v", read, write)
+		}
+		if pos, err = s.Next(pos); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = s.Next(pos); err != io.EOF {
+		t.Errorf("Expect %v to be equal %v", err, io.EOF)
+	}
+
+	b := make([]byte, width*4)
+	n, err := s.ReadAt(b, 0)
+	if err != io.EOF {
+		t.Errorf("Expect %v to be equal %v", err, io.EOF)
+	}
+	if uint64(n) != width*3 {
+		t.Errorf("Expect %v to be equal %v", n, width*3)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreCloseWhileReading(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		f, err := ioutil.TempFile("", "store_close_reading_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		s, err := newStore(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 1000; j++ {
+			if _, _, err = s.Append(write); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = s.Seal(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the readers get errors once the store is closed, the mapping isn't unmapped under them
+		var started, wg sync.WaitGroup
+		for r := 0; r < 4; r++ {
+			started.Add(1)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b := make([]byte, width*1000)
+				var once sync.Once
+				defer once.Do(started.Done)
+				for {
+					if _, err := s.ReadAt(b, 0); err != nil && err != io.EOF {
+						return
+					}
+					if _, err := s.Read(0); err != nil {
+						return
+					}
+					once.Do(started.Done)
+				}
+			}()
+		}
+		started.Wait()
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+	}
+}
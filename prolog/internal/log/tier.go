@@ -0,0 +1,477 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	api "github.com/lucaspere/go_projects/proglog/api/v1"
+	"github.com/lucaspere/go_projects/proglog/internal/objstore"
+)
+
+// tierCacheDir is the directory, inside the log's, where fetched remote segments are cached.
+const tierCacheDir = "tier-cache"
+
+// remoteSegment is a sealed segment stored in the tier's object store.
+type remoteSegment struct {
+	baseOffset, nextOffset uint64
+}
+
+// remoteKey returns the object key of a segment file, the offsets are padded so keys sort by offset.
+func remoteKey(baseOffset, nextOffset uint64, ext string) string {
+	return fmt.Sprintf("%020d-%020d%s", baseOffset, nextOffset, ext)
+}
+
+// tierCache holds the remote segments fetched by reads, evicting the least recently used ones.
+// The segments are fetched without holding `mu`, so a slow fetch only blocks the reads of its segment.
+type tierCache struct {
+	mu       sync.Mutex
+	dir      string
+	max      int
+	segments map[uint64]*cachedSegment
+	// order lists the base offsets of the fetched segments, least recently used first
+	order []uint64
+	// closed is set once the log is closed, the fetches done afterwards close their segment
+	closed bool
+}
+
+// cachedSegment is a remote segment fetched, or being fetched, into the cache. `ready` is closed
+// once the fetch is done, and `err` is its error. The reads of the segment hold `mu` for reading,
+// it's removed holding it for writing after which `segment` is nil.
+type cachedSegment struct {
+	ready   chan struct{}
+	err     error
+	mu      sync.RWMutex
+	segment *segment
+}
+
+// setupTier lists the segments already offloaded and starts the background offloading.
+func (l *Log) setupTier() error {
+	max := l.Config.Tier.CacheSegments
+	if max == 0 {
+		max = 2
+	}
+	l.cache = &tierCache{
+		dir:      path.Join(l.Dir, tierCacheDir),
+		max:      max,
+		segments: make(map[uint64]*cachedSegment),
+	}
+	l.remote = nil
+	if l.Config.Tier.Store == nil {
+		return nil
+	}
+	// the cache doesn't survive restarts
+	if err := os.RemoveAll(l.cache.dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(l.cache.dir, 0755); err != nil {
+		return err
+	}
+	keys, err := l.Config.Tier.Store.List(context.Background(), "")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		var r remoteSegment
+		if !strings.HasSuffix(key, ".store") {
+			continue
+		}
+		if _, err := fmt.Sscanf(key, "%d-%d.store", &r.baseOffset, &r.nextOffset); err != nil {
+			continue
+		}
+		l.remote = append(l.remote, r)
+	}
+	sort.Slice(l.remote, func(i, j int) bool {
+		return l.remote[i].baseOffset < l.remote[j].baseOffset
+	})
+
+	offloadc, done := make(chan struct{}, 1), make(chan struct{})
+	l.offloadc, l.offloadDone = offloadc, done
+	go func() {
+		defer close(done)
+		for range offloadc {
+			// failures are retried when the next segment is sealed
+			_ = l.Offload()
+		}
+	}()
+	return nil
+}
+
+// isRemote reports whether the segment starting at `baseOffset` was offloaded.
+func (l *Log) isRemote(baseOffset uint64) bool {
+	i := sort.Search(len(l.remote), func(i int) bool {
+		return l.remote[i].baseOffset >= baseOffset
+	})
+	return i < len(l.remote) && l.remote[i].baseOffset == baseOffset
+}
+
+// Offload uploads the sealed segments that aren't in the tier's object store yet, then removes
+// from disk the oldest offloaded ones beyond `Config.Tier.LocalSegments`.
+// The log calls it in the background whenever a segment is sealed.
+func (l *Log) Offload() error {
+	if l.Config.Tier.Store == nil {
+		return nil
+	}
+	l.offloadMu.Lock()
+	defer l.offloadMu.Unlock()
+
+	l.retain.RLock()
+	l.mu.RLock()
+	var pending []*segment
+	// Truncate may have removed every segment, the active one included
+	if n := len(l.segments); n > 0 {
+		for _, s := range l.segments[:n-1] {
+			if !l.isRemote(s.baseOffset) {
+				pending = append(pending, s)
+			}
+		}
+	}
+	l.mu.RUnlock()
+	var uploaded []*segment
+	var err error
+	for _, s := range pending {
+		if err = l.upload(s); err != nil {
+			break
+		}
+		uploaded = append(uploaded, s)
+	}
+	l.retain.RUnlock()
+
+	stale, rerr := l.offloaded(uploaded)
+	if err == nil {
+		err = rerr
+	}
+	for _, r := range stale {
+		if derr := l.deleteRemote(context.Background(), r); err == nil {
+			err = derr
+		}
+	}
+	return err
+}
+
+// offloaded adds the uploaded segments to the remote ones and removes from disk those beyond
+// `Config.Tier.LocalSegments`. It returns the uploaded segments that were removed by `Truncate`
+// or `SetStartOffset` during the upload, whose objects have to be deleted.
+func (l *Log) offloaded(uploaded []*segment) ([]remoteSegment, error) {
+	l.retain.Lock()
+	defer l.retain.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var stale []remoteSegment
+	for _, s := range uploaded {
+		r := remoteSegment{s.baseOffset, s.nextOffset}
+		if !l.hasSegment(s) || r.nextOffset <= l.startOffset {
+			stale = append(stale, r)
+			continue
+		}
+		l.remote = append(l.remote, r)
+	}
+	sort.Slice(l.remote, func(i, j int) bool {
+		return l.remote[i].baseOffset < l.remote[j].baseOffset
+	})
+
+	// the active segment is never offloaded, and segments are
+	// offloaded oldest first, so the evicted ones are a prefix
+	keep := l.Config.Tier.LocalSegments
+	if keep == 0 {
+		keep = 2
+	} else if keep < 0 {
+		keep = 0
+	}
+	evict := len(l.segments) - 1 - keep
+	for evict > 0 && l.isRemote(l.segments[0].baseOffset) {
+		if err := l.segments[0].Remove(); err != nil {
+			return stale, err
+		}
+		l.segments = l.segments[1:]
+		evict--
+	}
+	return stale, nil
+}
+
+// hasSegment reports whether `s` is still one of the log's local segments.
+func (l *Log) hasSegment(s *segment) bool {
+	for _, segment := range l.segments {
+		if segment == s {
+			return true
+		}
+	}
+	return false
+}
+
+// upload copies the sealed segment to the object store, the store file goes last since its key
+// is the one listed on startup.
+func (l *Log) upload(s *segment) error {
+	ctx := context.Background()
+	idx := s.index.mmap[:s.index.size]
+	if err := l.Config.Tier.Store.Put(
+		ctx, remoteKey(s.baseOffset, s.nextOffset, ".index"),
+		bytes.NewReader(idx), int64(len(idx)),
+	); err != nil {
+		return err
+	}
+	key, err := readFile(l.Config.fs(), keyFileName(s.store.Name()))
+	if err == nil {
+		err = l.Config.Tier.Store.Put(
+			ctx, remoteKey(s.baseOffset, s.nextOffset, ".key"),
+			bytes.NewReader(key), int64(len(key)),
+		)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return l.Config.Tier.Store.Put(
+		ctx, remoteKey(s.baseOffset, s.nextOffset, ".store"),
+		io.NewSectionReader(s.store, 0, int64(s.store.size)), int64(s.store.size),
+	)
+}
+
+// notifyOffload wakes the background offloading up without blocking.
+func (l *Log) notifyOffload() {
+	if l.offloadc == nil {
+		return
+	}
+	select {
+	case l.offloadc <- struct{}{}:
+	default:
+	}
+}
+
+// findRemote returns the remote segment holding `off`, if any.
+func (l *Log) findRemote(off uint64) (remoteSegment, bool) {
+	for _, r := range l.remote {
+		if r.baseOffset <= off && off < r.nextOffset {
+			return r, true
+		}
+	}
+	return remoteSegment{}, false
+}
+
+// readRemote reads the record at `off` from the remote segment, fetching it into the cache first if needed.
+func (l *Log) readRemote(r remoteSegment, off uint64) (*api.Record, error) {
+	for {
+		cs, err := l.cached(r)
+		if err != nil {
+			return nil, err
+		}
+		cs.mu.RLock()
+		if cs.segment == nil {
+			// evicted since, fetch it again
+			cs.mu.RUnlock()
+			continue
+		}
+		record, err := cs.segment.Read(off)
+		cs.mu.RUnlock()
+		return record, err
+	}
+}
+
+// cached returns the cached remote segment, fetching it unless it's cached or being fetched already,
+// in which case it waits for the fetch.
+func (l *Log) cached(r remoteSegment) (*cachedSegment, error) {
+	c := l.cache
+	c.mu.Lock()
+	if cs, ok := c.segments[r.baseOffset]; ok {
+		c.touch(r.baseOffset)
+		c.mu.Unlock()
+		<-cs.ready
+		return cs, cs.err
+	}
+	cs := &cachedSegment{ready: make(chan struct{})}
+	c.segments[r.baseOffset] = cs
+	c.mu.Unlock()
+
+	s, err := l.fetch(r)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer close(cs.ready)
+	cs.segment, cs.err = s, err
+	switch {
+	case err != nil:
+		delete(c.segments, r.baseOffset)
+		return cs, err
+	case c.closed:
+		cs.segment = nil
+		return cs, s.Close()
+	case c.segments[r.baseOffset] != cs:
+		// the remote segment was truncated during the fetch
+		cs.segment = nil
+		return cs, s.Remove()
+	}
+	c.order = append(c.order, r.baseOffset)
+	for len(c.order) > c.max {
+		if err = c.drop(c.order[0]); err != nil {
+			return cs, err
+		}
+	}
+	return cs, nil
+}
+
+// touch marks the segment as the most recently used one.
+func (c *tierCache) touch(base uint64) {
+	for i, b := range c.order {
+		if b == base {
+			c.order = append(append(c.order[:i], c.order[i+1:]...), base)
+			return
+		}
+	}
+}
+
+// drop removes the segment from the cache, once the reads in progress are done. A segment
+// still being fetched is removed by its fetch.
+func (c *tierCache) drop(base uint64) error {
+	cs, ok := c.segments[base]
+	if !ok {
+		return nil
+	}
+	delete(c.segments, base)
+	for i, b := range c.order {
+		if b == base {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	select {
+	case <-cs.ready:
+	default:
+		return nil
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.segment == nil {
+		return nil
+	}
+	err := cs.segment.Remove()
+	cs.segment = nil
+	return err
+}
+
+// fetch downloads the remote segment into the cache directory and opens it.
+func (l *Log) fetch(r remoteSegment) (*segment, error) {
+	var indexBytes uint64
+	for _, ext := range []string{".index", ".key", ".store"} {
+		n, err := l.download(
+			remoteKey(r.baseOffset, r.nextOffset, ext),
+			path.Join(l.cache.dir, fmt.Sprintf("%d%s", r.baseOffset, ext)),
+		)
+		// only encrypted segments have a key file
+		if err == objstore.ErrNotFound && ext == ".key" {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ext == ".index" {
+			indexBytes = n
+		}
+	}
+	c := l.Config
+	if c.Segment.MaxIndexBytes < indexBytes {
+		c.Segment.MaxIndexBytes = indexBytes
+	}
+	s, err := newSegment(l.cache.dir, r.baseOffset, c)
+	if err != nil {
+		return nil, err
+	}
+	return s, s.Seal()
+}
+
+func (l *Log) download(key, name string) (uint64, error) {
+	rc, err := l.Config.Tier.Store.Get(context.Background(), key)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	f, err := os.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, rc)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return uint64(n), err
+}
+
+// truncateRemote deletes the remote segments whose records are all below `lowest`.
+func (l *Log) truncateRemote(lowest uint64) error {
+	if l.Config.Tier.Store == nil {
+		return nil
+	}
+	ctx := context.Background()
+	var remote []remoteSegment
+	for _, r := range l.remote {
+		if r.nextOffset > lowest+1 {
+			remote = append(remote, r)
+			continue
+		}
+		if err := l.deleteRemote(ctx, r); err != nil {
+			return err
+		}
+		l.cache.mu.Lock()
+		err := l.cache.drop(r.baseOffset)
+		l.cache.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	l.remote = remote
+	return nil
+}
+
+// deleteRemote deletes the objects of the remote segment, the store first since its key is the one listed on startup.
+func (l *Log) deleteRemote(ctx context.Context, r remoteSegment) error {
+	for _, ext := range []string{".store", ".index", ".key"} {
+		if err := l.Config.Tier.Store.Delete(ctx, remoteKey(r.baseOffset, r.nextOffset, ext)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeTier stops the background offloading and closes the cached segments.
+func (l *Log) closeTier() error {
+	// notifyOffload reads the channel under `mu`, it mustn't send on it once closed
+	l.mu.Lock()
+	offloadc := l.offloadc
+	l.offloadc = nil
+	l.mu.Unlock()
+	if offloadc != nil {
+		close(offloadc)
+		<-l.offloadDone
+	}
+	if l.cache == nil {
+		return nil
+	}
+	c := l.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for base, cs := range c.segments {
+		delete(c.segments, base)
+		select {
+		case <-cs.ready:
+		default:
+			// closed by its fetch
+			continue
+		}
+		cs.mu.Lock()
+		var err error
+		if cs.segment != nil {
+			err = cs.segment.Close()
+			cs.segment = nil
+		}
+		cs.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	c.order = nil
+	return nil
+}
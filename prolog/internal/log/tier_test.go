@@ -0,0 +1,237 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/lucaspere/go_projects/proglog/api/v1"
+	"github.com/lucaspere/go_projects/proglog/internal/objstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	remote, err := objstore.NewLocal(path.Join(dir, "remote"))
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(path.Join(dir, "log"), 0755))
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Tier.Store = remote
+	c.Tier.LocalSegments = 1
+	c.Tier.CacheSegments = 1
+	log, err := NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+
+	record := &api.Record{Value: []byte("hello world")}
+	for i := uint64(0); i < 20; i++ {
+		off, err := log.Append(&api.Record{Value: record.Value})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	require.NoError(t, log.Offload())
+
+	// one sealed segment and the active one are left on disk
+	log.mu.RLock()
+	require.Len(t, log.segments, 2)
+	require.NotEmpty(t, log.remote)
+	localLowest := log.segments[0].baseOffset
+	log.mu.RUnlock()
+	require.Greater(t, localLowest, uint64(0))
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+
+	testTierRead := func(log *Log) {
+		// jump between remote segments to go through the cache eviction
+		for _, off := range []uint64{0, localLowest - 1, 1, 19} {
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, read.Offset)
+			require.Equal(t, record.Value, read.Value)
+		}
+		_, err = log.Read(20)
+		require.ErrorIs(t, err, ErrOffsetOutOfRange)
+	}
+	testTierRead(log)
+	require.NoError(t, log.Close())
+
+	// the remote segments are listed again on restart
+	log, err = NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+	testTierRead(log)
+
+	require.NoError(t, log.Truncate(localLowest-1))
+	_, err = log.Read(0)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+	keys, err := remote.List(context.Background(), "")
+	require.NoError(t, err)
+	for _, key := range keys {
+		require.False(t, strings.HasPrefix(key, fmt.Sprintf("%020d-", 0)), key)
+	}
+	require.NoError(t, log.Close())
+}
+
+// hookStore is an object store calling the hooks, when set, before putting and getting objects.
+type hookStore struct {
+	objstore.ObjectStore
+	put func(key string)
+	get func(key string)
+}
+
+func (s *hookStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if s.put != nil {
+		s.put(key)
+	}
+	return s.ObjectStore.Put(ctx, key, r, size)
+}
+
+func (s *hookStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if s.get != nil {
+		s.get(key)
+	}
+	return s.ObjectStore.Get(ctx, key)
+}
+
+func newTierLog(t *testing.T, store objstore.ObjectStore, localSegments int) *Log {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Tier.Store = store
+	c.Tier.LocalSegments = localSegments
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	return log
+}
+
+func TestTierOffloadTruncated(t *testing.T) {
+	remote, err := objstore.NewLocal(t.TempDir())
+	require.NoError(t, err)
+
+	// the first upload waits for Truncate to remove its segment
+	uploading, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	store := &hookStore{ObjectStore: remote, put: func(key string) {
+		if strings.HasSuffix(key, ".store") {
+			once.Do(func() {
+				close(uploading)
+				<-release
+			})
+		}
+	}}
+	log := newTierLog(t, store, 10)
+	<-uploading
+	truncated := make(chan error)
+	go func() {
+		truncated <- log.Truncate(2)
+	}()
+	// let Truncate wait for the upload
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	require.NoError(t, <-truncated)
+	require.NoError(t, log.Offload())
+
+	log.mu.RLock()
+	for _, r := range log.remote {
+		require.Greater(t, r.nextOffset, uint64(3), "truncated segment %d is remote", r.baseOffset)
+	}
+	log.mu.RUnlock()
+	keys, err := remote.List(context.Background(), "")
+	require.NoError(t, err)
+	for _, key := range keys {
+		require.False(t, strings.HasPrefix(key, fmt.Sprintf("%020d-", 0)), key)
+	}
+
+	// offloading a log whose segments were all truncated does nothing
+	require.NoError(t, log.Truncate(100))
+	require.NoError(t, log.Offload())
+	require.NoError(t, log.Close())
+}
+
+func TestTierLocalSegments(t *testing.T) {
+	for _, tc := range []struct {
+		localSegments, sealed int
+	}{
+		// zero keeps the default number of sealed segments
+		{localSegments: 0, sealed: 2},
+		{localSegments: 3, sealed: 3},
+		{localSegments: -1, sealed: 0},
+	} {
+		remote, err := objstore.NewLocal(t.TempDir())
+		require.NoError(t, err)
+		log := newTierLog(t, remote, tc.localSegments)
+		require.NoError(t, log.Offload())
+		log.mu.RLock()
+		require.Len(t, log.segments, tc.sealed+1, "LocalSegments %d", tc.localSegments)
+		log.mu.RUnlock()
+		require.NoError(t, log.Close())
+	}
+}
+
+func TestTierSlowFetch(t *testing.T) {
+	remote, err := objstore.NewLocal(t.TempDir())
+	require.NoError(t, err)
+
+	// the fetches of the first segment wait until released, and are counted
+	release := make(chan struct{})
+	var mu sync.Mutex
+	fetches := 0
+	store := &hookStore{ObjectStore: remote, get: func(key string) {
+		if strings.HasPrefix(key, fmt.Sprintf("%020d-", 0)) && strings.HasSuffix(key, ".store") {
+			mu.Lock()
+			fetches++
+			mu.Unlock()
+			<-release
+		}
+	}}
+	log := newTierLog(t, store, -1)
+	defer log.Close()
+	require.NoError(t, log.Offload())
+	log.mu.RLock()
+	require.GreaterOrEqual(t, len(log.remote), 2)
+	second := log.remote[1].baseOffset
+	log.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			read, err := log.Read(0)
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), read.Offset)
+		}()
+	}
+
+	// the other segments are read meanwhile
+	done := make(chan error)
+	go func() {
+		_, err := log.Read(second)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the read waited for the fetch of another segment")
+	}
+	close(release)
+	wg.Wait()
+	require.Equal(t, 1, fetches, "the segment was fetched once for both reads")
+}
@@ -0,0 +1,42 @@
+// Package objstore holds the object stores sealed log segments are offloaded to.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+)
+
+// ErrNotFound is returned when getting an object that doesn't exist.
+var ErrNotFound = errors.New("object not found")
+
+// ObjectStore is a flat key-value store of immutable blobs.
+type ObjectStore interface {
+	// Put stores the `size` bytes read from `r` under `key`, replacing any previous object.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get returns a reader of the object stored under `key`, the caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object stored under `key`, deleting a missing object isn't an error.
+	Delete(ctx context.Context, key string) error
+	// List returns the keys that start with `prefix`, in lexical order.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// FromEnv returns the object store configured from TIER_DIR for a local directory or
+// TIER_S3_* for an S3-compatible bucket. It's nil when neither is set.
+func FromEnv() (ObjectStore, error) {
+	if dir := os.Getenv("TIER_DIR"); len(dir) > 0 {
+		return NewLocal(dir)
+	}
+	if endpoint := os.Getenv("TIER_S3_ENDPOINT"); len(endpoint) > 0 {
+		return &S3{
+			Endpoint:  endpoint,
+			Bucket:    os.Getenv("TIER_S3_BUCKET"),
+			Region:    os.Getenv("TIER_S3_REGION"),
+			AccessKey: os.Getenv("TIER_S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("TIER_S3_SECRET_KEY"),
+		}, nil
+	}
+	return nil, nil
+}
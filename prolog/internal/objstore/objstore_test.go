@@ -0,0 +1,146 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objstore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewLocal(dir)
+	require.NoError(t, err)
+	testObjectStore(t, s)
+}
+
+func TestS3(t *testing.T) {
+	now := func() time.Time { return time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC) }
+	srv := httptest.NewServer(newFakeS3(t, "bucket", now))
+	defer srv.Close()
+
+	testObjectStore(t, &S3{
+		Endpoint:  srv.URL,
+		Bucket:    "bucket",
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		now:       now,
+	})
+
+	_, err := (&S3{Endpoint: srv.URL, Bucket: "bucket", Region: "us-east-1", AccessKey: "access", SecretKey: "wrong", now: now}).
+		List(context.Background(), "")
+	require.Error(t, err)
+}
+
+func testObjectStore(t *testing.T, s ObjectStore) {
+	ctx := context.Background()
+
+	_, err := s.Get(ctx, "missing")
+	require.Equal(t, ErrNotFound, err)
+	require.NoError(t, s.Delete(ctx, "missing"))
+
+	for _, key := range []string{"b.store", "a.store", "a.index"} {
+		require.NoError(t, s.Put(ctx, key, strings.NewReader("data of "+key), int64(len("data of "+key))))
+	}
+	// objects are replaced
+	require.NoError(t, s.Put(ctx, "a.store", strings.NewReader("new data"), 8))
+
+	r, err := s.Get(ctx, "a.store")
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, "new data", string(b))
+
+	keys, err := s.List(ctx, "a.")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.index", "a.store"}, keys)
+
+	require.NoError(t, s.Delete(ctx, "a.store"))
+	keys, err = s.List(ctx, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.index", "b.store"}, keys)
+}
+
+// newFakeS3 is a stand-in for an S3 bucket that checks the signature of every request.
+// It pages listings by two keys to exercise continuation tokens.
+func newFakeS3(t *testing.T, bucket string, now func() time.Time) http.Handler {
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	signer := &S3{Region: "us-east-1", AccessKey: "access", SecretKey: "secret", now: now}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		check := r.Clone(context.Background())
+		check.URL.Host = r.Host
+		signer.sign(check)
+		if check.Header.Get("Authorization") != r.Header.Get("Authorization") {
+			http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/"+bucket)
+		key = strings.TrimPrefix(key, "/")
+		switch {
+		case r.Method == http.MethodPut:
+			b, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			objects[key] = b
+		case r.Method == http.MethodGet && key == "":
+			prefix := r.URL.Query().Get("prefix")
+			var keys []string
+			for k := range objects {
+				if strings.HasPrefix(k, prefix) {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			start := 0
+			if token := r.URL.Query().Get("continuation-token"); token != "" {
+				start = sort.SearchStrings(keys, token)
+			}
+			var res listResult
+			for _, k := range keys[start:] {
+				if len(res.Contents) == 2 {
+					res.IsTruncated = true
+					res.NextContinuationToken = k
+					break
+				}
+				res.Contents = append(res.Contents, struct {
+					Key string `xml:"Key"`
+				}{k})
+			}
+			require.NoError(t, xml.NewEncoder(w).Encode(res))
+		case r.Method == http.MethodGet:
+			b, ok := objects[key]
+			if !ok {
+				http.Error(w, "NoSuchKey", http.StatusNotFound)
+				return
+			}
+			io.Copy(w, bytes.NewReader(b))
+		case r.Method == http.MethodDelete:
+			if _, ok := objects[key]; !ok {
+				http.Error(w, "NoSuchKey", http.StatusNotFound)
+				return
+			}
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
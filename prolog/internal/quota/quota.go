@@ -0,0 +1,153 @@
+// Package quota limits how fast each client can produce to the log.
+package quota
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idleTimeout is how long a client's buckets are kept after its last request.
+const idleTimeout = 10 * time.Minute
+
+// throttled counts the rejected requests by topic, served at /debug/vars.
+var throttled = expvar.NewMap("prolog_throttled_requests")
+
+// Handler serves the throttled requests counters as JSON, in the format of /debug/vars but
+// without the rest of expvar's variables such as the command line and the memory statistics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{%q: %s}\n", "prolog_throttled_requests", throttled.String())
+	})
+}
+
+// Quota is the rate a client may produce at, as token buckets of requests and bytes.
+// A zero rate means unlimited, and a zero burst defaults to one second worth of the rate.
+type Quota struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	RequestsBurst     float64 `json:"requests_burst"`
+	BytesPerSecond    float64 `json:"bytes_per_second"`
+	BytesBurst        float64 `json:"bytes_burst"`
+}
+
+// Config holds the quotas of every topic, `Default` applies to the topics without their own.
+type Config struct {
+	Default Quota            `json:"default"`
+	Topics  map[string]Quota `json:"topics"`
+}
+
+type bucket struct {
+	rate, burst, tokens float64
+}
+
+// wait returns how long until `n` tokens are available, zero when they're already there.
+func (b *bucket) wait(n float64) time.Duration {
+	if b.rate == 0 || b.tokens >= n {
+		return 0
+	}
+	// requests bigger than the burst wait until the bucket is full
+	need := math.Min(n, b.burst) - b.tokens
+	return time.Duration(math.Ceil(need / b.rate * float64(time.Second)))
+}
+
+func (b *bucket) refill(elapsed time.Duration) {
+	b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+}
+
+func newBucket(rate, burst float64) bucket {
+	if burst == 0 {
+		burst = rate
+	}
+	return bucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// client holds the buckets of a client for a topic.
+type client struct {
+	requests, bytes bucket
+	last            time.Time
+}
+
+type clientKey struct {
+	id, topic string
+}
+
+// Limiter tracks the buckets of every client and topic.
+type Limiter struct {
+	mu        sync.Mutex
+	config    Config
+	clients   map[clientKey]*client
+	lastSweep time.Time
+
+	// now is replaced by the tests to control time
+	now func() time.Time
+}
+
+func NewLimiter(c Config) *Limiter {
+	return &Limiter{
+		config:  c,
+		clients: make(map[clientKey]*client),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a request of `n` bytes from the client's buckets for the topic.
+// When the client is over its quota nothing is taken, and Allow returns false with
+// how long the client should wait before retrying.
+func (l *Limiter) Allow(id, topic string, n int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	key := clientKey{id, topic}
+	c, ok := l.clients[key]
+	if !ok {
+		q, ok := l.config.Topics[topic]
+		if !ok {
+			q = l.config.Default
+		}
+		c = &client{
+			requests: newBucket(q.RequestsPerSecond, q.RequestsBurst),
+			bytes:    newBucket(q.BytesPerSecond, q.BytesBurst),
+			last:     now,
+		}
+		l.clients[key] = c
+	}
+	c.requests.refill(now.Sub(c.last))
+	c.bytes.refill(now.Sub(c.last))
+	c.last = now
+
+	wait := c.requests.wait(1)
+	if w := c.bytes.wait(float64(n)); w > wait {
+		wait = w
+	}
+	if wait > 0 {
+		throttled.Add(topic, 1)
+		return false, wait
+	}
+	if c.requests.rate > 0 {
+		c.requests.tokens--
+	}
+	if c.bytes.rate > 0 {
+		// oversized requests drain the bucket into debt
+		c.bytes.tokens -= float64(n)
+	}
+	return true, 0
+}
+
+// sweep forgets the clients idle for long enough that their buckets are full again.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, c := range l.clients {
+		if now.Sub(c.last) > idleTimeout {
+			delete(l.clients, key)
+		}
+	}
+}
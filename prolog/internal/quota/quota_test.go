@@ -0,0 +1,81 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLimiter(c Config) (*Limiter, *time.Time) {
+	now := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLimiter(c)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestLimiterRequests(t *testing.T) {
+	l, now := newTestLimiter(Config{
+		Default: Quota{RequestsPerSecond: 2},
+	})
+
+	for i := 0; i < 2; i++ {
+		ok, _ := l.Allow("client", "topic", 0)
+		require.True(t, ok)
+	}
+	ok, wait := l.Allow("client", "topic", 0)
+	require.False(t, ok)
+	require.Equal(t, 500*time.Millisecond, wait)
+
+	// clients have their own buckets
+	ok, _ = l.Allow("other", "topic", 0)
+	require.True(t, ok)
+
+	*now = now.Add(wait)
+	ok, _ = l.Allow("client", "topic", 0)
+	require.True(t, ok)
+}
+
+func TestLimiterBytes(t *testing.T) {
+	l, now := newTestLimiter(Config{
+		Default: Quota{BytesPerSecond: 100},
+		Topics: map[string]Quota{
+			"unlimited": {},
+		},
+	})
+
+	ok, _ := l.Allow("client", "topic", 60)
+	require.True(t, ok)
+	ok, wait := l.Allow("client", "topic", 60)
+	require.False(t, ok)
+	require.Equal(t, 200*time.Millisecond, wait)
+
+	// a request bigger than the burst goes through once the bucket is full,
+	// and leaves the bucket in debt
+	*now = now.Add(time.Second)
+	ok, _ = l.Allow("client", "topic", 300)
+	require.True(t, ok)
+	ok, wait = l.Allow("client", "topic", 1)
+	require.False(t, ok)
+	require.Equal(t, 2*time.Second+10*time.Millisecond, wait)
+
+	// topics have their own quotas
+	for i := 0; i < 10; i++ {
+		ok, _ = l.Allow("client", "unlimited", 1000)
+		require.True(t, ok)
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	l, now := newTestLimiter(Config{
+		Default: Quota{RequestsPerSecond: 1},
+	})
+	ok, _ := l.Allow("client", "topic", 0)
+	require.True(t, ok)
+	require.Len(t, l.clients, 1)
+
+	*now = now.Add(idleTimeout + time.Minute)
+	ok, _ = l.Allow("other", "topic", 0)
+	require.True(t, ok)
+	require.Len(t, l.clients, 1)
+}
@@ -2,16 +2,54 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
+	api "github.com/lucaspere/go_projects/proglog/api/v1"
+	"github.com/lucaspere/go_projects/proglog/internal/log"
+	"github.com/lucaspere/go_projects/proglog/internal/quota"
+	"google.golang.org/protobuf/proto"
 )
 
-func NewHTTPServer(addr string) *http.Server {
-	httpsrv := newHTTPServer()
+// CommitLog is the log the server appends records to and reads them from.
+// The admin endpoints take its snapshots, move its start offset, list and roll its segments and register its schemas.
+type CommitLog interface {
+	Append(*api.Record) (uint64, error)
+	Read(uint64) (*api.Record, error)
+	Snapshot(io.Writer) error
+	LowestOffset() (uint64, error)
+	SetStartOffset(uint64) error
+	Segments() []log.SegmentInfo
+	Roll() error
+	Duplicate(*api.Record) (uint64, bool)
+	RegisterSchema(log.Schema) (uint32, error)
+}
+
+// Config configures the server: the log it serves, under which topic name, and how producers are throttled.
+// A nil `Limiter` lets producers append as fast as they can.
+type Config struct {
+	CommitLog CommitLog
+	Topic     string
+	Limiter   *quota.Limiter
+}
+
+func NewHTTPServer(addr string, config Config) *http.Server {
+	httpsrv := newHTTPServer(config)
 	r := mux.NewRouter()
 	r.HandleFunc("/", httpsrv.handleProduce).Methods("POST")
 	r.HandleFunc("/", httpsrv.handleConsume).Methods("GET")
+	r.HandleFunc("/admin/snapshot", httpsrv.handleSnapshot).Methods("GET")
+	r.HandleFunc("/admin/start-offset", httpsrv.handleStartOffset).Methods("POST")
+	r.HandleFunc("/admin/segments", httpsrv.handleSegments).Methods("GET")
+	r.HandleFunc("/admin/roll", httpsrv.handleRoll).Methods("POST")
+	r.HandleFunc("/admin/schemas", httpsrv.handleRegisterSchema).Methods("POST")
+	// only the quotas' metrics, the other variables of expvar are none of the clients' business
+	r.Handle("/debug/vars", quota.Handler()).Methods("GET")
 
 	return &http.Server{
 		Addr:    addr,
@@ -20,17 +58,27 @@ func NewHTTPServer(addr string) *http.Server {
 }
 
 type httpServer struct {
-	Log *Log
+	Log     CommitLog
+	Topic   string
+	Limiter *quota.Limiter
 }
 
-func newHTTPServer() *httpServer {
+func newHTTPServer(config Config) *httpServer {
+	topic := config.Topic
+	if topic == "" {
+		topic = "default"
+	}
 	return &httpServer{
-		Log: NewLog(),
+		Log:     config.CommitLog,
+		Topic:   topic,
+		Limiter: config.Limiter,
 	}
 }
 
+// ProduceRequest carries the record to append. Idempotent producers set the record's
+// `producer_id` and `sequence`, and get the original offset back when they retry.
 type ProduceRequest struct {
-	Record Record `json:"record"`
+	Record *api.Record `json:"record"`
 }
 
 type ProduceResponse struct {
@@ -42,23 +90,53 @@ type ConsumeRequest struct {
 }
 
 type ConsumeResponse struct {
-	Record Record `json:"record"`
+	Record *api.Record `json:"record"`
 }
 
 func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 	var req ProduceRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
+	if err == nil && req.Record == nil {
+		err = errors.New("missing record")
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	off, err := s.Log.Append(req.Record)
+	var off uint64
+	if s.Limiter != nil {
+		// retries of records already appended don't use the quota
+		var dup bool
+		if off, dup = s.Log.Duplicate(req.Record); dup {
+			s.writeProduceResponse(w, off)
+			return
+		}
+		ok, wait := s.Limiter.Allow(clientID(r), s.Topic, proto.Size(req.Record))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "produce quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+	}
+	off, err = s.Log.Append(req.Record)
+	if errors.Is(err, log.ErrOutOfOrderSequence) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, log.ErrInvalidRecord) || errors.Is(err, log.ErrUnknownSchemaVersion) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.writeProduceResponse(w, off)
+}
+
+func (s *httpServer) writeProduceResponse(w http.ResponseWriter, off uint64) {
 	res := ProduceResponse{Offset: off}
-	err = json.NewEncoder(w).Encode(res)
+	err := json.NewEncoder(w).Encode(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -73,7 +151,7 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	record, err := s.Log.Read(req.Offset)
-	if err == ErrOffsetNotFound {
+	if errors.Is(err, log.ErrOffsetOutOfRange) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
@@ -88,3 +166,138 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// handleSnapshot streams a tar snapshot of the log, see `log.Restore` to rebuild a data directory from it.
+func (s *httpServer) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-tar")
+	sw := &startedWriter{w: w}
+	if err := s.Log.Snapshot(sw); err != nil {
+		if sw.started {
+			// the status is already sent, abort the response so the client
+			// doesn't take the truncated archive for a complete one
+			panic(http.ErrAbortHandler)
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// startedWriter records whether `w` was written to, the first write to a response sends its status.
+type startedWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (s *startedWriter) Write(p []byte) (int, error) {
+	s.started = true
+	return s.w.Write(p)
+}
+
+// StartOffsetRequest moves the log start offset forward, hiding the records below `Offset`.
+type StartOffsetRequest struct {
+	Offset uint64 `json:"offset"`
+}
+
+// StartOffsetResponse carries the lowest offset consumers can read once the start offset moved.
+type StartOffsetResponse struct {
+	LowestOffset uint64 `json:"lowest_offset"`
+}
+
+func (s *httpServer) handleStartOffset(w http.ResponseWriter, r *http.Request) {
+	var req StartOffsetRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = s.Log.SetStartOffset(req.Offset)
+	if errors.Is(err, log.ErrOffsetOutOfRange) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	off, err := s.Log.LowestOffset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res := StartOffsetResponse{LowestOffset: off}
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+type SegmentsResponse struct {
+	Segments []log.SegmentInfo `json:"segments"`
+}
+
+func (s *httpServer) handleSegments(w http.ResponseWriter, r *http.Request) {
+	res := SegmentsResponse{Segments: s.Log.Segments()}
+	err := json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleRoll seals the active segment, which starts offloading it when the log is tiered.
+// It responds with the segments that follow the roll.
+func (s *httpServer) handleRoll(w http.ResponseWriter, r *http.Request) {
+	if err := s.Log.Roll(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.handleSegments(w, r)
+}
+
+// RegisterSchemaRequest carries a new version of the log's schema, its `Version` is assigned by the log.
+type RegisterSchemaRequest struct {
+	Schema log.Schema `json:"schema"`
+}
+
+// RegisterSchemaResponse carries the version assigned to the registered schema.
+type RegisterSchemaResponse struct {
+	Version uint32 `json:"version"`
+}
+
+func (s *httpServer) handleRegisterSchema(w http.ResponseWriter, r *http.Request) {
+	var req RegisterSchemaRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	version, err := s.Log.RegisterSchema(req.Schema)
+	if errors.Is(err, log.ErrInvalidSchema) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res := RegisterSchemaResponse{Version: version}
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// clientID identifies the client quotas apply to: the common name of its TLS certificate
+// when it has one, its IP address otherwise.
+func clientID(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
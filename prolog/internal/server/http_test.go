@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	api "github.com/lucaspere/go_projects/proglog/api/v1"
+	"github.com/lucaspere/go_projects/proglog/internal/log"
+	"github.com/lucaspere/go_projects/proglog/internal/quota"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	return newTestServerWithLimiter(t, nil)
+}
+
+func newTestServerWithLimiter(t *testing.T, limiter *quota.Limiter) *httptest.Server {
+	t.Helper()
+	return newTestServerWithConfig(t, Config{
+		CommitLog: newTestLog(t),
+		Limiter:   limiter,
+	})
+}
+
+func newTestServerWithConfig(t *testing.T, config Config) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(NewHTTPServer("", config).Handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestLog(t *testing.T) *log.Log {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	commitLog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { commitLog.Close() })
+	return commitLog
+}
+
+func produce(t *testing.T, url string, record *api.Record) (*http.Response, ProduceResponse) {
+	t.Helper()
+	b, err := json.Marshal(ProduceRequest{Record: record})
+	require.NoError(t, err)
+	res, err := http.Post(url, "application/json", bytes.NewReader(b))
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	var got ProduceResponse
+	if res.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&got))
+	}
+	return res, got
+}
+
+func TestHTTPProduceIdempotent(t *testing.T) {
+	srv := newTestServer(t)
+
+	for seq := uint64(0); seq < 2; seq++ {
+		res, got := produce(t, srv.URL, &api.Record{
+			Value:      []byte("hello world"),
+			ProducerId: "producer",
+			Sequence:   seq,
+		})
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, seq, got.Offset)
+	}
+
+	res, got := produce(t, srv.URL, &api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: "producer",
+		Sequence:   0,
+	})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, uint64(0), got.Offset)
+
+	res, _ = produce(t, srv.URL, &api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: "producer",
+		Sequence:   7,
+	})
+	require.Equal(t, http.StatusConflict, res.StatusCode)
+}
+
+func TestHTTPConsume(t *testing.T) {
+	srv := newTestServer(t)
+	_, got := produce(t, srv.URL, &api.Record{Value: []byte("hello world")})
+
+	consume := func(off uint64) *http.Response {
+		b, err := json.Marshal(ConsumeRequest{Offset: off})
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodGet, srv.URL, bytes.NewReader(b))
+		require.NoError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+
+	res := consume(got.Offset)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var read ConsumeResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&read))
+	require.Equal(t, []byte("hello world"), read.Record.Value)
+
+	res = consume(got.Offset + 1)
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestHTTPSnapshot(t *testing.T) {
+	srv := newTestServer(t)
+	_, got := produce(t, srv.URL, &api.Record{Value: []byte("hello world")})
+
+	res, err := http.Get(srv.URL + "/admin/snapshot")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/x-tar", res.Header.Get("Content-Type"))
+
+	dir, err := ioutil.TempDir("", "server-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, log.Restore(dir, res.Body))
+
+	restored, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer restored.Close()
+	read, err := restored.Read(got.Offset)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+}
+
+func TestHTTPProduceQuota(t *testing.T) {
+	srv := newTestServerWithLimiter(t, quota.NewLimiter(quota.Config{
+		Default: quota.Quota{RequestsPerSecond: 0.1, RequestsBurst: 2},
+	}))
+
+	for i := 0; i < 2; i++ {
+		res, _ := produce(t, srv.URL, &api.Record{Value: []byte("hello world")})
+		require.Equal(t, http.StatusOK, res.StatusCode)
+	}
+	res, _ := produce(t, srv.URL, &api.Record{Value: []byte("hello world")})
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	require.Equal(t, "10", res.Header.Get("Retry-After"))
+
+	res, err := http.Get(srv.URL + "/debug/vars")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var vars map[string]json.RawMessage
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&vars))
+	// the rest of expvar isn't exposed
+	require.Len(t, vars, 1)
+	var throttled map[string]int
+	require.NoError(t, json.Unmarshal(vars["prolog_throttled_requests"], &throttled))
+	require.Equal(t, 1, throttled["default"])
+}
+
+func TestHTTPProduceQuotaRetries(t *testing.T) {
+	srv := newTestServerWithLimiter(t, quota.NewLimiter(quota.Config{
+		Default: quota.Quota{RequestsPerSecond: 0.1, RequestsBurst: 2},
+	}))
+
+	// the retries of appended records don't use the quota
+	for i := 0; i < 3; i++ {
+		res, got := produce(t, srv.URL, &api.Record{
+			Value:      []byte("hello world"),
+			ProducerId: "producer",
+			Sequence:   0,
+		})
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, uint64(0), got.Offset)
+	}
+	res, got := produce(t, srv.URL, &api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: "producer",
+		Sequence:   1,
+	})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, uint64(1), got.Offset)
+	res, _ = produce(t, srv.URL, &api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: "producer",
+		Sequence:   2,
+	})
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+}
+
+func TestHTTPAdmin(t *testing.T) {
+	srv := newTestServer(t)
+	for i := 0; i < 3; i++ {
+		produce(t, srv.URL, &api.Record{Value: []byte("hello world")})
+	}
+
+	res, err := http.Post(srv.URL+"/admin/roll", "application/json", nil)
+	require.NoError(t, err)
+	var segments SegmentsResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&segments))
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Len(t, segments.Segments, 2)
+	require.Equal(t, uint64(3), segments.Segments[1].BaseOffset)
+
+	setStartOffset := func(off uint64) (*http.Response, StartOffsetResponse) {
+		b, err := json.Marshal(StartOffsetRequest{Offset: off})
+		require.NoError(t, err)
+		res, err := http.Post(srv.URL+"/admin/start-offset", "application/json", bytes.NewReader(b))
+		require.NoError(t, err)
+		defer res.Body.Close()
+		var got StartOffsetResponse
+		if res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&got))
+		}
+		return res, got
+	}
+	res, got := setStartOffset(2)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, uint64(2), got.LowestOffset)
+	res, _ = setStartOffset(10)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, err = http.Get(srv.URL + "/admin/segments")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&segments))
+	require.Len(t, segments.Segments, 2)
+	require.True(t, segments.Segments[1].Active)
+}
+
+func TestHTTPRegisterSchema(t *testing.T) {
+	srv := newTestServer(t)
+
+	register := func(schema log.Schema) (*http.Response, RegisterSchemaResponse) {
+		b, err := json.Marshal(RegisterSchemaRequest{Schema: schema})
+		require.NoError(t, err)
+		res, err := http.Post(srv.URL+"/admin/schemas", "application/json", bytes.NewReader(b))
+		require.NoError(t, err)
+		defer res.Body.Close()
+		var got RegisterSchemaResponse
+		if res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&got))
+		}
+		return res, got
+	}
+	res, got := register(log.Schema{
+		Type:       log.SchemaJSON,
+		Definition: []byte(`{"type": "object", "required": ["name"]}`),
+	})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, uint32(1), got.Version)
+	res, _ = register(log.Schema{Type: log.SchemaJSON, Definition: []byte(`{"type": 12}`)})
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// the records are validated against the registered schema
+	res, _ = produce(t, srv.URL, &api.Record{Value: []byte(`{"name": "prolog"}`)})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res, _ = produce(t, srv.URL, &api.Record{Value: []byte(`{}`)})
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res, _ = produce(t, srv.URL, &api.Record{Value: []byte(`{"name": "prolog"}`), SchemaVersion: 2})
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+// snapshotFailLog is a log whose snapshots fail after writing `written`.
+type snapshotFailLog struct {
+	CommitLog
+	written []byte
+}
+
+func (l snapshotFailLog) Snapshot(w io.Writer) error {
+	if len(l.written) > 0 {
+		if _, err := w.Write(l.written); err != nil {
+			return err
+		}
+	}
+	return errors.New("snapshot failed")
+}
+
+func TestHTTPSnapshotFailure(t *testing.T) {
+	// nothing was sent yet, the client gets the error
+	srv := newTestServerWithConfig(t, Config{CommitLog: snapshotFailLog{CommitLog: newTestLog(t)}})
+	res, err := http.Get(srv.URL + "/admin/snapshot")
+	require.NoError(t, err)
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusInternalServerError, res.StatusCode)
+	require.Equal(t, "snapshot failed\n", string(b))
+
+	// midway, the response is aborted rather than ended as if the archive was complete
+	srv = newTestServerWithConfig(t, Config{CommitLog: snapshotFailLog{
+		CommitLog: newTestLog(t),
+		written:   make([]byte, 64<<10),
+	}})
+	srv.Config.ErrorLog = stdlog.New(io.Discard, "", 0)
+	res, err = http.Get(srv.URL + "/admin/snapshot")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	_, err = io.ReadAll(res.Body)
+	require.Error(t, err)
+}